@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	glass "github.com/glasslabs/looking-glass"
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	flagDevModule = "module"
+	flagDevName   = "name"
+)
+
+const devWatchInterval = 500 * time.Millisecond
+
+func dev(ctx context.Context, cmd *cli.Command) error {
+	secrets := module.NewSecrets(nil)
+	log, err := newLogger(cmd, secrets.Writer(os.Stdout))
+	if err != nil {
+		return err
+	}
+
+	srcDir, err := filepath.Abs(cmd.String(flagDevModule))
+	if err != nil {
+		return fmt.Errorf("could not resolve module directory: %w", err)
+	}
+	name := cmd.String(flagDevName)
+	if name == "" {
+		name = filepath.Base(srcDir)
+	}
+
+	log.Info("Starting Looking Glass in development mode", lctx.Str("version", version), lctx.Str("module", name))
+
+	ids, err := loadIdentities(cmd.String(flagSecretsKey))
+	if err != nil {
+		return err
+	}
+	secretVals, err := loadSecrets(cmd.String(flagSecretsFile), ids)
+	if err != nil {
+		return err
+	}
+	secrets.Update(secretVals)
+
+	cfg, err := loadConfig(cmd.String(flagConfigFile), secretVals)
+	if err != nil {
+		return err
+	}
+
+	// The module keeps its configuration when it is in the configuration
+	// file, but is run from its build.
+	desc := module.Descriptor{
+		Name:     name,
+		Position: module.Position{Vertical: module.Middle, Horizontal: module.Center},
+	}
+	mods := make([]module.Descriptor, 0, len(cfg.Modules))
+	for _, m := range cfg.Modules {
+		if m.Name == name {
+			desc = m
+			continue
+		}
+		mods = append(mods, m)
+	}
+	cfg.Modules = mods
+
+	// The build replaces the source of the module, which would otherwise
+	// select its runner, e.g. the in-process runner for go:// modules.
+	desc.URI, desc.Path, desc.Version = "", "", ""
+	desc.SHA256, desc.Signature = "", ""
+	desc.Runtime = module.RuntimeWASI
+
+	modPath := cmd.String(flagModPath)
+	execCtx, err := newExecContext(modPath, cmd.String(flagAssetsPath), secrets)
+	if err != nil {
+		return err
+	}
+	// Builds are kept apart from the module cache, and removed on exit.
+	buildDir, err := os.MkdirTemp("", "glass-dev-")
+	if err != nil {
+		return fmt.Errorf("could not create build directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(buildDir) }()
+	out := filepath.Join(buildDir, name+".wasm")
+
+	builds := watchModule(ctx, srcDir, out, desc, log)
+
+	if err = glass.Dev(ctx, cfg, builds, modPath, execCtx, log); err != nil {
+		log.Error("Looking Glass Shutdown", lctx.Err(err))
+
+		return err
+	}
+
+	log.Info("Looking Glass Shutdown")
+
+	return nil
+}
+
+// watchModule polls the source directory of the module, building it to
+// out when it changes, and sending each build. The module is built once
+// when the watch starts.
+func watchModule(ctx context.Context, dir, out string, desc module.Descriptor, log *logger.Logger) <-chan glass.Build {
+	ch := make(chan glass.Build)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(devWatchInterval)
+		defer ticker.Stop()
+
+		var state string
+		for {
+			newState, err := sourceState(dir)
+			switch {
+			case err != nil:
+				log.Error("Could not read module source", lctx.Str("module", desc.Name), lctx.Err(err))
+			case newState != state:
+				state = newState
+
+				log.Info("Building module", lctx.Str("module", desc.Name), lctx.Str("dir", dir))
+
+				b, err := buildModule(ctx, dir, out)
+				if ctx.Err() != nil {
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- glass.Build{Module: desc, WASM: b, Err: err}:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return ch
+}
+
+// sourceState returns a digest of the state of the files in the source
+// directory dir. Hidden files and directories are ignored, as the go
+// tool ignores them.
+func sourceState(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && (strings.HasPrefix(d.Name(), ".") || strings.HasPrefix(d.Name(), "_")) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(h, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildModule builds the module in dir for wasip1 to out with the local Go
+// toolchain, returning the module. The error of a failed build is the
+// compiler output.
+func buildModule(ctx context.Context, dir, out string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("building module: %w", err)
+	}
+
+	b, err := os.ReadFile(filepath.Clean(out))
+	if err != nil {
+		return nil, fmt.Errorf("reading module: %w", err)
+	}
+	return b, nil
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"os"
+	"io"
 
 	"github.com/hamba/logger/v2"
 	"github.com/hamba/logger/v2/ctx"
 	"github.com/urfave/cli/v3"
 )
 
-func newLogger(cmd *cli.Command) (*logger.Logger, error) {
+func newLogger(cmd *cli.Command, w io.Writer) (*logger.Logger, error) {
 	str := cmd.String(flagLogLevel)
 	if str == "" {
 		str = "info"
@@ -28,7 +28,7 @@ func newLogger(cmd *cli.Command) (*logger.Logger, error) {
 		fields = append(fields, ctx.Str(k, v))
 	}
 
-	return logger.New(os.Stdout, fmtr, lvl).With(fields...), nil
+	return logger.New(w, fmtr, lvl).With(fields...), nil
 }
 
 func newLogFormatter(cmd *cli.Command) logger.Formatter {
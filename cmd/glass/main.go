@@ -17,8 +17,10 @@ import (
 const (
 	flagConfigFile  = "config"
 	flagSecretsFile = "secrets"
+	flagSecretsKey  = "secrets.key"
 	flagAssetsPath  = "assets"
 	flagModPath     = "modules"
+	flagWatch       = "watch"
 	flagLogFormat   = "log.format"
 	flagLogLevel    = "log.level"
 	flagLogCtx      = "log.ctx"
@@ -32,13 +34,72 @@ var commands = []*cli.Command{
 	{
 		Name:  "run",
 		Usage: "Run looking glass",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    flagSecretsFile,
+				Aliases: []string{"s"},
+				Usage:   "The path to the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsFile)),
+			},
+			&cli.StringFlag{
+				Name:    flagSecretsKey,
+				Usage:   "The age identity, or path to an identity file, decrypting the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsKey)),
+			},
+			&cli.StringFlag{
+				Name:     flagConfigFile,
+				Aliases:  []string{"c"},
+				Usage:    "The path to the configuration file.",
+				Required: true,
+				Sources:  cli.EnvVars(strcase.ToSNAKE(flagConfigFile)),
+			},
+			&cli.StringFlag{
+				Name:     flagAssetsPath,
+				Aliases:  []string{"a"},
+				Usage:    "The path to the assets directory.",
+				Required: true,
+				Sources:  cli.EnvVars(strcase.ToSNAKE(flagAssetsPath)),
+			},
+			&cli.StringFlag{
+				Name:     flagModPath,
+				Aliases:  []string{"m"},
+				Usage:    "The path to the module cache directory.",
+				Required: true,
+				Sources:  cli.EnvVars(strcase.ToSNAKE(flagModPath)),
+			},
+			&cli.BoolFlag{
+				Name:    flagWatch,
+				Value:   true,
+				Usage:   "Reload modules when the configuration or secrets file changes.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagWatch)),
+			},
+		}, newLogFlags()...),
+		Action: run,
+	},
+	{
+		Name:  "dev",
+		Usage: "Run looking glass, rebuilding and replacing a module when its source changes",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:     flagDevModule,
+				Usage:    "The path to the Go source directory of the module.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  flagDevName,
+				Usage: "The name of the module. Defaults to the name of the source directory.",
+			},
 			&cli.StringFlag{
 				Name:    flagSecretsFile,
 				Aliases: []string{"s"},
 				Usage:   "The path to the secrets file.",
 				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsFile)),
 			},
+			&cli.StringFlag{
+				Name:    flagSecretsKey,
+				Usage:   "The age identity, or path to an identity file, decrypting the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsKey)),
+			},
 			&cli.StringFlag{
 				Name:     flagConfigFile,
 				Aliases:  []string{"c"},
@@ -60,28 +121,138 @@ var commands = []*cli.Command{
 				Required: true,
 				Sources:  cli.EnvVars(strcase.ToSNAKE(flagModPath)),
 			},
+		}, newLogFlags()...),
+		Action: dev,
+	},
+	{
+		Name:  "modules",
+		Usage: "Manage the module cache",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:     flagModPath,
+				Aliases:  []string{"m"},
+				Usage:    "The path to the module cache directory.",
+				Required: true,
+				Sources:  cli.EnvVars(strcase.ToSNAKE(flagModPath)),
+			},
 			&cli.StringFlag{
-				Name:     flagLogFormat,
-				Category: categoryLog,
-				Usage:    "Specify the format of logs. Supported formats: 'logfmt', 'json', 'console'",
-				Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogFormat)),
+				Name:    flagConfigFile,
+				Aliases: []string{"c"},
+				Usage:   "The path to the configuration file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagConfigFile)),
 			},
 			&cli.StringFlag{
-				Name:     flagLogLevel,
-				Category: categoryLog,
-				Value:    "info",
-				Usage:    "Specify the log level. e.g. 'debug', 'info', 'error'.",
-				Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogLevel)),
+				Name:    flagSecretsFile,
+				Aliases: []string{"s"},
+				Usage:   "The path to the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsFile)),
+			},
+			&cli.StringFlag{
+				Name:    flagSecretsKey,
+				Usage:   "The age identity, or path to an identity file, decrypting the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsKey)),
+			},
+		}, newLogFlags()...),
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the cached modules",
+				Action: modulesList,
+			},
+			{
+				Name:   "fetch",
+				Usage:  "Download the modules in the configuration into the cache",
+				Action: modulesFetch,
 			},
-			&cli.StringMapFlag{
-				Name:     flagLogCtx,
-				Category: categoryLog,
-				Usage:    "A list of context field appended to every log. Format: key=value.",
-				Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogCtx)),
+			{
+				Name:   "prune",
+				Usage:  "Remove cached modules that are not in the configuration",
+				Action: modulesPrune,
+			},
+			{
+				Name:   "verify",
+				Usage:  "Verify cached modules against the digest recorded when downloaded",
+				Action: modulesVerify,
 			},
 		},
-		Action: run,
 	},
+	{
+		Name:  "secrets",
+		Usage: "Manage an encrypted secrets file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     flagSecretsFile,
+				Aliases:  []string{"s"},
+				Usage:    "The path to the secrets file.",
+				Required: true,
+				Sources:  cli.EnvVars(strcase.ToSNAKE(flagSecretsFile)),
+			},
+			&cli.StringFlag{
+				Name:    flagSecretsKey,
+				Usage:   "The age identity, or path to an identity file, decrypting the secrets file.",
+				Sources: cli.EnvVars(strcase.ToSNAKE(flagSecretsKey)),
+			},
+			&cli.StringSliceFlag{
+				Name:  flagSecretsRecipient,
+				Usage: "An age recipient to encrypt the secrets file to, in addition to the recipient of the key.",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "decrypt",
+				Usage:  "Print the decrypted secrets file",
+				Action: secretsDecrypt,
+			},
+			{
+				Name:  "encrypt",
+				Usage: "Encrypt a plain text secrets file in place",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  flagSecretsFormat,
+						Value: "age",
+						Usage: "The encrypted format. Supported formats: 'age' encrypts the file, 'values' encrypts each value.",
+					},
+				},
+				Action: secretsEncrypt,
+			},
+			{
+				Name:  "edit",
+				Usage: "Edit the secrets file in $EDITOR, keeping it encrypted",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  flagSecretsFormat,
+						Value: "age",
+						Usage: "The encrypted format of a new secrets file. Supported formats: 'age', 'values'.",
+					},
+				},
+				Action: secretsEdit,
+			},
+		},
+	},
+}
+
+func newLogFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     flagLogFormat,
+			Category: categoryLog,
+			Usage:    "Specify the format of logs. Supported formats: 'logfmt', 'json', 'console'",
+			Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogFormat)),
+		},
+		&cli.StringFlag{
+			Name:     flagLogLevel,
+			Category: categoryLog,
+			Value:    "info",
+			Usage:    "Specify the log level. e.g. 'debug', 'info', 'error'.",
+			Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogLevel)),
+		},
+		&cli.StringMapFlag{
+			Name:     flagLogCtx,
+			Category: categoryLog,
+			Usage:    "A list of context field appended to every log. Format: key=value.",
+			Sources:  cli.EnvVars(strcase.ToSNAKE(flagLogCtx)),
+		},
+	}
 }
 
 func main() {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	glass "github.com/glasslabs/looking-glass"
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/urfave/cli/v3"
+)
+
+func modulesList(_ context.Context, cmd *cli.Command) error {
+	// Logs are kept apart from the table, so it can be piped.
+	log, err := newLogger(cmd, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	d, _, err := newModulesDownloader(cmd, log, false)
+	if err != nil {
+		return err
+	}
+
+	entries, err := d.Entries()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.Root().Writer, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "URL\tNAME\tVERSION\tAUTHOR\tABI\tSIZE\tFETCHED\tVALIDATED\tSHA256")
+	for _, entry := range entries {
+		manifest, _, err := d.EntryManifest(entry)
+		if err != nil {
+			log.Warn("Could not read module manifest", lctx.Str("url", entry.URL), lctx.Err(err))
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			entry.URL,
+			orDash(manifest.Name),
+			orDash(manifest.Version),
+			orDash(manifest.Author),
+			orDash(manifest.ABI),
+			entry.Size,
+			entry.FetchedAt.Format(time.RFC3339),
+			entry.ValidatedAt.Format(time.RFC3339),
+			entry.SHA256,
+		)
+	}
+	return w.Flush()
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func modulesFetch(ctx context.Context, cmd *cli.Command) error {
+	log, err := newLogger(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	d, cfg, err := newModulesDownloader(cmd, log, true)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, desc := range cfg.Modules {
+		if desc.InProcess() {
+			continue
+		}
+
+		uri, err := resolveModule(ctx, d, desc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		integrity := module.Integrity{SHA256: desc.SHA256, Signature: desc.Signature}
+		if _, err = d.DownloadBytes(ctx, uri, integrity); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", desc.Name, err))
+			continue
+		}
+
+		log.Info("Module fetched", lctx.Str("module", desc.Name), lctx.Str("uri", uri))
+	}
+	return errors.Join(errs...)
+}
+
+func modulesPrune(ctx context.Context, cmd *cli.Command) error {
+	log, err := newLogger(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	d, cfg, err := newModulesDownloader(cmd, log, true)
+	if err != nil {
+		return err
+	}
+
+	keep := make([]string, 0, len(cfg.Modules))
+	for _, desc := range cfg.Modules {
+		uri, err := resolveModule(ctx, d, desc)
+		if err != nil {
+			// Pruning without knowing every module could remove one in use.
+			return fmt.Errorf("not pruning: %w", err)
+		}
+		keep = append(keep, uri)
+	}
+
+	removed, err := d.Prune(keep)
+	for _, entry := range removed {
+		log.Info("Module removed", lctx.Str("url", entry.URL))
+	}
+	return err
+}
+
+func modulesVerify(_ context.Context, cmd *cli.Command) error {
+	log, err := newLogger(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	d, _, err := newModulesDownloader(cmd, log, false)
+	if err != nil {
+		return err
+	}
+
+	entries, err := d.Entries()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, entry := range entries {
+		if err = d.VerifyEntry(entry); err != nil {
+			log.Error("Module verification failed", lctx.Str("url", entry.URL), lctx.Err(err))
+
+			failed++
+			continue
+		}
+
+		log.Info("Module verified", lctx.Str("url", entry.URL))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d modules failed verification", failed, len(entries))
+	}
+	return nil
+}
+
+// newModulesDownloader returns a Downloader for the modules directory,
+// configured from the configuration file when one is given.
+func newModulesDownloader(cmd *cli.Command, log *logger.Logger, needConfig bool) (*module.Downloader, glass.Config, error) {
+	var cfg glass.Config
+	if file := cmd.String(flagConfigFile); file != "" {
+		ids, err := loadIdentities(cmd.String(flagSecretsKey))
+		if err != nil {
+			return nil, glass.Config{}, err
+		}
+		secrets, err := loadSecrets(cmd.String(flagSecretsFile), ids)
+		if err != nil {
+			return nil, glass.Config{}, err
+		}
+		if cfg, err = loadConfig(file, secrets); err != nil {
+			return nil, glass.Config{}, err
+		}
+	} else if needConfig {
+		return nil, glass.Config{}, fmt.Errorf("a configuration file is required, set it with --%s", flagConfigFile)
+	}
+
+	keys, err := module.ParsePublicKeys(cfg.TrustedKeys)
+	if err != nil {
+		return nil, glass.Config{}, err
+	}
+
+	d, err := module.NewDownloader(cmd.String(flagModPath), log, module.WithIndex(cfg.Index), module.WithTrustedKeys(keys))
+	if err != nil {
+		return nil, glass.Config{}, err
+	}
+	return d, cfg, nil
+}
+
+func resolveModule(ctx context.Context, d *module.Downloader, desc module.Descriptor) (string, error) {
+	if desc.Path == "" {
+		return desc.URI, nil
+	}
+
+	uri, err := d.Resolve(ctx, desc.Path, desc.Version)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", desc.Name, err)
+	}
+	return uri, nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"filippo.io/age"
 	glass "github.com/glasslabs/looking-glass"
 	"github.com/glasslabs/looking-glass/module"
 	lctx "github.com/hamba/logger/v2/ctx"
@@ -14,34 +15,42 @@ import (
 )
 
 func run(ctx context.Context, cmd *cli.Command) error {
-	log, err := newLogger(cmd)
+	// Secret values are redacted from everything logged.
+	secrets := module.NewSecrets(nil)
+	log, err := newLogger(cmd, secrets.Writer(os.Stdout))
 	if err != nil {
 		return err
 	}
 
 	log.Info("Starting Looking Glass", lctx.Str("version", version))
 
-	secrets, err := loadSecrets(cmd.String(flagSecretsFile))
+	ids, err := loadIdentities(cmd.String(flagSecretsKey))
 	if err != nil {
 		return err
 	}
+	secretVals, err := loadSecrets(cmd.String(flagSecretsFile), ids)
+	if err != nil {
+		return err
+	}
+	secrets.Update(secretVals)
 
-	cfg, err := loadConfig(cmd.String(flagConfigFile), secrets)
+	cfg, err := loadConfig(cmd.String(flagConfigFile), secretVals)
 	if err != nil {
 		return err
 	}
 
 	modPath := cmd.String(flagModPath)
-	cachePath := filepath.Join(modPath, "cache")
-	if err = os.MkdirAll(cachePath, 0o700); err != nil {
-		return fmt.Errorf("could not create cache directory: %w", err)
+	execCtx, err := newExecContext(modPath, cmd.String(flagAssetsPath), secrets)
+	if err != nil {
+		return err
 	}
 
-	execCtx := module.ExecContext{
-		CachePath:  cachePath,
-		AssetsPath: cmd.String(flagAssetsPath),
+	var updates <-chan glass.Config
+	if cmd.Bool(flagWatch) {
+		updates = watchConfig(ctx, cmd.String(flagConfigFile), cmd.String(flagSecretsFile), ids, secrets, log)
 	}
-	if err = glass.Run(ctx, cfg, modPath, execCtx, log); err != nil {
+
+	if err = glass.Run(ctx, cfg, updates, modPath, execCtx, log); err != nil {
 		log.Error("Looking Glass Shutdown", lctx.Err(err))
 
 		return err
@@ -52,7 +61,32 @@ func run(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
-func loadSecrets(file string) (map[string]any, error) {
+// newExecContext creates the module directories in modPath, returning
+// the module execution context using them.
+func newExecContext(modPath, assetsPath string, secrets *module.Secrets) (module.ExecContext, error) {
+	cachePath := filepath.Join(modPath, "cache")
+	if err := os.MkdirAll(cachePath, 0o700); err != nil {
+		return module.ExecContext{}, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	dataPath := filepath.Join(modPath, "data")
+	if err := os.MkdirAll(dataPath, 0o700); err != nil {
+		return module.ExecContext{}, fmt.Errorf("could not create data directory: %w", err)
+	}
+	httpCachePath := filepath.Join(modPath, "http")
+	if err := os.MkdirAll(httpCachePath, 0o700); err != nil {
+		return module.ExecContext{}, fmt.Errorf("could not create http cache directory: %w", err)
+	}
+
+	return module.ExecContext{
+		CachePath:     cachePath,
+		AssetsPath:    assetsPath,
+		DataPath:      dataPath,
+		HTTPCachePath: httpCachePath,
+		Secrets:       secrets,
+	}, nil
+}
+
+func loadSecrets(file string, ids []age.Identity) (map[string]any, error) {
 	if file == "" {
 		return nil, nil //nolint:nilnil
 	}
@@ -65,7 +99,7 @@ func loadSecrets(file string) (map[string]any, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not read secrets file: %w", err)
 	}
-	s, err := glass.ParseSecrets(in)
+	s, err := glass.ParseSecrets(in, ids...)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse secrets file: %w", err)
 	}
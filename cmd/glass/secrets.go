@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	glass "github.com/glasslabs/looking-glass"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	flagSecretsFormat    = "format"
+	flagSecretsRecipient = "recipient"
+)
+
+func secretsDecrypt(_ context.Context, cmd *cli.Command) error {
+	ids, err := loadIdentities(cmd.String(flagSecretsKey))
+	if err != nil {
+		return err
+	}
+	in, err := os.ReadFile(filepath.Clean(cmd.String(flagSecretsFile)))
+	if err != nil {
+		return fmt.Errorf("could not read secrets file: %w", err)
+	}
+
+	plain, _, err := glass.DecryptSecrets(in, ids...)
+	if err != nil {
+		return err
+	}
+	_, err = cmd.Writer.Write(plain)
+	return err
+}
+
+func secretsEncrypt(_ context.Context, cmd *cli.Command) error {
+	file := cmd.String(flagSecretsFile)
+	format, err := glass.ParseSecretsFormat(cmd.String(flagSecretsFormat))
+	if err != nil {
+		return err
+	}
+	recipients, err := loadRecipients(cmd, nil)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return fmt.Errorf("could not read secrets file: %w", err)
+	}
+	if current := glass.DetectSecretsFormat(in); current != glass.SecretsPlain {
+		return fmt.Errorf("secrets file is already encrypted (%s)", current)
+	}
+
+	out, err := glass.EncryptSecrets(in, format, recipients...)
+	if err != nil {
+		return err
+	}
+	return writeSecrets(file, out)
+}
+
+func secretsEdit(ctx context.Context, cmd *cli.Command) error {
+	file := cmd.String(flagSecretsFile)
+	ids, err := loadIdentities(cmd.String(flagSecretsKey))
+	if err != nil {
+		return err
+	}
+
+	format, err := glass.ParseSecretsFormat(cmd.String(flagSecretsFormat))
+	if err != nil {
+		return err
+	}
+	var plain []byte
+	in, err := os.ReadFile(filepath.Clean(file))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("could not read secrets file: %w", err)
+	default:
+		// An existing file keeps its format.
+		if plain, format, err = glass.DecryptSecrets(in, ids...); err != nil {
+			return err
+		}
+	}
+
+	edited, err := editFile(ctx, plain)
+	if err != nil {
+		return err
+	}
+	if in != nil && bytes.Equal(edited, plain) {
+		return nil
+	}
+	if _, err = glass.ParseSecrets(edited); err != nil {
+		return fmt.Errorf("edited secrets are invalid: %w", err)
+	}
+
+	var recipients []age.Recipient
+	if format != glass.SecretsPlain {
+		// The recipients of an existing file keep their access.
+		stored, err := glass.SecretsRecipients(in)
+		if err != nil {
+			return err
+		}
+		if recipients, err = loadRecipients(cmd, stored); err != nil {
+			return err
+		}
+	}
+	out, err := glass.EncryptSecrets(edited, format, recipients...)
+	if err != nil {
+		return err
+	}
+	return writeSecrets(file, out)
+}
+
+// editFile opens b in the editor from $EDITOR, returning the edited
+// contents. The plain text is only kept on disk while the editor runs.
+func editFile(ctx context.Context, b []byte) ([]byte, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	dir, err := os.MkdirTemp("", "glass-secrets-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	file := filepath.Join(dir, "secrets.yaml")
+	if err = os.WriteFile(file, b, 0o600); err != nil {
+		return nil, fmt.Errorf("could not write temporary file: %w", err)
+	}
+
+	args := strings.Fields(editor)
+	//nolint:gosec // The editor is chosen by the user.
+	c := exec.CommandContext(ctx, args[0], append(args[1:], file)...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = c.Run(); err != nil {
+		return nil, fmt.Errorf("running editor: %w", err)
+	}
+
+	return os.ReadFile(filepath.Clean(file))
+}
+
+func writeSecrets(file string, b []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("could not write secrets file: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("could not write secrets file: %w", err)
+	}
+	return nil
+}
+
+// loadIdentities loads the age identities from key, which is either an
+// identity or the path to an identity file.
+func loadIdentities(key string) ([]age.Identity, error) {
+	if key == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	r := strings.NewReader(key)
+	if !strings.HasPrefix(key, "AGE-SECRET-KEY-") {
+		b, err := os.ReadFile(filepath.Clean(key))
+		if err != nil {
+			return nil, fmt.Errorf("could not read secrets key: %w", err)
+		}
+		r = strings.NewReader(string(b))
+	}
+
+	ids, err := age.ParseIdentities(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse secrets key: %w", err)
+	}
+	return ids, nil
+}
+
+// loadRecipients returns the stored recipients, the recipients given as
+// flags, and those of the secrets key, without duplicates.
+func loadRecipients(cmd *cli.Command, stored []age.Recipient) ([]age.Recipient, error) {
+	recipients := stored
+	if rs := cmd.StringSlice(flagSecretsRecipient); len(rs) > 0 {
+		flagged, err := age.ParseRecipients(strings.NewReader(strings.Join(rs, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse recipients: %w", err)
+		}
+		recipients = append(recipients, flagged...)
+	}
+
+	ids, err := loadIdentities(cmd.String(flagSecretsKey))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		switch id := id.(type) {
+		case *age.X25519Identity:
+			recipients = append(recipients, id.Recipient())
+		case *age.HybridIdentity:
+			recipients = append(recipients, id.Recipient())
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("a recipient is required, set it with --%s or --%s", flagSecretsRecipient, flagSecretsKey)
+	}
+	return uniqueRecipients(recipients), nil
+}
+
+// uniqueRecipients returns recipients without duplicates, in order.
+func uniqueRecipients(recipients []age.Recipient) []age.Recipient {
+	seen := map[string]bool{}
+	unique := make([]age.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		if s, ok := r.(fmt.Stringer); ok {
+			if seen[s.String()] {
+				continue
+			}
+			seen[s.String()] = true
+		}
+		unique = append(unique, r)
+	}
+	return unique
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	glass "github.com/glasslabs/looking-glass"
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+const watchInterval = 2 * time.Second
+
+// fileState is the observed state of a watched file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(file string) (fileState, error) {
+	if file == "" {
+		return fileState{}, nil
+	}
+
+	fi, err := os.Stat(filepath.Clean(file))
+	if errors.Is(err, os.ErrNotExist) {
+		return fileState{}, nil
+	}
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// watchConfig polls the configuration and secrets files, sending the newly
+// loaded configuration when either of them changes. Reloaded secrets are
+// updated in secrets. Configurations that cannot be loaded are logged and
+// skipped.
+func watchConfig(ctx context.Context, cfgFile, secretsFile string, ids []age.Identity, secrets *module.Secrets, log *logger.Logger) <-chan glass.Config {
+	ch := make(chan glass.Config)
+
+	go func() {
+		defer close(ch)
+
+		cfgState, _ := statFile(cfgFile)
+		secState, _ := statFile(secretsFile)
+
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			newCfgState, err := statFile(cfgFile)
+			if err != nil {
+				log.Error("Could not stat configuration file", lctx.Err(err))
+				continue
+			}
+			newSecState, err := statFile(secretsFile)
+			if err != nil {
+				log.Error("Could not stat secrets file", lctx.Err(err))
+				continue
+			}
+			if newCfgState == cfgState && newSecState == secState {
+				continue
+			}
+			cfgState, secState = newCfgState, newSecState
+
+			log.Info("Configuration changed, reloading")
+
+			secretVals, err := loadSecrets(secretsFile, ids)
+			if err != nil {
+				log.Error("Could not reload secrets", lctx.Err(err))
+				continue
+			}
+			secrets.Update(secretVals)
+
+			cfg, err := loadConfig(cfgFile, secretVals)
+			if err != nil {
+				log.Error("Could not reload configuration", lctx.Err(err))
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- cfg:
+			}
+		}
+	}()
+
+	return ch
+}
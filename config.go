@@ -13,17 +13,15 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// ParseSecrets parses secrets from in.
-func ParseSecrets(in []byte) (map[string]any, error) {
-	sec := map[string]any{}
-	err := yaml.Unmarshal(in, &sec)
-	return sec, err
-}
-
 // Config contains the main configuration.
 type Config struct {
-	UI      ui.Config           `yaml:"ui"`
-	Modules []module.Descriptor `yaml:"modules"`
+	UI          ui.Config               `yaml:"ui"`
+	Index       module.IndexConfig      `yaml:"index"`
+	TrustedKeys []string                `yaml:"trustedKeys"`
+	MQTT        module.MQTTConfig       `yaml:"mqtt"`
+	HTTPCache   module.HTTPCacheConfig  `yaml:"httpCache"`
+	Scheduler   *module.SchedulerConfig `yaml:"scheduler"`
+	Modules     []module.Descriptor     `yaml:"modules"`
 }
 
 // Validate validates the configuration.
@@ -31,6 +29,23 @@ func (c Config) Validate() error {
 	if err := c.UI.Validate(); err != nil {
 		return err
 	}
+	if err := c.Index.Validate(); err != nil {
+		return err
+	}
+	if _, err := module.ParsePublicKeys(c.TrustedKeys); err != nil {
+		return fmt.Errorf("config: invalid trusted key: %w", err)
+	}
+	if err := c.MQTT.Validate(); err != nil {
+		return err
+	}
+	if err := c.HTTPCache.Validate(); err != nil {
+		return err
+	}
+	if c.Scheduler != nil {
+		if err := c.Scheduler.Validate(); err != nil {
+			return err
+		}
+	}
 
 	if len(c.Modules) == 0 {
 		return errors.New("config: at least one module is required")
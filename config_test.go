@@ -112,6 +112,57 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: "config: ui scale must be greater than or equal to zero",
 		},
+		{
+			name: "handles invalid index",
+			config: glass.Config{
+				UI: ui.Config{
+					Width:  1,
+					Height: 1,
+				},
+				Index: module.IndexConfig{Type: "test"},
+				Modules: []module.Descriptor{
+					{
+						Name: "test-module",
+						URI:  "test",
+					},
+				},
+			},
+			wantErr: `config: unsupported index type "test"`,
+		},
+		{
+			name: "handles invalid mqtt broker",
+			config: glass.Config{
+				UI: ui.Config{
+					Width:  1,
+					Height: 1,
+				},
+				MQTT: module.MQTTConfig{Brokers: []module.MQTTBroker{{Name: "home"}}},
+				Modules: []module.Descriptor{
+					{
+						Name: "test-module",
+						URI:  "test",
+					},
+				},
+			},
+			wantErr: `config: mqtt broker "home" must have a valid url`,
+		},
+		{
+			name: "handles invalid scheduler",
+			config: glass.Config{
+				UI: ui.Config{
+					Width:  1,
+					Height: 1,
+				},
+				Scheduler: &module.SchedulerConfig{MaxConcurrent: -1},
+				Modules: []module.Descriptor{
+					{
+						Name: "test-module",
+						URI:  "test",
+					},
+				},
+			},
+			wantErr: "config: scheduler max concurrent must be greater than or equal to zero",
+		},
 		{
 			name: "handles no modules",
 			config: glass.Config{
@@ -0,0 +1,119 @@
+package glasstest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is a clock controlled by the test. Modules see its time, and
+// their sleeps only end when the clock is advanced past them.
+type Clock struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	now      time.Time
+	sleepers []*sleeper
+	stopped  bool
+}
+
+type sleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+// NewClock returns a clock starting at now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by d, the clock is stopped, or
+// ctx is done, returning the error of ctx.
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil || d <= 0 {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil
+	}
+	s := &sleeper{until: c.now.Add(d), done: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.sleepers = slices.DeleteFunc(c.sleepers, func(o *sleeper) bool { return o == s })
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Advance moves the clock forward by d, waking the sleeps that end by the
+// new time.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sleepers := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.until.After(c.now) {
+			sleepers = append(sleepers, s)
+			continue
+		}
+		close(s.done)
+	}
+	c.sleepers = sleepers
+}
+
+// Sleepers returns the number of sleeps waiting for the clock.
+func (c *Clock) Sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.sleepers)
+}
+
+// WaitForSleepers blocks until at least n sleeps are waiting for the
+// clock, e.g. until a module waits for its next update, or the clock is
+// stopped.
+func (c *Clock) WaitForSleepers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.sleepers) < n && !c.stopped {
+		c.cond.Wait()
+	}
+}
+
+// Stop wakes all sleeps, and ends later sleeps immediately, so modules
+// can be stopped.
+func (c *Clock) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+	for _, s := range c.sleepers {
+		close(s.done)
+	}
+	c.sleepers = nil
+	c.cond.Broadcast()
+}
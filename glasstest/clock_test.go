@@ -0,0 +1,70 @@
+package glasstest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glasslabs/looking-glass/glasstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock_Advance(t *testing.T) {
+	t.Parallel()
+
+	c := glasstest.NewClock(glasstest.StartTime)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_ = c.Sleep(context.Background(), time.Minute)
+	}()
+	c.WaitForSleepers(1)
+
+	c.Advance(30 * time.Second)
+	assert.Equal(t, 1, c.Sleepers(), "the sleep must not end early")
+
+	c.Advance(30 * time.Second)
+	<-done
+	assert.Equal(t, glasstest.StartTime.Add(time.Minute), c.Now())
+	assert.Zero(t, c.Sleepers())
+}
+
+func TestClock_Stop(t *testing.T) {
+	t.Parallel()
+
+	c := glasstest.NewClock(glasstest.StartTime)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_ = c.Sleep(context.Background(), time.Hour)
+	}()
+	c.WaitForSleepers(1)
+
+	c.Stop()
+
+	<-done
+	_ = c.Sleep(context.Background(), time.Hour)
+	assert.Equal(t, glasstest.StartTime, c.Now())
+}
+
+func TestClock_SleepHandlesCancelledContext(t *testing.T) {
+	t.Parallel()
+
+	c := glasstest.NewClock(glasstest.StartTime)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Sleep(ctx, time.Hour)
+	}()
+	c.WaitForSleepers(1)
+
+	cancel()
+
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Zero(t, c.Sleepers())
+}
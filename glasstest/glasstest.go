@@ -0,0 +1,299 @@
+// Package glasstest runs looking-glass modules in tests, without a window.
+//
+// A Harness runs modules on the host, recording the widgets they render
+// in a UI, serving their HTTP requests with a fake Transport, and giving
+// them a Clock controlled by the test:
+//
+//	h := glasstest.New(t)
+//	h.Transport.HandleFunc("api.example.com/weather", func(w http.ResponseWriter, _ *http.Request) {
+//		_, _ = w.Write([]byte(`{"temp": 21}`))
+//	})
+//	h.LoadFile(module.Descriptor{Name: "weather"}, "weather.wasm")
+//
+//	h.WaitForWidget("weather", glasstest.HasText("21°"))
+package glasstest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glasslabs/client-go"
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	loadTimeout    = 5 * time.Minute
+	pollInterval   = 100 * time.Millisecond
+)
+
+// StartTime is the time the clock of a Harness starts at by default.
+var StartTime = time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+type options struct {
+	timeout    time.Duration
+	start      time.Time
+	assetsPath string
+}
+
+// Option configures a Harness.
+type Option func(*options)
+
+// WithTimeout sets how long the Harness waits for widgets once a module
+// has loaded. Compiling the module is not part of the timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithStartTime sets the time the clock of the Harness starts at.
+func WithStartTime(t time.Time) Option {
+	return func(o *options) {
+		o.start = t
+	}
+}
+
+// WithAssets sets the assets directory modules read from.
+func WithAssets(path string) Option {
+	return func(o *options) {
+		o.assetsPath = path
+	}
+}
+
+// Harness runs modules for a test.
+type Harness struct {
+	// UI records the widgets rendered by the modules.
+	UI *UI
+	// Transport serves the HTTP requests of the modules.
+	Transport *Transport
+	// Clock is the clock of the modules.
+	Clock *Clock
+
+	t       testing.TB
+	ctx     context.Context
+	loader  *module.Loader
+	timeout time.Duration
+	logs    *syncBuffer
+}
+
+// New returns a Harness for the test t, stopped when the test ends.
+// Module storage is kept in a temporary directory.
+func New(t testing.TB, opts ...Option) *Harness {
+	t.Helper()
+
+	o := options{timeout: defaultTimeout, start: StartTime}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	logs := &syncBuffer{}
+	log := logger.New(logs, logger.LogfmtFormat(), logger.Info)
+
+	h := &Harness{
+		UI:        NewUI(),
+		Transport: NewTransport(),
+		Clock:     NewClock(o.start),
+		t:         t,
+		timeout:   o.timeout,
+		logs:      logs,
+	}
+
+	d, err := module.NewDownloader(t.TempDir(), log)
+	if err != nil {
+		t.Fatalf("glasstest: creating downloader: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	execCtx := module.ExecContext{
+		AssetsPath: o.assetsPath,
+		DataPath:   t.TempDir(),
+		Transport:  h.Transport,
+		Clock:      h.Clock,
+	}
+	loader, err := module.New(ctx, h.UI, d, execCtx, log)
+	if err != nil {
+		cancel()
+		t.Fatalf("glasstest: creating loader: %v", err)
+	}
+	h.ctx = ctx
+	h.loader = loader
+
+	t.Cleanup(func() {
+		cancel()
+		// Modules waiting for the clock must wake up to stop.
+		h.Clock.Stop()
+
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer closeCancel()
+		_ = loader.Close(closeCtx)
+	})
+
+	return h
+}
+
+// Load runs the module described by desc from its WASM file wasm.
+func (h *Harness) Load(desc module.Descriptor, wasm []byte) {
+	h.t.Helper()
+
+	if err := h.loader.Replace(h.ctx, desc, wasm); err != nil {
+		h.t.Fatalf("glasstest: loading module %s: %v", desc.Name, err)
+	}
+}
+
+// LoadFile runs the module described by desc from the WASM file at path.
+func (h *Harness) LoadFile(desc module.Descriptor, path string) {
+	h.t.Helper()
+
+	b, err := os.ReadFile(path) //nolint:gosec // The path is given by the test.
+	if err != nil {
+		h.t.Fatalf("glasstest: reading module: %v", err)
+	}
+	h.Load(desc, b)
+}
+
+// Status returns the status of the named module.
+func (h *Harness) Status(name string) (module.Status, bool) {
+	for _, st := range h.loader.Status() {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return module.Status{}, false
+}
+
+// WaitForWidget waits for the named module to render a widget matching
+// pred, returning the first such widget it rendered. The test fails if the
+// module fails, or renders no matching widget within the timeout of the
+// Harness once it has loaded.
+func (h *Harness) WaitForWidget(name string, pred func(client.Widget) bool) client.Widget {
+	h.t.Helper()
+
+	return h.waitForWidget(name, h.timeout, pred)
+}
+
+// WaitForWidgetWithin is like WaitForWidget, waiting for timeout instead
+// of the timeout of the Harness.
+func (h *Harness) WaitForWidgetWithin(name string, timeout time.Duration, pred func(client.Widget) bool) client.Widget {
+	h.t.Helper()
+
+	return h.waitForWidget(name, timeout, pred)
+}
+
+func (h *Harness) waitForWidget(name string, timeout time.Duration, pred func(client.Widget) bool) client.Widget {
+	h.t.Helper()
+
+	// The timeout only starts once the module has loaded, as compiling it
+	// can be slow, e.g. with the race detector.
+	loading := time.NewTimer(loadTimeout)
+	defer loading.Stop()
+	loadingC := loading.C
+	var (
+		timer    *time.Timer
+		timeoutC <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		changed := h.UI.Changed()
+		for _, w := range h.UI.Widgets(name) {
+			if pred(w) {
+				return w
+			}
+		}
+		st, ok := h.Status(name)
+		if ok && st.State == module.StateFailed {
+			h.t.Fatalf("glasstest: module %s failed: %v\n%s", name, st.LastError, h.Logs())
+			return nil
+		}
+		if timer == nil && ok && st.State != module.StateStarting {
+			timer = time.NewTimer(timeout)
+			timeoutC = timer.C
+			loadingC = nil
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-loadingC:
+			h.t.Fatalf("glasstest: module %s did not load within %s\n%s", name, loadTimeout, h.Logs())
+			return nil
+		case <-timeoutC:
+			h.t.Fatalf("glasstest: module %s rendered no matching widget within %s\n%s", name, timeout, h.Logs())
+			return nil
+		}
+	}
+}
+
+// Logs returns the logs of the host and the modules.
+func (h *Harness) Logs() string {
+	return h.logs.String()
+}
+
+// HasText returns a predicate matching widgets containing a text widget
+// whose content contains s.
+func HasText(s string) func(client.Widget) bool {
+	return func(w client.Widget) bool {
+		return hasText(w, s)
+	}
+}
+
+func hasText(w client.Widget, s string) bool {
+	switch w := w.(type) {
+	case *client.Text:
+		return strings.Contains(w.Content, s)
+	case *client.VStack:
+		return anyHasText(w.Children, s)
+	case *client.HStack:
+		return anyHasText(w.Children, s)
+	case *client.Table:
+		for _, r := range w.Rows {
+			for _, c := range r.Columns {
+				if c.Child != nil && hasText(c.Child, s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func anyHasText(widgets []client.Widget, s string) bool {
+	for _, w := range widgets {
+		if hasText(w, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
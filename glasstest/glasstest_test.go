@@ -0,0 +1,86 @@
+package glasstest_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glasslabs/looking-glass/glasstest"
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHarness_WaitForWidget(t *testing.T) {
+	t.Parallel()
+
+	wasm := buildGreeter(t)
+
+	h := glasstest.New(t)
+	h.Transport.HandleFunc("GET api.example.com/greeting", func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	})
+
+	desc := module.Descriptor{
+		Name:     "greeter",
+		Position: module.Position{Vertical: module.Top, Horizontal: module.Left},
+		Config:   map[string]any{"url": "https://api.example.com/greeting"},
+	}
+	h.Load(desc, wasm)
+
+	h.WaitForWidget("greeter", glasstest.HasText("hello"))
+	h.WaitForWidget("greeter", glasstest.HasText("12:00"))
+
+	h.Clock.WaitForSleepers(1)
+	h.Clock.Advance(time.Minute)
+
+	h.WaitForWidgetWithin("greeter", 10*time.Second, glasstest.HasText("12:01"))
+	reqs := h.Transport.Requests()
+	require.GreaterOrEqual(t, len(reqs), 2)
+	assert.Equal(t, "https://api.example.com/greeting", reqs[0].URL.String())
+	pos, ok := h.UI.Position("greeter")
+	require.True(t, ok)
+	assert.Equal(t, desc.Position, pos)
+}
+
+var (
+	greeterOnce sync.Once
+	greeterWASM []byte
+	greeterErr  error
+)
+
+// buildGreeter builds the greeter module in testdata with the local Go
+// toolchain.
+func buildGreeter(t *testing.T) []byte {
+	t.Helper()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go toolchain is required to build the test module")
+	}
+
+	greeterOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "glasstest")
+		if err != nil {
+			greeterErr = err
+			return
+		}
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		out := filepath.Join(dir, "greeter.wasm")
+		cmd := exec.Command("go", "build", "-o", out, ".")
+		cmd.Dir = filepath.Join("testdata", "greeter")
+		cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+		if b, err := cmd.CombinedOutput(); err != nil {
+			greeterErr = fmt.Errorf("%w: %s", err, b)
+			return
+		}
+		greeterWASM, greeterErr = os.ReadFile(out)
+	})
+	require.NoError(t, greeterErr)
+	return greeterWASM
+}
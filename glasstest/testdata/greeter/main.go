@@ -0,0 +1,52 @@
+// Command greeter is a module rendering a greeting fetched over HTTP with
+// the time, refreshed every minute. The glasstest tests build it with:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -o greeter.wasm .
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/glasslabs/client-go"
+)
+
+type config struct {
+	URL string `json:"url"`
+}
+
+func main() {
+	mod, err := client.NewModule()
+	if err != nil {
+		os.Exit(1)
+	}
+	var cfg config
+	if err = mod.ParseConfig(&cfg); err != nil {
+		os.Exit(1)
+	}
+
+	for {
+		mod.Render(&client.VStack{Children: []client.Widget{
+			&client.Text{Content: greeting(cfg.URL)},
+			&client.Text{Content: time.Now().UTC().Format("15:04")},
+		}})
+
+		time.Sleep(time.Minute)
+	}
+}
+
+func greeting(url string) string {
+	resp, err := http.Get(url) //nolint:noctx
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return string(b)
+}
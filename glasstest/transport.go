@@ -0,0 +1,67 @@
+package glasstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Transport is a fake HTTP transport, serving the HTTP requests of modules
+// with handlers instead of the network. Requests are matched against the
+// handler patterns of an http.ServeMux, which may include the host, e.g.
+// "GET api.example.com/weather". Unmatched requests get a 404 response.
+//
+// Responses are buffered, so handlers streaming an endless response
+// block the module.
+type Transport struct {
+	mux *http.ServeMux
+
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+// NewTransport returns a transport without handlers.
+func NewTransport() *Transport {
+	return &Transport{mux: http.NewServeMux()}
+}
+
+// Handle registers the handler for pattern.
+func (t *Transport) Handle(pattern string, h http.Handler) {
+	t.mux.Handle(pattern, h)
+}
+
+// HandleFunc registers the handler function for pattern.
+func (t *Transport) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	t.mux.HandleFunc(pattern, h)
+}
+
+// Requests returns the requests made through the transport, in order.
+func (t *Transport) Requests() []*http.Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reqs := make([]*http.Request, len(t.reqs))
+	copy(reqs, t.reqs)
+	return reqs
+}
+
+// RoundTrip serves req with the matching handler.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	srvReq := req.Clone(req.Context())
+	if srvReq.Host == "" {
+		srvReq.Host = req.URL.Host
+	}
+	srvReq.RequestURI = req.URL.RequestURI()
+	srvReq.Body = req.Body
+
+	t.mu.Lock()
+	t.reqs = append(t.reqs, srvReq)
+	t.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	t.mux.ServeHTTP(rec, srvReq)
+
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
@@ -0,0 +1,55 @@
+package glasstest_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/glasslabs/looking-glass/glasstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tr := glasstest.NewTransport()
+	tr.HandleFunc("POST api.example.com/echo", func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		rw.Header().Set("X-Test", req.Header.Get("Accept"))
+		_, _ = rw.Write(b)
+	})
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, "https://api.example.com/echo?q=1", strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/plain")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(got))
+	assert.Equal(t, "text/plain", resp.Header.Get("X-Test"))
+	reqs := tr.Requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "/echo?q=1", reqs[0].RequestURI)
+}
+
+func TestTransport_RoundTripHandlesUnmatchedRequest(t *testing.T) {
+	t.Parallel()
+
+	tr := glasstest.NewTransport()
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "https://api.example.com/missing", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,137 @@
+package glasstest
+
+import (
+	"sync"
+
+	"github.com/glasslabs/client-go"
+	"github.com/glasslabs/looking-glass/module"
+)
+
+// UI is a module.UIProvider recording the containers of modules and the
+// widgets they render, instead of drawing them in a window.
+type UI struct {
+	mu      sync.Mutex
+	mods    map[string]*moduleUI
+	changed chan struct{}
+}
+
+type moduleUI struct {
+	pos     module.Position
+	widgets []client.Widget
+}
+
+// NewUI returns a UI without modules.
+func NewUI() *UI {
+	return &UI{
+		mods:    map[string]*moduleUI{},
+		changed: make(chan struct{}),
+	}
+}
+
+// CreateModule creates the container of the named module.
+func (u *UI) CreateModule(name, vert, horiz string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.mods[name] = &moduleUI{pos: module.Position{Vertical: vert, Horizontal: horiz}}
+	u.notify()
+}
+
+// RemoveModule removes the container of the named module.
+func (u *UI) RemoveModule(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.mods, name)
+	u.notify()
+}
+
+// MoveModule moves the container of the named module.
+func (u *UI) MoveModule(name, vert, horiz string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if m, ok := u.mods[name]; ok {
+		m.pos = module.Position{Vertical: vert, Horizontal: horiz}
+		u.notify()
+	}
+}
+
+// ModuleUI returns the updater of the named module, or nil if the module
+// has no container.
+func (u *UI) ModuleUI(name string) module.WidgetUpdater {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.mods[name]; !ok {
+		return nil
+	}
+	return updater{ui: u, name: name}
+}
+
+// Position returns the position of the container of the named module.
+func (u *UI) Position(name string) (module.Position, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	m, ok := u.mods[name]
+	if !ok {
+		return module.Position{}, false
+	}
+	return m.pos, true
+}
+
+// Widget returns the widget the named module rendered last.
+func (u *UI) Widget(name string) (client.Widget, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	m, ok := u.mods[name]
+	if !ok || len(m.widgets) == 0 {
+		return nil, false
+	}
+	return m.widgets[len(m.widgets)-1], true
+}
+
+// Widgets returns the widgets the named module rendered, in order.
+func (u *UI) Widgets(name string) []client.Widget {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	m, ok := u.mods[name]
+	if !ok {
+		return nil
+	}
+	widgets := make([]client.Widget, len(m.widgets))
+	copy(widgets, m.widgets)
+	return widgets
+}
+
+// Changed returns a channel closed on the next change to the UI.
+func (u *UI) Changed() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.changed
+}
+
+func (u *UI) notify() {
+	close(u.changed)
+	u.changed = make(chan struct{})
+}
+
+type updater struct {
+	ui   *UI
+	name string
+}
+
+func (w updater) Update(widget client.Widget) error {
+	w.ui.mu.Lock()
+	defer w.ui.mu.Unlock()
+
+	if m, ok := w.ui.mods[w.name]; ok {
+		m.widgets = append(m.widgets, widget)
+		w.ui.notify()
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package module
+
+import (
+	"context"
+	"sync"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// maxBusMessageSize is the maximum size of a message on the bus.
+const maxBusMessageSize = 1 << 20
+
+// busQueueSize is the number of messages queued for a subscriber
+// before the oldest is dropped.
+const busQueueSize = 32
+
+// bus is an in-process message broker shared by all modules. The last
+// message published to a topic is retained and delivered to new subscribers.
+type bus struct {
+	mu     sync.Mutex
+	topics map[string]*busTopic
+}
+
+func newBus() *bus {
+	return &bus{topics: map[string]*busTopic{}}
+}
+
+type busTopic struct {
+	retained []byte
+	subs     map[*subscription]struct{}
+}
+
+func (b *bus) topic(name string) *busTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &busTopic{subs: map[*subscription]struct{}{}}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// publish publishes msg to all subscribers of topic, returning the number
+// of subscribers that were too slow and had their oldest message dropped.
+func (b *bus) publish(topic string, msg []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(topic)
+	t.retained = append([]byte{}, msg...)
+
+	var dropped int
+	for sub := range t.subs {
+		if !sub.deliver(t.retained) {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// subscribe subscribes to topic. The retained message of the topic,
+// if any, is the first message of the subscription.
+func (b *bus) subscribe(topic string) *subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := newSubscription(topic)
+	sub.unsubscribe = b.unsubscribe
+
+	t := b.topic(topic)
+	if t.retained != nil {
+		sub.ch <- t.retained
+	}
+	t.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *bus) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t, ok := b.topics[sub.topic]; ok {
+		delete(t.subs, sub)
+	}
+}
+
+// subscription is a queue of messages published to a topic.
+type subscription struct {
+	topic string
+	ch    chan []byte
+	done  chan struct{}
+	once  sync.Once
+
+	// unsubscribe removes the subscription from its source.
+	unsubscribe func(*subscription)
+
+	// pending holds a message that did not fit the plugin buffer.
+	pending []byte
+}
+
+func newSubscription(topic string) *subscription {
+	return &subscription{
+		topic: topic,
+		ch:    make(chan []byte, busQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver queues msg, dropping the oldest queued message if the queue
+// is full. It reports false if a message was dropped.
+func (s *subscription) deliver(msg []byte) bool {
+	select {
+	case s.ch <- msg:
+		return true
+	default:
+	}
+
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- msg:
+	default:
+	}
+	return false
+}
+
+// next returns the next message, blocking until one is published, the
+// subscription is closed or ctx is done.
+func (s *subscription) next(ctx context.Context) ([]byte, bool) {
+	if s.pending != nil {
+		return s.pending, true
+	}
+
+	select {
+	case msg := <-s.ch:
+		return msg, true
+	case <-s.done:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() {
+		s.unsubscribe(s)
+		close(s.done)
+	})
+}
+
+// busPublishFunc publishes a message to a topic.
+func busPublishFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		topicPtr := uint32(stack[0])
+		topicLen := uint32(stack[1])
+		msgPtr := uint32(stack[2])
+		msgLen := uint32(stack[3])
+
+		topic, ok := mod.Memory().Read(topicPtr, topicLen)
+		if !ok || topicLen == 0 || msgLen > maxBusMessageSize {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		msg, ok := mod.Memory().Read(msgPtr, msgLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok || !menv.perms.allowsPublish(string(topic)) {
+			env.log.Warn("bus_publish: topic not permitted", lctx.Str("module", mod.Name()), lctx.Str("topic", string(topic)))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+
+		if dropped := env.bus.publish(string(topic), msg); dropped > 0 {
+			env.log.Warn("bus_publish: subscribers are not keeping up, dropped oldest messages",
+				lctx.Str("module", mod.Name()), lctx.Str("topic", string(topic)), lctx.Int("subscribers", dropped))
+		}
+		stack[0] = 0
+	}
+}
+
+// busSubscribeFunc subscribes to a topic and returns a handle for reading
+// its messages.
+func busSubscribeFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		topicPtr := uint32(stack[0])
+		topicLen := uint32(stack[1])
+
+		topic, ok := mod.Memory().Read(topicPtr, topicLen)
+		if !ok || topicLen == 0 {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok || !menv.perms.allowsSubscribe(string(topic)) {
+			env.log.Warn("bus_subscribe: topic not permitted", lctx.Str("module", mod.Name()), lctx.Str("topic", string(topic)))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+
+		handle := menv.handles.add(env.bus.subscribe(string(topic)))
+		stack[0] = uint64(handle)
+	}
+}
+
+// busNextFunc reads the next message of a subscription into the plugin
+// buffer. Blocks until a message is published.
+func busNextFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		bufPtr := uint32(stack[1])
+		bufLen := uint32(stack[2])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		sub, ok := getHandle[*subscription](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		msg, ok := sub.next(ctx)
+		if !ok {
+			stack[0] = errno(errnoIO)
+			return
+		}
+
+		// A message that does not fit is kept for the next call.
+		sub.pending = nil
+		if len(msg) > int(bufLen) {
+			sub.pending = msg
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, msg)
+	}
+}
+
+// busCloseFunc closes a subscription and releases the handle.
+func busCloseFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			return
+		}
+		if sub, ok := removeHandle[*subscription](menv.handles, handle); ok {
+			sub.close()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus_PublishDeliversToSubscribers(t *testing.T) {
+	t.Parallel()
+
+	b := newBus()
+	sub1 := b.subscribe("weather")
+	sub2 := b.subscribe("weather")
+	other := b.subscribe("news")
+
+	dropped := b.publish("weather", []byte("sunny"))
+
+	assert.Equal(t, 0, dropped)
+	for _, sub := range []*subscription{sub1, sub2} {
+		msg, ok := sub.next(t.Context())
+		require.True(t, ok)
+		assert.Equal(t, []byte("sunny"), msg)
+	}
+	assert.Empty(t, other.ch)
+}
+
+func TestBus_SubscribeReceivesRetainedMessage(t *testing.T) {
+	t.Parallel()
+
+	b := newBus()
+	b.publish("weather", []byte("rainy"))
+	b.publish("weather", []byte("sunny"))
+
+	sub := b.subscribe("weather")
+
+	msg, ok := sub.next(t.Context())
+	require.True(t, ok)
+	assert.Equal(t, []byte("sunny"), msg)
+}
+
+func TestBus_PublishDropsOldestForSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	b := newBus()
+	sub := b.subscribe("weather")
+
+	var dropped int
+	for i := range busQueueSize + 1 {
+		dropped += b.publish("weather", []byte(strconv.Itoa(i)))
+	}
+
+	assert.Equal(t, 1, dropped)
+	msg, ok := sub.next(t.Context())
+	require.True(t, ok)
+	assert.Equal(t, []byte("1"), msg)
+}
+
+func TestSubscription_NextHandlesClose(t *testing.T) {
+	t.Parallel()
+
+	b := newBus()
+	sub := b.subscribe("weather")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sub.close()
+	}()
+	_, ok := sub.next(t.Context())
+
+	assert.False(t, ok)
+	assert.Empty(t, b.topics["weather"].subs)
+}
+
+func TestSubscription_NextHandlesContextDone(t *testing.T) {
+	t.Parallel()
+
+	sub := newBus().subscribe("weather")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, ok := sub.next(ctx)
+
+	assert.False(t, ok)
+}
+
+func TestBusHostFuncs(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	pubEnv := mustRegister(t, env, Descriptor{Name: "weather"})
+	t.Cleanup(func() { env.unregister(pubEnv) })
+	subEnv := mustRegister(t, env, Descriptor{Name: "wear"})
+	pub := newMemModule("weather")
+	sub := newMemModule("wear")
+
+	stack := sub.call("weather/current")
+	busSubscribeFunc(env)(t.Context(), sub, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	done := make(chan []uint64)
+	go func() {
+		stack := []uint64{handle, resultOffset, 3}
+		busNextFunc(env)(t.Context(), sub, stack)
+		done <- stack
+	}()
+
+	stack = pub.call("weather/current", "sunny")
+	busPublishFunc(env)(t.Context(), pub, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = <-done
+	assert.Equal(t, uint64(5), stack[0], "returns the length when the buffer is too small")
+
+	stack = []uint64{handle, resultOffset, 16}
+	busNextFunc(env)(t.Context(), sub, stack)
+	require.Equal(t, uint64(5), stack[0])
+	assert.Equal(t, "sunny", sub.result(stack[0]))
+
+	env.unregister(subEnv)
+
+	assert.Empty(t, env.bus.topics["weather/current"].subs)
+}
+
+func TestBusHostFuncs_HandlesPermissionDenied(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{
+		Name:        "test",
+		Permissions: &Permissions{Bus: BusPermissions{Publish: []string{"test/*"}, Subscribe: []string{"weather"}}},
+	})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("weather/current", "sunny")
+	busPublishFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoPermission, int32(stack[0]))
+
+	stack = mod.call("news")
+	busSubscribeFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoPermission, int32(stack[0]))
+
+	assert.Contains(t, buf.String(), `msg="bus_publish: topic not permitted" module=test topic=weather/current`)
+	assert.Contains(t, buf.String(), `msg="bus_subscribe: topic not permitted" module=test topic=news`)
+
+	stack = mod.call("test/status", "ok")
+	busPublishFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, uint64(0), stack[0])
+}
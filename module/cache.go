@@ -0,0 +1,338 @@
+package module
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+const (
+	metaSuffix = ".meta.json"
+
+	// downloadsDir is the directory of the cache downloaded modules are
+	// kept in, apart from the other data kept in the cache directory.
+	downloadsDir = "downloads"
+)
+
+// CacheEntry describes a module downloaded into the cache.
+type CacheEntry struct {
+	// Path is the path of the cached file relative to the cache directory.
+	Path         string    `json:"-"`
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	ValidatedAt  time.Time `json:"validatedAt"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+}
+
+// cacheKey returns the cache path for u, in the downloads directory. The
+// scheme and host are part of the path so the same path over another
+// scheme or on another host does not collide, and a query is kept as a
+// digest suffix.
+func cacheKey(u *url.URL) string {
+	host := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(u.Host)
+	p := path.Join("/", downloadsDir, strings.ToLower(u.Scheme), host, path.Clean("/"+u.Path))
+	if u.RawQuery != "" {
+		sum := sha256.Sum256([]byte(u.RawQuery))
+		p += "-" + hex.EncodeToString(sum[:6])
+	}
+	return p
+}
+
+// fetchCached returns the cache path of the file given in u, downloading it
+// when it is not cached and revalidating it with the origin when it is.
+// When the origin cannot be reached, a valid cached file is used.
+func (d *Downloader) fetchCached(ctx context.Context, u *url.URL) (string, bool, error) {
+	p := cacheKey(u)
+	uri := u.String()
+
+	entry, ok := d.cachedEntry(p)
+	if !ok {
+		d.log.Info("Downloading module", lctx.Str("url", uri))
+
+		if _, err := d.fetch(ctx, uri, nil); err != nil {
+			return "", false, err
+		}
+		d.removeLegacy(u)
+		return p, false, nil
+	}
+
+	d.log.Debug("Revalidating cached module", lctx.Str("url", uri))
+
+	fetched, err := d.fetch(ctx, uri, &entry)
+	switch {
+	case err != nil:
+		d.log.Warn("Could not revalidate cached module, using cached file", lctx.Str("url", uri), lctx.Err(err))
+		return p, true, nil
+	case fetched == nil:
+		d.log.Info("Using cached module", lctx.Str("path", p))
+		return p, true, nil
+	default:
+		d.log.Info("Cached module changed, downloaded new version", lctx.Str("url", uri))
+		return p, false, nil
+	}
+}
+
+// cachedEntry returns the cache entry for the path if both the file and its
+// metadata exist and the file matches the recorded digest.
+func (d *Downloader) cachedEntry(p string) (CacheEntry, bool) {
+	entry, err := d.readMeta(p)
+	if err != nil {
+		return CacheEntry{}, false
+	}
+	if err = d.VerifyEntry(entry); err != nil {
+		d.log.Warn("Cached module is corrupt", lctx.Str("path", p), lctx.Err(err))
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
+// fetch downloads uri into the cache. If entry is given, the request is
+// made conditional on it and a nil entry is returned when the cached file
+// is still fresh.
+func (d *Downloader) fetch(ctx context.Context, uri string, entry *CacheEntry) (*CacheEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	p := cacheKey(req.URL)
+	now := time.Now()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		entry.ValidatedAt = now
+		if err = d.writeMeta(p, *entry); err != nil {
+			return nil, err
+		}
+		return nil, nil //nolint:nilnil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+
+	newEntry := CacheEntry{
+		Path:         p,
+		URL:          uri,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    now,
+		ValidatedAt:  now,
+		SHA256:       hex.EncodeToString(sum[:]),
+		Size:         int64(len(b)),
+	}
+
+	cachedPath := filepath.Join(d.cachePath, filepath.FromSlash(p))
+	if err = ensurePath(filepath.Dir(cachedPath)); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(cachedPath, b, 0o644); err != nil {
+		return nil, fmt.Errorf("caching file %q: %w", p, err)
+	}
+	if err = d.writeMeta(p, newEntry); err != nil {
+		return nil, err
+	}
+	return &newEntry, nil
+}
+
+func (d *Downloader) readMeta(p string) (CacheEntry, error) {
+	//nolint:gosec // Path is constructed from trusted cache directory and cache key.
+	b, err := os.ReadFile(filepath.Join(d.cachePath, filepath.FromSlash(p)+metaSuffix))
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	var entry CacheEntry
+	if err = json.Unmarshal(b, &entry); err != nil {
+		return CacheEntry{}, fmt.Errorf("decoding cache metadata: %w", err)
+	}
+	entry.Path = p
+	return entry, nil
+}
+
+func (d *Downloader) writeMeta(p string, entry CacheEntry) error {
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(d.cachePath, filepath.FromSlash(p)+metaSuffix), b, 0o644); err != nil {
+		return fmt.Errorf("writing cache metadata: %w", err)
+	}
+	return nil
+}
+
+// Entries returns all modules in the cache, ordered by URL.
+func (d *Downloader) Entries() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	err := filepath.WalkDir(filepath.Join(d.cachePath, downloadsDir), func(file string, de fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if de.IsDir() || !strings.HasSuffix(file, metaSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.cachePath, strings.TrimSuffix(file, metaSuffix))
+		if err != nil {
+			return err
+		}
+		entry, err := d.readMeta("/" + filepath.ToSlash(rel))
+		if err != nil {
+			d.log.Warn("Skipping invalid cache entry", lctx.Str("path", file), lctx.Err(err))
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading cache: %w", err)
+	}
+
+	slices.SortFunc(entries, func(a, b CacheEntry) int { return strings.Compare(a.URL, b.URL) })
+	return entries, nil
+}
+
+// VerifyEntry verifies that the cached file matches the digest recorded
+// when it was downloaded.
+func (d *Downloader) VerifyEntry(entry CacheEntry) error {
+	b, err := d.readFile(entry.Path)
+	if err != nil {
+		return err
+	}
+	return Integrity{SHA256: entry.SHA256}.Verify(b, nil)
+}
+
+// EntryManifest returns the manifest embedded in the cached module. It
+// reports false if the module has no manifest.
+func (d *Downloader) EntryManifest(entry CacheEntry) (Manifest, bool, error) {
+	b, err := d.readFile(entry.Path)
+	if err != nil {
+		return Manifest{}, false, err
+	}
+	return ReadManifest(b)
+}
+
+// Prune removes all cached modules whose URL is not in keep,
+// returning the removed entries.
+func (d *Downloader) Prune(keep []string) ([]CacheEntry, error) {
+	entries, err := d.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []CacheEntry
+	for _, entry := range entries {
+		if slices.Contains(keep, entry.URL) {
+			continue
+		}
+		if err = d.removeEntry(entry.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+func (d *Downloader) removeEntry(p string) error {
+	file := filepath.Join(d.cachePath, filepath.FromSlash(p))
+	for _, name := range []string{file, file + metaSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing cached module: %w", err)
+		}
+	}
+
+	// Remove directories left empty, stopping at the downloads directory.
+	root := filepath.Join(d.cachePath, downloadsDir)
+	for dir := filepath.Dir(file); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// removeLegacy removes the copy of u cached by its path alone, as done
+// before downloads were kept in the downloads directory.
+func (d *Downloader) removeLegacy(u *url.URL) {
+	file := filepath.Join(d.cachePath, filepath.FromSlash(path.Clean("/"+u.Path)))
+	root := filepath.Join(d.cachePath, downloadsDir)
+	if file == root || strings.HasPrefix(file, root+string(filepath.Separator)) {
+		return
+	}
+	if fi, err := os.Lstat(file); err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	if err := os.Remove(file); err != nil {
+		d.log.Warn("Could not remove module cached in the old layout", lctx.Str("path", file), lctx.Err(err))
+		return
+	}
+
+	for dir := filepath.Dir(file); dir != d.cachePath && strings.HasPrefix(dir, d.cachePath); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+}
+
+func writeFileAtomic(name string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }()
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,58 @@
+package module
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "keys by scheme host and path",
+			url:  "https://example.com/mod/test.wasm",
+			want: "/downloads/https/example.com/mod/test.wasm",
+		},
+		{
+			name: "keys http apart from https",
+			url:  "http://example.com/mod/test.wasm",
+			want: "/downloads/http/example.com/mod/test.wasm",
+		},
+		{
+			name: "handles ports",
+			url:  "http://example.com:8080/test.wasm",
+			want: "/downloads/http/example.com_8080/test.wasm",
+		},
+		{
+			name: "handles escaping paths",
+			url:  "https://example.com/../../test.wasm",
+			want: "/downloads/https/example.com/test.wasm",
+		},
+		{
+			name: "handles queries",
+			url:  "https://example.com/test.wasm?v=1",
+			want: "/downloads/https/example.com/test.wasm-a798de8ee75a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+
+			got := cacheKey(u)
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
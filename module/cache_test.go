@@ -0,0 +1,106 @@
+package module_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloader_Entries(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", `"test"`)
+		_, _ = rw.Write([]byte("wasm"))
+	}))
+	t.Cleanup(srv.Close)
+
+	d, err := module.NewDownloader(t.TempDir(), log)
+	require.NoError(t, err)
+
+	_, err = d.Download(t.Context(), srv.URL+"/b.wasm")
+	require.NoError(t, err)
+	_, err = d.Download(t.Context(), srv.URL+"/a.wasm?v=1")
+	require.NoError(t, err)
+
+	got, err := d.Entries()
+
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, srv.URL+"/a.wasm?v=1", got[0].URL)
+	assert.Equal(t, srv.URL+"/b.wasm", got[1].URL)
+	assert.Equal(t, `"test"`, got[1].ETag)
+	assert.Equal(t, int64(4), got[1].Size)
+	sum := sha256.Sum256([]byte("wasm"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), got[1].SHA256)
+	assert.False(t, got[1].FetchedAt.IsZero())
+	for _, entry := range got {
+		assert.NoError(t, d.VerifyEntry(entry))
+	}
+}
+
+func TestDownloader_VerifyEntryHandlesCorruptFile(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("wasm"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := t.TempDir()
+	d, err := module.NewDownloader(cachePath, log)
+	require.NoError(t, err)
+
+	path, err := d.Download(t.Context(), srv.URL+"/a.wasm")
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(cachePath, path), []byte("corrupt"), 0o600)
+	require.NoError(t, err)
+
+	entries, err := d.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	err = d.VerifyEntry(entries[0])
+
+	assert.ErrorContains(t, err, "sha256 mismatch")
+}
+
+func TestDownloader_Prune(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("wasm"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := t.TempDir()
+	d, err := module.NewDownloader(cachePath, log)
+	require.NoError(t, err)
+
+	_, err = d.Download(t.Context(), srv.URL+"/keep/a.wasm")
+	require.NoError(t, err)
+	removedPath, err := d.Download(t.Context(), srv.URL+"/remove/b.wasm")
+	require.NoError(t, err)
+
+	got, err := d.Prune([]string{srv.URL + "/keep/a.wasm"})
+
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, srv.URL+"/remove/b.wasm", got[0].URL)
+	assert.NoFileExists(t, filepath.Join(cachePath, removedPath))
+	assert.NoDirExists(t, filepath.Dir(filepath.Join(cachePath, removedPath)))
+	entries, err := d.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, srv.URL+"/keep/a.wasm", entries[0].URL)
+}
@@ -0,0 +1,42 @@
+package module
+
+import (
+	"context"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Clock is the time source of modules, read by the wall and monotonic
+// clocks and used by sleeps.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep blocks until d has passed, or ctx is done, returning the
+	// error of ctx.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// withClock configures cfg to give the module clock as its clocks, or the
+// system clocks if clock is nil.
+func withClock(cfg wazero.ModuleConfig, clock Clock) wazero.ModuleConfig {
+	if clock == nil {
+		return cfg.WithSysWalltime().WithSysNanotime().WithSysNanosleep()
+	}
+
+	// Monotonic time counts from the start of the module, but is never
+	// zero as language runtimes take zero for a broken clock.
+	start := clock.Now().Add(-time.Nanosecond)
+	return cfg.
+		WithWalltime(func() (int64, int32) {
+			now := clock.Now()
+			return now.Unix(), int32(now.Nanosecond()) //nolint:gosec // Nanoseconds fit.
+		}, sys.ClockResolution(1)).
+		WithNanotime(func() int64 {
+			return int64(clock.Now().Sub(start))
+		}, sys.ClockResolution(1)).
+		WithNanosleep(func(ns int64) {
+			_ = clock.Sleep(context.Background(), time.Duration(ns))
+		})
+}
@@ -0,0 +1,60 @@
+package module
+
+import "reflect"
+
+// Changes describes the differences between two sets of module descriptors.
+type Changes struct {
+	// Removed contains the modules that are no longer configured.
+	Removed []Descriptor
+	// Added contains the modules that are newly configured.
+	Added []Descriptor
+	// Changed contains the modules that must be restarted.
+	Changed []Descriptor
+	// Moved contains the modules where only the position changed.
+	Moved []Descriptor
+}
+
+// Empty reports whether there are no changes.
+func (c Changes) Empty() bool {
+	return len(c.Removed) == 0 && len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Moved) == 0
+}
+
+// Diff compares the previous and next module descriptors by name.
+// Descriptors in the results are taken from next, except for removed
+// modules which are taken from prev.
+func Diff(prev, next []Descriptor) Changes {
+	old := make(map[string]Descriptor, len(prev))
+	for _, desc := range prev {
+		old[desc.Name] = desc
+	}
+
+	var c Changes
+	seen := make(map[string]bool, len(next))
+	for _, desc := range next {
+		seen[desc.Name] = true
+
+		oldDesc, ok := old[desc.Name]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, desc)
+		case !equalIgnoringPosition(oldDesc, desc):
+			c.Changed = append(c.Changed, desc)
+		case oldDesc.Position != desc.Position:
+			c.Moved = append(c.Moved, desc)
+		}
+	}
+	for _, desc := range prev {
+		if !seen[desc.Name] {
+			c.Removed = append(c.Removed, desc)
+		}
+	}
+	return c
+}
+
+func equalIgnoringPosition(a, b Descriptor) bool {
+	a.Position = Position{}
+	b.Position = Position{}
+	// Moving a config around the file does not change it.
+	a.configLines, b.configLines = nil, nil
+	return reflect.DeepEqual(a, b)
+}
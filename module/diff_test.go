@@ -0,0 +1,64 @@
+package module_test
+
+import (
+	"testing"
+
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	topRight := module.Position{Vertical: module.Top, Horizontal: module.Right}
+	bottomLeft := module.Position{Vertical: module.Bottom, Horizontal: module.Left}
+
+	prev := []module.Descriptor{
+		{Name: "unchanged", URI: "a.wasm", Position: topRight, Config: map[string]any{"a": 1}},
+		{Name: "removed", URI: "b.wasm", Position: topRight},
+		{Name: "changed", URI: "c.wasm", Position: topRight, Config: map[string]any{"a": 1}},
+		{Name: "moved", URI: "d.wasm", Position: topRight},
+	}
+	next := []module.Descriptor{
+		{Name: "unchanged", URI: "a.wasm", Position: topRight, Config: map[string]any{"a": 1}},
+		{Name: "changed", URI: "c.wasm", Position: bottomLeft, Config: map[string]any{"a": 2}},
+		{Name: "moved", URI: "d.wasm", Position: bottomLeft},
+		{Name: "added", URI: "e.wasm", Position: topRight},
+	}
+
+	got := module.Diff(prev, next)
+
+	assert.Equal(t, []module.Descriptor{prev[1]}, got.Removed)
+	assert.Equal(t, []module.Descriptor{next[3]}, got.Added)
+	assert.Equal(t, []module.Descriptor{next[1]}, got.Changed)
+	assert.Equal(t, []module.Descriptor{next[2]}, got.Moved)
+	assert.False(t, got.Empty())
+}
+
+func TestDiff_NoChanges(t *testing.T) {
+	t.Parallel()
+
+	descs := []module.Descriptor{
+		{Name: "test", URI: "a.wasm", Config: map[string]any{"a": []any{1, 2}}},
+	}
+
+	got := module.Diff(descs, descs)
+
+	assert.True(t, got.Empty())
+}
+
+func TestDiff_IgnoresConfigLines(t *testing.T) {
+	t.Parallel()
+
+	var prev, next []module.Descriptor
+	err := yaml.Unmarshal([]byte("- name: test\n  uri: a.wasm\n  config:\n    a: 1\n"), &prev)
+	require.NoError(t, err)
+	err = yaml.Unmarshal([]byte("\n\n- name: test\n  uri: a.wasm\n  config:\n    a: 1\n"), &next)
+	require.NoError(t, err)
+
+	got := module.Diff(prev, next)
+
+	assert.True(t, got.Empty())
+}
@@ -3,27 +3,48 @@ package module
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/hamba/logger/v2"
 	lctx "github.com/hamba/logger/v2/ctx"
 )
 
+// DownloaderOption configures a Downloader.
+type DownloaderOption func(*Downloader)
+
+// WithIndex sets the index used to resolve module paths and versions.
+func WithIndex(idx IndexConfig) DownloaderOption {
+	return func(d *Downloader) {
+		d.index = idx
+	}
+}
+
+// WithTrustedKeys sets the public keys trusted to sign modules.
+func WithTrustedKeys(keys []PublicKey) DownloaderOption {
+	return func(d *Downloader) {
+		d.keys = keys
+	}
+}
+
 // Downloader downloads and caches modules.
 type Downloader struct {
 	httpClient *http.Client
 	cachePath  string
+	index      IndexConfig
+	keys       []PublicKey
+
+	pinsMu sync.Mutex
 
 	log *logger.Logger
 }
 
 // NewDownloader returns a Downloader with the cachePath.
 // If the cache path does not exist, the reader attempts to create it.
-func NewDownloader(cachePath string, log *logger.Logger) (*Downloader, error) {
+func NewDownloader(cachePath string, log *logger.Logger, opts ...DownloaderOption) (*Downloader, error) {
 	if err := ensurePath(cachePath); err != nil {
 		return nil, err
 	}
@@ -33,20 +54,52 @@ func NewDownloader(cachePath string, log *logger.Logger) (*Downloader, error) {
 		return nil, err
 	}
 
-	return &Downloader{
+	d := &Downloader{
 		httpClient: http.DefaultClient,
 		cachePath:  cachePath,
 		log:        log,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
 }
 
 // DownloadBytes fetches the file given by uri, caching it locally, and returns
-// its contents as bytes. It is the counterpart to Download used by ExtismRunner.
-func (d *Downloader) DownloadBytes(ctx context.Context, uri string) ([]byte, error) {
-	path, err := d.Download(ctx, uri)
+// its contents as bytes once they match the expected integrity. A cached file
+// that does not match is fetched again; a mismatched file is never returned.
+func (d *Downloader) DownloadBytes(ctx context.Context, uri string, integrity Integrity) ([]byte, error) {
+	path, cached, err := d.download(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readFile(path)
 	if err != nil {
 		return nil, err
 	}
+
+	err = integrity.Verify(data, d.keys)
+	if err != nil && cached {
+		d.log.Warn("Cached module failed verification, downloading again", lctx.Str("path", path), lctx.Err(err))
+
+		if err = d.removeEntry(path); err != nil {
+			return nil, err
+		}
+		if path, _, err = d.download(ctx, uri); err != nil {
+			return nil, err
+		}
+		if data, err = d.readFile(path); err != nil {
+			return nil, err
+		}
+		err = integrity.Verify(data, d.keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("refusing to run module %s: %w", uri, err)
+	}
+	return data, nil
+}
+
+func (d *Downloader) readFile(path string) ([]byte, error) {
 	//nolint:gosec // Path is constructed from trusted cache directory and validated module path.
 	data, err := os.ReadFile(filepath.Join(d.cachePath, path))
 	if err != nil {
@@ -55,77 +108,35 @@ func (d *Downloader) DownloadBytes(ctx context.Context, uri string) ([]byte, err
 	return data, nil
 }
 
-// Download fetches the file given in uri, caching it locally.
+// Download fetches the file given in uri, caching it locally, and returns its
+// path relative to the cache directory. Files fetched over HTTP are cached by
+// host and path, and revalidated with the origin when already cached.
 func (d *Downloader) Download(ctx context.Context, uri string) (string, error) {
+	path, _, err := d.download(ctx, uri)
+	return path, err
+}
+
+// download fetches the file given in uri, reporting if it was served from the cache.
+func (d *Downloader) download(ctx context.Context, uri string) (string, bool, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
-		return "", fmt.Errorf("parsing uri: %w", err)
+		return "", false, fmt.Errorf("parsing uri: %w", err)
 	}
 
 	switch u.Scheme {
 	case "file", "":
 		path := filepath.Join(d.cachePath, u.Path)
 		if _, err = os.Stat(path); err != nil {
-			return "", err
+			return "", false, err
 		}
-		return u.Path, nil
+		return u.Path, false, nil
 	case "http", "https":
-		return d.withCache(u.Path, func() ([]byte, error) {
-			return d.readHTTPFile(ctx, uri)
-		})
+		return d.fetchCached(ctx, u)
 	default:
-		return "", fmt.Errorf("unsupported uri scheme %q", u.Scheme)
+		return "", false, fmt.Errorf("unsupported uri scheme %q", u.Scheme)
 	}
 }
 
-func (d *Downloader) withCache(path string, fn func() ([]byte, error)) (string, error) {
-	cachedPath := filepath.Join(d.cachePath, path)
-
-	if _, err := os.Stat(cachedPath); err == nil {
-		d.log.Info("Using cached module", lctx.Str("path", path))
-
-		return path, nil
-	}
-	b, err := fn()
-	if err != nil {
-		return "", err
-	}
-
-	dir := filepath.Dir(cachedPath)
-	if err = ensurePath(dir); err != nil {
-		return "", err
-	}
-
-	if err = os.WriteFile(cachedPath, b, 0o644); err != nil {
-		return "", fmt.Errorf("caching file %q: %w", path, err)
-	}
-	return path, nil
-}
-
-func (d *Downloader) readHTTPFile(ctx context.Context, url string) ([]byte, error) {
-	d.log.Info("Downloading module", lctx.Str("url", url))
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := d.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		_, _ = io.Copy(io.Discard, resp.Body)
-		_ = resp.Body.Close()
-	}()
-
-	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
-	}
-
-	return io.ReadAll(resp.Body)
-}
-
 func ensurePath(path string) error {
 	if err := os.MkdirAll(path, 0o750); err != nil {
 		return fmt.Errorf("creating path %q: %w", path, err)
@@ -2,10 +2,16 @@ package module_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/glasslabs/looking-glass/module"
@@ -104,20 +110,58 @@ func TestDownload_DownloadHTTPFile(t *testing.T) {
 			got, err := r.Download(context.Background(), url)
 
 			test.wantErr(t, err)
-			assert.Equal(t, test.want, got)
+			if test.want != "" {
+				assert.Equal(t, "/downloads/http/"+strings.ReplaceAll(srv.Listener.Addr().String(), ":", "_")+test.want, got)
+			}
 		})
 	}
 }
 
+func TestDownload_DownloadHTTPFileRemovesOldLayout(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("module"))
+	}))
+	t.Cleanup(srv.Close)
+
+	tmpDir := t.TempDir()
+	legacy := filepath.Join(tmpDir, "glasslabs", "clock", "clock.wasm")
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacy), 0o750))
+	require.NoError(t, os.WriteFile(legacy, []byte("old module"), 0o600))
+	local := filepath.Join(tmpDir, "local.wasm")
+	require.NoError(t, os.WriteFile(local, []byte("local module"), 0o600))
+
+	d, err := module.NewDownloader(tmpDir, log)
+	require.NoError(t, err)
+
+	got, err := d.Download(t.Context(), srv.URL+"/glasslabs/clock/clock.wasm")
+
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(tmpDir, filepath.FromSlash(got)))
+	assert.NoFileExists(t, legacy)
+	assert.NoDirExists(t, filepath.Join(tmpDir, "glasslabs"))
+	assert.FileExists(t, local)
+}
+
 func TestDownload_DownloadHTTPCachedFile(t *testing.T) {
 	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
 
-	var called int
+	var called, revalidated atomic.Int32
 	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		called++
+		called.Add(1)
+
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			revalidated.Add(1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
 
 		b, err := os.ReadFile("testdata/test.wasm")
 		assert.NoError(t, err)
+		rw.Header().Set("ETag", `"v1"`)
 		_, _ = rw.Write(b)
 	}))
 	t.Cleanup(srv.Close)
@@ -134,5 +178,136 @@ func TestDownload_DownloadHTTPCachedFile(t *testing.T) {
 	_, err = r.Download(context.Background(), url)
 
 	require.NoError(t, err)
-	assert.Equal(t, 1, called)
+	assert.Equal(t, int32(2), called.Load())
+	assert.Equal(t, int32(1), revalidated.Load())
+}
+
+func TestDownload_DownloadHTTPFileChanged(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	var version atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version.Load())
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		_, _ = rw.Write([]byte(etag))
+	}))
+	t.Cleanup(srv.Close)
+
+	r, err := module.NewDownloader(t.TempDir(), log)
+	require.NoError(t, err)
+
+	url := srv.URL + "/clock.wasm"
+	_, err = r.DownloadBytes(t.Context(), url, module.Integrity{})
+	require.NoError(t, err)
+
+	version.Store(1)
+
+	got, err := r.DownloadBytes(t.Context(), url, module.Integrity{})
+
+	require.NoError(t, err)
+	assert.Equal(t, `"v1"`, string(got))
+}
+
+func TestDownload_DownloadHTTPFileUsesCacheWhenOffline(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("wasm"))
+	}))
+
+	r, err := module.NewDownloader(t.TempDir(), log)
+	require.NoError(t, err)
+
+	url := srv.URL + "/clock.wasm"
+	_, err = r.DownloadBytes(t.Context(), url, module.Integrity{})
+	require.NoError(t, err)
+
+	srv.Close()
+
+	got, err := r.DownloadBytes(t.Context(), url, module.Integrity{})
+
+	require.NoError(t, err)
+	assert.Equal(t, "wasm", string(got))
+}
+
+func TestDownload_DownloadHTTPFileKeysByHost(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv1 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("one"))
+	}))
+	t.Cleanup(srv1.Close)
+	srv2 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("two"))
+	}))
+	t.Cleanup(srv2.Close)
+
+	r, err := module.NewDownloader(t.TempDir(), log)
+	require.NoError(t, err)
+
+	got1, err := r.DownloadBytes(t.Context(), srv1.URL+"/clock.wasm", module.Integrity{})
+	require.NoError(t, err)
+	got2, err := r.DownloadBytes(t.Context(), srv2.URL+"/clock.wasm", module.Integrity{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "one", string(got1))
+	assert.Equal(t, "two", string(got2))
+}
+
+func TestDownload_DownloadBytesVerifiesIntegrity(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	want, err := os.ReadFile("testdata/test.wasm")
+	require.NoError(t, err)
+	sum := sha256.Sum256(want)
+
+	var called atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called.Add(1)
+
+		_, _ = rw.Write(want)
+	}))
+	t.Cleanup(srv.Close)
+
+	tmpDir := t.TempDir()
+	r, err := module.NewDownloader(tmpDir, log)
+	require.NoError(t, err)
+
+	url := srv.URL + "/testdata/test.wasm"
+	integrity := module.Integrity{SHA256: hex.EncodeToString(sum[:])}
+	_, err = r.DownloadBytes(t.Context(), url, integrity)
+	require.NoError(t, err)
+
+	// Corrupt the cached file.
+	host := strings.ReplaceAll(srv.Listener.Addr().String(), ":", "_")
+	err = os.WriteFile(filepath.Join(tmpDir, "downloads", "http", host, "testdata", "test.wasm"), []byte("corrupt"), 0o600)
+	require.NoError(t, err)
+
+	got, err := r.DownloadBytes(t.Context(), url, integrity)
+
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.Equal(t, int32(2), called.Load())
+}
+
+func TestDownload_DownloadBytesHandlesMismatch(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("tampered"))
+	}))
+	t.Cleanup(srv.Close)
+
+	r, err := module.NewDownloader(t.TempDir(), log)
+	require.NoError(t, err)
+
+	url := srv.URL + "/testdata/test.wasm"
+	_, err = r.DownloadBytes(t.Context(), url, module.Integrity{SHA256: strings.Repeat("00", 32)})
+
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "refusing to run module "+url+": sha256 mismatch")
 }
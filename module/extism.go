@@ -0,0 +1,409 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	// extismKernelModule is the host module implementing the Extism
+	// runtime kernel.
+	extismKernelModule = "extism:host/env"
+
+	// defaultKernelMemory is the kernel memory available to an Extism
+	// plugin when its memory is not limited.
+	defaultKernelMemory = 64 << 20
+
+	// maxVarBytes is the maximum size of the variables of an Extism plugin.
+	maxVarBytes = 1 << 20
+
+	// defaultMaxHTTPResponseBytes is the maximum size of a response read
+	// by http_request when the response size is not limited.
+	defaultMaxHTTPResponseBytes = 50 << 20
+)
+
+// extismKernel is the state of the Extism runtime kernel for a plugin
+// instance. Plugins exchange data with the host through blocks allocated
+// in the kernel memory, addressed by offsets. Offset 0 is never allocated,
+// so it can mean "none".
+type extismKernel struct {
+	mem    []byte
+	blocks map[uint64]uint64
+	limit  uint64
+
+	input     [2]uint64 // Offset and length.
+	output    [2]uint64 // Offset and length.
+	errOffset uint64
+
+	config  map[string]string
+	vars    map[string][]byte
+	varSize int
+
+	httpStatus  int32
+	httpHeaders map[string]string
+}
+
+func newExtismKernel(config map[string]string, limit uint64) *extismKernel {
+	return &extismKernel{
+		blocks: map[uint64]uint64{},
+		limit:  limit,
+		config: config,
+		vars:   map[string][]byte{},
+	}
+}
+
+// reset frees the kernel memory, ready for the next call.
+func (k *extismKernel) reset() {
+	k.mem = k.mem[:0]
+	clear(k.blocks)
+	k.input = [2]uint64{}
+	k.output = [2]uint64{}
+	k.errOffset = 0
+}
+
+// alloc allocates a block of n bytes, returning its offset or 0 if the
+// kernel memory is exhausted. Memory is only reclaimed by reset.
+func (k *extismKernel) alloc(n uint64) uint64 {
+	if n == 0 || uint64(len(k.mem))+n > k.limit {
+		return 0
+	}
+	offs := uint64(len(k.mem)) + 1
+	k.mem = append(k.mem, make([]byte, n)...)
+	k.blocks[offs] = n
+	return offs
+}
+
+// bytes returns the n bytes of memory at offs.
+func (k *extismKernel) bytes(offs, n uint64) ([]byte, bool) {
+	start := offs - 1
+	if offs == 0 || start > uint64(len(k.mem)) || n > uint64(len(k.mem))-start {
+		return nil, false
+	}
+	return k.mem[start : start+n], true
+}
+
+// block returns the contents of the block at offs.
+func (k *extismKernel) block(offs uint64) ([]byte, bool) {
+	n, ok := k.blocks[offs]
+	if !ok {
+		return nil, false
+	}
+	return k.bytes(offs, n)
+}
+
+// write allocates a block holding b, returning its offset.
+func (k *extismKernel) write(b []byte) uint64 {
+	offs := k.alloc(uint64(len(b)))
+	if offs == 0 {
+		return 0
+	}
+	copy(k.mem[offs-1:], b)
+	return offs
+}
+
+// setInput writes the input of the next call.
+func (k *extismKernel) setInput(b []byte) {
+	k.input = [2]uint64{k.write(b), uint64(len(b))}
+}
+
+// result returns the output and error message set by the last call.
+func (k *extismKernel) result() ([]byte, string) {
+	var out []byte
+	if k.output[1] > 0 {
+		b, _ := k.bytes(k.output[0], k.output[1])
+		out = bytes.Clone(b)
+	}
+	var msg string
+	if k.errOffset != 0 {
+		b, _ := k.block(k.errOffset)
+		msg = string(b)
+	}
+	return out, msg
+}
+
+// buildExtismModule registers the Extism runtime kernel into rt. The
+// kernel is described in https://github.com/extism/proposals/blob/main/EIP-007-extism-runtime-kernel.md.
+//
+// Plugin configuration is read with config_get, mapped from the module
+// config: strings are passed as they are, other values as JSON. HTTP
+// requests made with http_request use the client of the module, with its
+// permissions, cache and request scheduling. As in Extism, a request not
+// permitted traps the call.
+func buildExtismModule(ctx context.Context, rt wazero.Runtime, r *extismRunner) error {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+
+	b := rt.NewHostModuleBuilder(extismKernelModule)
+	export := func(name string, fn func(k *extismKernel, stack []uint64), params, results []api.ValueType) {
+		b.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(func(_ context.Context, mod api.Module, stack []uint64) {
+				k, ok := r.kernels.Load(mod.Name())
+				if !ok {
+					panic(fmt.Errorf("%s: module %s is not an extism plugin", name, mod.Name()))
+				}
+				fn(k, stack)
+			}), params, results).
+			Export(name)
+	}
+
+	export("alloc", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.alloc(stack[0])
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("free", func(k *extismKernel, stack []uint64) {
+		delete(k.blocks, stack[0])
+	}, []api.ValueType{i64}, nil)
+	export("length", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.blocks[stack[0]]
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("length_unsafe", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.blocks[stack[0]]
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("load_u8", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(stack[0], 1)
+		if !ok {
+			panic(fmt.Errorf("load_u8: invalid offset %d", stack[0]))
+		}
+		stack[0] = uint64(b[0])
+	}, []api.ValueType{i64}, []api.ValueType{i32})
+	export("load_u64", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(stack[0], 8)
+		if !ok {
+			panic(fmt.Errorf("load_u64: invalid offset %d", stack[0]))
+		}
+		stack[0] = binary.LittleEndian.Uint64(b)
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("store_u8", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(stack[0], 1)
+		if !ok {
+			panic(fmt.Errorf("store_u8: invalid offset %d", stack[0]))
+		}
+		b[0] = byte(stack[1])
+	}, []api.ValueType{i64, i32}, nil)
+	export("store_u64", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(stack[0], 8)
+		if !ok {
+			panic(fmt.Errorf("store_u64: invalid offset %d", stack[0]))
+		}
+		binary.LittleEndian.PutUint64(b, stack[1])
+	}, []api.ValueType{i64, i64}, nil)
+	export("input_set", func(k *extismKernel, stack []uint64) {
+		k.input = [2]uint64{stack[0], stack[1]}
+	}, []api.ValueType{i64, i64}, nil)
+	export("input_offset", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.input[0]
+	}, nil, []api.ValueType{i64})
+	export("input_length", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.input[1]
+	}, nil, []api.ValueType{i64})
+	export("input_load_u8", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(k.input[0]+stack[0], 1)
+		if !ok || stack[0] >= k.input[1] {
+			panic(fmt.Errorf("input_load_u8: invalid offset %d", stack[0]))
+		}
+		stack[0] = uint64(b[0])
+	}, []api.ValueType{i64}, []api.ValueType{i32})
+	export("input_load_u64", func(k *extismKernel, stack []uint64) {
+		b, ok := k.bytes(k.input[0]+stack[0], 8)
+		if !ok || stack[0]+8 > k.input[1] {
+			panic(fmt.Errorf("input_load_u64: invalid offset %d", stack[0]))
+		}
+		stack[0] = binary.LittleEndian.Uint64(b)
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("output_set", func(k *extismKernel, stack []uint64) {
+		k.output = [2]uint64{stack[0], stack[1]}
+	}, []api.ValueType{i64, i64}, nil)
+	export("output_offset", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.output[0]
+	}, nil, []api.ValueType{i64})
+	export("output_length", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.output[1]
+	}, nil, []api.ValueType{i64})
+	export("error_set", func(k *extismKernel, stack []uint64) {
+		k.errOffset = stack[0]
+	}, []api.ValueType{i64}, nil)
+	export("error_get", func(k *extismKernel, stack []uint64) {
+		stack[0] = k.errOffset
+	}, nil, []api.ValueType{i64})
+	export("memory_bytes", func(k *extismKernel, stack []uint64) {
+		stack[0] = uint64(len(k.mem))
+	}, nil, []api.ValueType{i64})
+	export("reset", func(k *extismKernel, _ []uint64) {
+		k.reset()
+	}, nil, nil)
+	export("config_get", func(k *extismKernel, stack []uint64) {
+		key, _ := k.block(stack[0])
+		v, ok := k.config[string(key)]
+		if !ok {
+			stack[0] = 0
+			return
+		}
+		stack[0] = k.write([]byte(v))
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("var_get", func(k *extismKernel, stack []uint64) {
+		key, _ := k.block(stack[0])
+		v, ok := k.vars[string(key)]
+		if !ok {
+			stack[0] = 0
+			return
+		}
+		stack[0] = k.write(v)
+	}, []api.ValueType{i64}, []api.ValueType{i64})
+	export("var_set", func(k *extismKernel, stack []uint64) {
+		key, _ := k.block(stack[0])
+		k.varSize -= len(k.vars[string(key)])
+		delete(k.vars, string(key))
+		if stack[1] == 0 {
+			return
+		}
+		v, _ := k.block(stack[1])
+		if k.varSize+len(v) > maxVarBytes {
+			panic(fmt.Errorf("var_set: variables exceed %d bytes", maxVarBytes))
+		}
+		k.vars[string(key)] = bytes.Clone(v)
+		k.varSize += len(v)
+	}, []api.ValueType{i64, i64}, nil)
+	export("http_status_code", func(k *extismKernel, stack []uint64) {
+		stack[0] = uint64(k.httpStatus)
+	}, nil, []api.ValueType{i32})
+	export("http_headers", func(k *extismKernel, stack []uint64) {
+		if k.httpHeaders == nil {
+			stack[0] = 0
+			return
+		}
+		b, _ := json.Marshal(k.httpHeaders)
+		stack[0] = k.write(b)
+	}, nil, []api.ValueType{i64})
+	export("get_log_level", func(_ *extismKernel, stack []uint64) {
+		// All messages are sent, the host logger filters them.
+		stack[0] = 0
+	}, nil, []api.ValueType{i32})
+
+	b.NewFunctionBuilder().
+		WithGoModuleFunction(extismHTTPRequestFunc(r), []api.ValueType{i64, i64}, []api.ValueType{i64}).
+		Export("http_request")
+	for _, level := range []string{"trace", "debug", "info", "warn", "error"} {
+		b.NewFunctionBuilder().
+			WithGoModuleFunction(extismLogFunc(r, level), []api.ValueType{i64}, nil).
+			Export("log_" + level)
+	}
+
+	_, err := b.Instantiate(ctx)
+	return err
+}
+
+// extismHTTPRequest is the request of an Extism http_request call.
+type extismHTTPRequest struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+}
+
+// extismHTTPRequestFunc makes an HTTP request with the client of the
+// module, returning the offset of the response body.
+func extismHTTPRequestFunc(r *extismRunner) api.GoModuleFunc {
+	log := r.env.log
+
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		k, ok := r.kernels.Load(mod.Name())
+		if !ok {
+			panic(fmt.Errorf("http_request: module %s is not an extism plugin", mod.Name()))
+		}
+		menv, ok := r.env.module(mod)
+		if !ok {
+			panic(fmt.Errorf("http_request: module %s is not registered", mod.Name()))
+		}
+		k.httpStatus, k.httpHeaders = 0, nil
+
+		reqJSON, _ := k.block(stack[0])
+		var hr extismHTTPRequest
+		if err := json.Unmarshal(reqJSON, &hr); err != nil {
+			panic(fmt.Errorf("http_request: invalid request: %w", err))
+		}
+		if hr.Method == "" {
+			hr.Method = http.MethodGet
+		}
+
+		var body io.Reader
+		if stack[1] != 0 {
+			b, _ := k.block(stack[1])
+			body = bytes.NewReader(b)
+		}
+		req, err := http.NewRequestWithContext(ctx, strings.ToUpper(hr.Method), hr.URL, body)
+		if err != nil {
+			panic(fmt.Errorf("http_request: invalid request: %w", err))
+		}
+		for key, v := range hr.Headers {
+			req.Header.Set(key, v)
+		}
+
+		if !menv.perms.allowsRequest(req.Method, req.URL) {
+			log.Warn("http_request: request not permitted",
+				lctx.Str("module", mod.Name()), lctx.Str("method", req.Method), lctx.Str("url", req.URL.Redacted()))
+			panic(fmt.Errorf("HTTP request to '%s' is not allowed", req.URL.Redacted()))
+		}
+
+		resp, err := menv.client.Do(req)
+		if err != nil {
+			panic(fmt.Errorf("http_request: %w", err))
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		limit := menv.limits.MaxResponseBytes
+		if limit == 0 {
+			limit = defaultMaxHTTPResponseBytes
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			panic(fmt.Errorf("http_request: reading response: %w", err))
+		}
+		if int64(len(b)) > limit {
+			panic(fmt.Errorf("http_request: response exceeds %d bytes", limit))
+		}
+
+		k.httpStatus = int32(resp.StatusCode) //nolint:gosec // Status codes are small.
+		k.httpHeaders = make(map[string]string, len(resp.Header))
+		for key, v := range resp.Header {
+			k.httpHeaders[strings.ToLower(key)] = strings.Join(v, ",")
+		}
+		if len(b) == 0 {
+			stack[0] = 0
+			return
+		}
+		stack[0] = k.write(b)
+	}
+}
+
+// extismLogFunc logs a message of the plugin at level.
+func extismLogFunc(r *extismRunner, level string) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		k, ok := r.kernels.Load(mod.Name())
+		if !ok {
+			return
+		}
+		msg, _ := k.block(stack[0])
+
+		line := r.env.secrets.redact(string(msg))
+		field := lctx.Str("module", mod.Name())
+		switch level {
+		case "error":
+			r.log.Error(line, field)
+		case "warn":
+			r.log.Warn(line, field)
+		case "info":
+			r.log.Info(line, field)
+		case "debug":
+			r.log.Debug(line, field)
+		default:
+			r.log.Trace(line, field)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/glasslabs/client-go"
+)
+
+// GoModule is a module written in Go and run in-process, so it can be
+// run under a debugger or compiled into a custom glass binary. It mirrors
+// the contract of WASM modules.
+type GoModule interface {
+	// Run runs the module until ctx is canceled, rendering its widgets
+	// with host.
+	Run(ctx context.Context, host *Host) error
+}
+
+// GoModuleFunc is a function acting as a GoModule.
+type GoModuleFunc func(ctx context.Context, host *Host) error
+
+// Run calls f.
+func (f GoModuleFunc) Run(ctx context.Context, host *Host) error {
+	return f(ctx, host)
+}
+
+var (
+	goModulesMu sync.RWMutex
+	goModules   = map[string]GoModule{}
+)
+
+// RegisterGoModule registers a Go module under name, so it can be loaded
+// with the URI "go://name". It panics if name is already registered.
+func RegisterGoModule(name string, mod GoModule) {
+	goModulesMu.Lock()
+	defer goModulesMu.Unlock()
+
+	if mod == nil {
+		panic("module: go module " + name + " is nil")
+	}
+	if _, ok := goModules[name]; ok {
+		panic("module: go module " + name + " is already registered")
+	}
+	goModules[name] = mod
+}
+
+// GoModules returns the names of the registered Go modules, sorted.
+func GoModules() []string {
+	goModulesMu.RLock()
+	defer goModulesMu.RUnlock()
+
+	names := make([]string, 0, len(goModules))
+	for name := range goModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupGoModule(name string) (GoModule, bool) {
+	goModulesMu.RLock()
+	defer goModulesMu.RUnlock()
+
+	mod, ok := goModules[name]
+	return mod, ok
+}
+
+// goModuleName returns the name of the Go module in uri, if uri is a
+// go:// URI.
+func goModuleName(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "go" {
+		return "", false
+	}
+	return u.Host, true
+}
+
+// Host is the host of a running Go module.
+type Host struct {
+	name       string
+	config     []byte
+	assetsPath string
+	client     *http.Client
+	render     func(widgetXML []byte) error
+}
+
+// Name returns the module name.
+func (h *Host) Name() string {
+	return h.name
+}
+
+// ParseConfig decodes the module configuration into v. If the module has
+// no configuration, v is left unchanged.
+func (h *Host) ParseConfig(v any) error {
+	if len(h.config) == 0 || string(h.config) == "null" {
+		return nil
+	}
+	return json.Unmarshal(h.config, v)
+}
+
+// Asset returns the contents of the named file from the assets directory.
+func (h *Host) Asset(path string) ([]byte, error) {
+	if h.assetsPath == "" {
+		return nil, errors.New("assets are not available")
+	}
+	root, err := os.OpenRoot(h.assetsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = root.Close() }()
+
+	return root.ReadFile(filepath.FromSlash(path))
+}
+
+// Render sends a widget tree to the display, replacing the current content.
+// The widget is encoded as a WASM module would encode it, so it renders
+// the same.
+func (h *Host) Render(w client.Widget) error {
+	b, err := xml.Marshal(w)
+	if err != nil {
+		return fmt.Errorf("encoding widget: %w", err)
+	}
+	return h.render(b)
+}
+
+// HTTPClient returns the HTTP client of the module. Requests are subject
+// to the permissions, http configuration, cache and request scheduler of
+// the module, as for WASM modules.
+func (h *Host) HTTPClient() *http.Client {
+	return h.client
+}
+
+// permittedTransport fails requests the permissions of a module do not
+// allow.
+type permittedTransport struct {
+	perms *Permissions
+	next  http.RoundTripper
+}
+
+func (t permittedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.perms.allowsRequest(req.Method, req.URL) {
+		return nil, fmt.Errorf("%s request to %q is not permitted", req.Method, req.URL.Redacted())
+	}
+	return t.next.RoundTrip(req)
+}
@@ -3,68 +3,420 @@ package module
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/glasslabs/client-go"
+	"github.com/go4org/hashtriemap"
 	"github.com/hamba/logger/v2"
 	lctx "github.com/hamba/logger/v2/ctx"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
 )
 
-// streamStore manages open HTTP response streams keyed by a numeric handle.
-// Handles are issued with a monotonically increasing counter so they are
-// unique for the lifetime of the process.
-type streamStore struct {
-	counter atomic.Int32
+// Host function error numbers. They are returned to the plugin as
+// negative i32 values.
+const (
+	errnoInvalid    int32 = -1 // Invalid argument or handle.
+	errnoIO         int32 = -2 // I/O error.
+	errnoPermission int32 = -3 // Permission denied.
+	errnoNotFound   int32 = -4 // Not found.
+	errnoQuota      int32 = -5 // Quota exceeded.
+	errnoClosed     int32 = -6 // Connection closed.
+	errnoDecode     int32 = -7 // Widget could not be decoded.
+)
 
-	mu      sync.Mutex
-	streams map[int32]*openStream
+// errno encodes n as an i32 result value.
+func errno(n int32) uint64 {
+	return uint64(uint32(n))
 }
 
-func newStreamStore() *streamStore {
-	return &streamStore{streams: make(map[int32]*openStream)}
+// writeResult writes b into the plugin buffer and returns its length.
+// Nothing is written when b does not fit, so the plugin can retry with
+// a buffer of the returned length.
+func writeResult(mod api.Module, ptr, length uint32, b []byte) uint64 {
+	if len(b) <= int(length) && !mod.Memory().Write(ptr, b) {
+		return errno(errnoInvalid)
+	}
+	return uint64(len(b))
 }
 
-// openStream holds an in-flight HTTP response body.
-type openStream struct {
-	resp *http.Response
+// hostEnv holds the state shared by the host functions.
+type hostEnv struct {
+	ui       UIProvider
+	dataPath string
+	bus      *bus
+	brokers  map[string]*mqttBroker
+	cache    *httpCache
+	sched    *scheduler
+	secrets  *Secrets
+	// transport, when set, makes the HTTP requests of modules.
+	transport http.RoundTripper
+	mods      hashtriemap.HashTrieMap[string, *moduleEnv]
+
+	log *logger.Logger
+}
+
+// newHostEnv returns a host environment storing module data in dataPath.
+// Module data is not persisted if dataPath is empty.
+func newHostEnv(ui UIProvider, dataPath string, log *logger.Logger) *hostEnv {
+	return &hostEnv{
+		ui:       ui,
+		dataPath: dataPath,
+		bus:      newBus(),
+		log:      log,
+	}
+}
+
+// register registers the environment of the module instance described by desc.
+func (e *hostEnv) register(desc Descriptor) (*moduleEnv, error) {
+	env, err := newModuleEnv(desc, e.dataPath, e.log)
+	if err != nil {
+		return nil, err
+	}
+	if e.transport != nil {
+		env.client.Transport = e.transport
+	}
+	if e.sched != nil {
+		env.client.Transport = e.sched.transport(desc.Name, env.client.Transport)
+	}
+	if e.cache != nil {
+		env.client.Transport = e.cache.transport(desc.Name, desc.HTTP.cachePartition(), env.client.Transport)
+	}
+	e.mods.Store(desc.Name, env)
+	return env, nil
+}
+
+// unregister removes the environment of a module instance, closing
+// everything it still holds open.
+func (e *hostEnv) unregister(env *moduleEnv) {
+	// A newer instance of the module may already be registered.
+	e.mods.CompareAndDelete(env.name, env)
+
+	env.close()
+}
+
+// module returns the environment of the calling module instance.
+func (e *hostEnv) module(mod api.Module) (*moduleEnv, bool) {
+	return e.mods.Load(mod.Name())
+}
+
+// stream returns the open stream with the handle of the calling module instance.
+func (e *hostEnv) stream(mod api.Module, handle int32) (*openStream, bool) {
+	env, ok := e.module(mod)
+	if !ok {
+		return nil, false
+	}
+	return getHandle[*openStream](env.handles, handle)
 }
 
-func (s *streamStore) add(stream *openStream) int32 {
+// kvStore returns the key-value store of the calling module instance,
+// if the module may use storage.
+func (e *hostEnv) kvStore(mod api.Module, fn string) (*kvStore, bool) {
+	env, ok := e.module(mod)
+	if !ok || !env.perms.allowsStorage() {
+		e.log.Warn(fn+": storage not permitted", lctx.Str("module", mod.Name()))
+		return nil, false
+	}
+	return env.kv, true
+}
+
+// NewFunctionListener returns a listener tracking calls into the host,
+// which is how the watchdog sees a module yield.
+func (e *hostEnv) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return hostCallListener{env: e}
+}
+
+type hostCallListener struct {
+	env *hostEnv
+}
+
+func (l hostCallListener) Before(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if env, ok := l.env.module(mod); ok {
+		env.enterHost()
+	}
+}
+
+func (l hostCallListener) After(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ []uint64) {
+	if env, ok := l.env.module(mod); ok {
+		env.exitHost()
+	}
+}
+
+func (l hostCallListener) Abort(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ error) {
+	if env, ok := l.env.module(mod); ok {
+		env.exitHost()
+	}
+}
+
+// moduleEnv holds the host state of a single module instance.
+type moduleEnv struct {
+	name    string
+	perms   *Permissions
+	limits  Limits
+	client  *http.Client
+	handles *handleStore
+	streams *streamQuota
+	kv      *kvStore
+	secrets []string
+
+	inHost     atomic.Int32
+	lastActive atomic.Int64
+	violation  atomic.Pointer[error]
+	lastErr    atomic.Pointer[error]
+
+	log *logger.Logger
+}
+
+func newModuleEnv(desc Descriptor, dataPath string, log *logger.Logger) (*moduleEnv, error) {
+	perms := desc.Permissions
+
+	client, err := newHTTPClient(desc.HTTP, perms)
+	if err != nil {
+		return nil, fmt.Errorf("creating http client: %w", err)
+	}
+
+	var maxStreams int
+	if perms != nil {
+		maxStreams = perms.MaxStreams
+	}
+
+	env := &moduleEnv{
+		name:    desc.Name,
+		perms:   perms,
+		limits:  desc.Limits,
+		client:  client,
+		handles: newHandleStore(),
+		streams: newStreamQuota(maxStreams, desc.Limits.MaxResponseBytes),
+		kv:      newKVStore(dataPath, desc.Name, desc.Limits.MaxStorageBytes),
+		secrets: desc.Secrets,
+		log:     log,
+	}
+	env.lastActive.Store(time.Now().UnixNano())
+	return env, nil
+}
+
+// enterHost records the module calling into the host.
+func (e *moduleEnv) enterHost() {
+	e.inHost.Add(1)
+	e.lastActive.Store(time.Now().UnixNano())
+}
+
+// exitHost records the module returning from a host call.
+func (e *moduleEnv) exitHost() {
+	e.inHost.Add(-1)
+	e.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long the module has been running guest code
+// without calling into the host. A module waiting in the host is not idle.
+func (e *moduleEnv) idle(now time.Time) time.Duration {
+	if e.inHost.Load() > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, e.lastActive.Load()))
+}
+
+// exceed records that the module exceeded a resource limit, reporting
+// false if a violation was already recorded.
+func (e *moduleEnv) exceed(err error) bool {
+	if !e.violation.CompareAndSwap(nil, &err) {
+		return false
+	}
+
+	e.log.Error("Module exceeded resource limit, stopping module", lctx.Str("module", e.name), lctx.Err(err))
+	return true
+}
+
+// stop records the violation and stops the module instance.
+func (e *moduleEnv) stop(ctx context.Context, mod api.Module, err error) {
+	if !e.exceed(err) {
+		return
+	}
+	_ = mod.CloseWithExitCode(ctx, exitCodeLimitExceeded)
+}
+
+// err returns the resource limit violation of the module, if any.
+func (e *moduleEnv) err() error {
+	if err := e.violation.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// setLastError records the error of the last render call, clearing it
+// if the call succeeded.
+func (e *moduleEnv) setLastError(err error) {
+	if err == nil {
+		e.lastErr.Store(nil)
+		return
+	}
+	e.lastErr.Store(&err)
+}
+
+// close closes all open resources of the module.
+func (e *moduleEnv) close() {
+	e.handles.closeAll()
+	e.client.CloseIdleConnections()
+}
+
+// hostResource is a resource a module instance holds open through a handle.
+type hostResource interface {
+	close()
+}
+
+// handleStore holds the open resources of a module instance keyed by a
+// numeric handle. Handles are issued with a monotonically increasing counter
+// so they are unique for the lifetime of the module instance.
+type handleStore struct {
+	counter atomic.Int32
+
+	mu     sync.Mutex
+	values map[int32]hostResource
+}
+
+func newHandleStore() *handleStore {
+	return &handleStore{values: make(map[int32]hostResource)}
+}
+
+func (s *handleStore) add(r hostResource) int32 {
 	id := s.counter.Add(1)
 	s.mu.Lock()
-	s.streams[id] = stream
+	s.values[id] = r
 	s.mu.Unlock()
 	return id
 }
 
-func (s *streamStore) get(id int32) (*openStream, bool) {
+// closeAll removes and closes all resources.
+func (s *handleStore) closeAll() {
+	s.mu.Lock()
+	values := s.values
+	s.values = make(map[int32]hostResource)
+	s.mu.Unlock()
+
+	for _, r := range values {
+		r.close()
+	}
+}
+
+// getHandle returns the resource with the handle if it is a T.
+func getHandle[T hostResource](s *handleStore, id int32) (T, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	sc, ok := s.streams[id]
-	return sc, ok
+
+	r, ok := s.values[id].(T)
+	return r, ok
 }
 
-func (s *streamStore) remove(id int32) *openStream {
+// removeHandle removes the resource with the handle if it is a T.
+func removeHandle[T hostResource](s *handleStore, id int32) (T, bool) {
 	s.mu.Lock()
-	sc := s.streams[id]
-	delete(s.streams, id)
-	s.mu.Unlock()
-	return sc
+	defer s.mu.Unlock()
+
+	r, ok := s.values[id].(T)
+	if ok {
+		delete(s.values, id)
+	}
+	return r, ok
+}
+
+// streamQuota limits the open streams of a module instance.
+type streamQuota struct {
+	open       atomic.Int32
+	maxStreams int
+	maxBytes   int64
+}
+
+// newStreamQuota returns a quota allowing maxStreams open streams
+// of up to maxBytes each. Zero means no limit.
+func newStreamQuota(maxStreams int, maxBytes int64) *streamQuota {
+	return &streamQuota{
+		maxStreams: maxStreams,
+		maxBytes:   maxBytes,
+	}
 }
 
-// buildHostModule registers the looking-glass host functions into rt.
+// reserve reserves an open stream, reporting false when the
+// stream limit has been reached.
+func (q *streamQuota) reserve() bool {
+	n := q.open.Add(1)
+	if q.maxStreams > 0 && int(n) > q.maxStreams {
+		q.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release releases a stream reserved with reserve.
+func (q *streamQuota) release() {
+	q.open.Add(-1)
+}
+
+// openStream holds an in-flight HTTP response body.
+type openStream struct {
+	resp  *http.Response
+	read  int64
+	quota *streamQuota
+}
+
+// count records n bytes read from the stream, returning an error when the
+// stream exceeds the response size limit.
+func (s *openStream) count(n int) error {
+	s.read += int64(n)
+	if s.quota.maxBytes > 0 && s.read > s.quota.maxBytes {
+		return fmt.Errorf("response from %s exceeds %d bytes", s.resp.Request.URL.Redacted(), s.quota.maxBytes)
+	}
+	return nil
+}
+
+func (s *openStream) close() {
+	_ = s.resp.Body.Close()
+	s.quota.release()
+}
+
+// setHeaders sets the headers given as "Key: Value\n" lines.
+func setHeaders(h http.Header, b []byte) {
+	for line := range strings.SplitSeq(strings.TrimRight(string(b), "\n"), "\n") {
+		if k, v, found := strings.Cut(line, ": "); found {
+			h.Set(k, v)
+		}
+	}
+}
+
+// buildHostModule registers the host modules of the supported ABI
+// versions into rt. The "looking-glass" module implements
+// looking-glass/v1, and the "looking-glass/v2" module implements
+// looking-glass/v2. Both export the functions below, except where noted.
 //
 // render(ptr uint32, length uint32)
 //
 //	ptr and length describe a slice in the plugin's linear memory containing
 //	"moduleName\x00{widgetXML}". The host splits on the null byte, looks up
-//	the named module's WidgetPusher, and forwards the XML bytes to it.
+//	the calling module's WidgetPusher, and forwards the XML bytes to it.
+//	The module is identified by its instance, never by the payload; a
+//	payload naming another module is rejected.
+//
+// render(ptr uint32, length uint32) -> result (v2)
+//
+//	Renders as the v1 render, returning 0 on success. A payload that is
+//	malformed or names another module returns -1, a widget that cannot be
+//	decoded -7, a module without a container -4, and a failed update -2.
+//
+// last_error(buf_ptr, buf_len) -> n (v2)
+//
+//	Reads the error message of the last render call into buf_ptr and
+//	returns its length, or 0 if the call succeeded. As with kv_get, nothing
+//	is written if the message is longer than buf_len.
 //
 // http_stream_open(method_ptr, method_len, url_ptr, url_len, hdr_ptr, hdr_len, body_ptr, body_len) -> handle
 //
@@ -72,11 +424,25 @@ func (s *streamStore) remove(id int32) *openStream {
 //	hdr_ptr points to newline-separated "Key: Value\n" header lines (hdr_len=0
 //	for no headers). body_ptr/body_len describe a request body (0/0 for none).
 //	Returns a non-negative handle on success, or a negative errno on failure.
+//	Requests not granted by the module's permissions return -3.
 //
 // http_stream_status(handle) -> status_code
 //
 //	Returns the HTTP status code for the response identified by handle.
 //
+// http_stream_header(handle, name_ptr, name_len, buf_ptr, buf_len) -> n
+//
+//	Reads the values of the response header name, joined by ", ", into
+//	buf_ptr and returns their length, or -4 if the response has no such
+//	header. If the values are longer than buf_len nothing is written and
+//	their length is returned.
+//
+// http_stream_headers(handle, buf_ptr, buf_len) -> n
+//
+//	Reads all response headers into buf_ptr as "Key: Value\n" lines, sorted
+//	by key, and returns their length. As with http_stream_header, nothing
+//	is written if they are longer than buf_len.
+//
 // http_stream_read(handle, buf_ptr, buf_len) -> n
 //
 //	Reads up to buf_len bytes from the response body into buf_ptr.
@@ -87,20 +453,158 @@ func (s *streamStore) remove(id int32) *openStream {
 // http_stream_close(handle)
 //
 //	Closes the response body and releases the handle.
-func buildHostModule(ctx context.Context, rt wazero.Runtime, ui UIProvider, log *logger.Logger) error {
-	store := newStreamStore()
-
-	_, err := rt.NewHostModuleBuilder("looking-glass").
+//
+// kv_get(key_ptr, key_len, buf_ptr, buf_len) -> n
+//
+//	Reads the value of key into buf_ptr and returns its length, or -4 if
+//	the key does not exist. If the value is longer than buf_len nothing is
+//	written and its length is returned.
+//
+// kv_set(key_ptr, key_len, val_ptr, val_len) -> result
+//
+//	Sets the value of key, returning 0 on success. Keys are at most 256
+//	bytes and may not contain newlines. Returns -5 when the module's
+//	storage quota would be exceeded.
+//
+// kv_delete(key_ptr, key_len) -> result
+//
+//	Deletes key, returning 0 on success.
+//
+// kv_list(prefix_ptr, prefix_len, buf_ptr, buf_len) -> n
+//
+//	Reads the keys starting with prefix into buf_ptr as newline-terminated
+//	lines, in order, and returns their length. As with kv_get, nothing is
+//	written if they are longer than buf_len.
+//
+// The key-value store is namespaced per module and persisted in the data
+// directory, so values survive restarts.
+//
+// bus_publish(topic_ptr, topic_len, msg_ptr, msg_len) -> result
+//
+//	Publishes a message of at most 1MiB to topic, returning 0 on success.
+//	The message is retained as the last message of the topic.
+//
+// bus_subscribe(topic_ptr, topic_len) -> handle
+//
+//	Subscribes to topic and returns a handle for reading its messages.
+//	The retained message of the topic, if any, is the first message.
+//
+// bus_next(handle, buf_ptr, buf_len) -> n
+//
+//	Reads the next message into buf_ptr and returns its length. Blocks
+//	until a message is published or the module context is cancelled. If
+//	the message is longer than buf_len nothing is written, its length is
+//	returned and the message is returned again by the next call.
+//
+// bus_close(handle)
+//
+//	Closes the subscription and releases the handle.
+//
+// Topics a module may publish and subscribe to are given by its permissions.
+//
+// ws_open(url_ptr, url_len, hdr_ptr, hdr_len) -> handle
+//
+//	Opens a WebSocket connection to a ws or wss URL, with the same header
+//	format as http_stream_open. The connection is checked against the
+//	module's HTTP permissions as a GET request and counts as an open stream.
+//
+// ws_send(handle, type, msg_ptr, msg_len) -> result
+//
+//	Sends a text (1) or binary (2) message, returning 0 on success or -6 if
+//	the connection is closed.
+//
+// ws_recv(handle, buf_ptr, buf_len) -> n
+//
+//	Reads the next message of at most 1MiB into buf_ptr and returns its
+//	length, or -6 once the connection is closed. Blocks until a message is
+//	received or the module context is cancelled. As with bus_next, a
+//	message longer than buf_len is returned again by the next call.
+//
+// ws_close_code(handle) -> code
+//
+//	Returns the close code of the connection, or 0 while it is open. A
+//	connection lost without a close frame has the code 1006.
+//
+// ws_close(handle, code)
+//
+//	Closes the connection with code, or 1000 if code is 0, and releases
+//	the handle.
+//
+// mqtt_connect(name_ptr, name_len) -> handle
+//
+//	Connects to the named broker from the mqtt configuration and returns a
+//	handle for it, or -4 if there is no such broker. Connections are shared
+//	by all modules, one per broker.
+//
+// mqtt_subscribe(handle, filter_ptr, filter_len) -> handle
+//
+//	Subscribes to a topic filter on the broker of a connection handle and
+//	returns a handle for reading its messages.
+//
+// mqtt_recv(handle, buf_ptr, buf_len) -> n
+//
+//	Reads the next message into buf_ptr as its topic and payload separated
+//	by a null byte, and returns its length. Blocks until a message is
+//	received or the module context is cancelled. As with bus_next, a
+//	message longer than buf_len is returned again by the next call.
+//
+// mqtt_publish(handle, topic_ptr, topic_len, msg_ptr, msg_len, qos, retain) -> result
+//
+//	Publishes a message to topic with QoS 0, 1 or 2, retained by the
+//	broker if retain is not 0. Returns 0 once the broker has accepted it.
+//
+// mqtt_close(handle)
+//
+//	Closes a connection or subscription handle. The broker is disconnected
+//	once no module uses it.
+//
+// secret_get(name_ptr, name_len, buf_ptr, buf_len) -> n
+//
+//	Reads the value of the named secret into buf_ptr and returns its length,
+//	or -3 if the secret is not granted to the module and -4 if there is no
+//	such secret. As with kv_get, nothing is written if the value is longer
+//	than buf_len.
+//
+// Handles are scoped to the module instance that opened them, and are
+// closed when the instance closes.
+func buildHostModule(ctx context.Context, rt wazero.Runtime, env *hostEnv) error {
+	v1 := rt.NewHostModuleBuilder(hostModuleV1).
 		NewFunctionBuilder().
 		WithGoModuleFunction(
-			renderFunc(ui, log),
+			renderFunc(env.ui, env.log),
 			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
 			[]api.ValueType{},
 		).
+		Export("render")
+	if _, err := exportHostFuncs(v1, env).Instantiate(ctx); err != nil {
+		return err
+	}
+
+	v2 := rt.NewHostModuleBuilder(hostModuleV2).
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			renderV2Func(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
 		Export("render").
 		NewFunctionBuilder().
 		WithGoModuleFunction(
-			httpStreamOpenFunc(store, log),
+			lastErrorFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("last_error")
+	_, err := exportHostFuncs(v2, env).Instantiate(ctx)
+	return err
+}
+
+// exportHostFuncs exports the host functions shared by all ABI versions.
+func exportHostFuncs(b wazero.HostModuleBuilder, env *hostEnv) wazero.HostModuleBuilder {
+	return b.
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			httpStreamOpenFunc(env),
 			[]api.ValueType{
 				api.ValueTypeI32, api.ValueTypeI32, // method
 				api.ValueTypeI32, api.ValueTypeI32, // url
@@ -113,75 +617,278 @@ func buildHostModule(ctx context.Context, rt wazero.Runtime, ui UIProvider, log
 		NewFunctionBuilder().
 		WithGoModuleFunction(
 			// http_stream_status: returns the HTTP status code for a handle.
-			httpStreamStatusFunc(store),
+			httpStreamStatusFunc(env),
 			[]api.ValueType{api.ValueTypeI32},
 			[]api.ValueType{api.ValueTypeI32},
 		).
 		Export("http_stream_status").
 		NewFunctionBuilder().
 		WithGoModuleFunction(
-			httpStreamReadFunc(store),
+			httpStreamHeaderFunc(env),
+			[]api.ValueType{
+				api.ValueTypeI32,                   // handle
+				api.ValueTypeI32, api.ValueTypeI32, // name
+				api.ValueTypeI32, api.ValueTypeI32, // buffer
+			},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("http_stream_header").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			httpStreamHeadersFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("http_stream_headers").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			httpStreamReadFunc(env),
 			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
 			[]api.ValueType{api.ValueTypeI32},
 		).
 		Export("http_stream_read").
 		NewFunctionBuilder().
 		WithGoModuleFunction(
-			httpStreamCloseFunc(store),
+			httpStreamCloseFunc(env),
 			[]api.ValueType{api.ValueTypeI32},
 			[]api.ValueType{},
 		).
 		Export("http_stream_close").
-		Instantiate(ctx)
-	return err
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			kvGetFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("kv_get").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			kvSetFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("kv_set").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			kvDeleteFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("kv_delete").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			kvListFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("kv_list").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			busPublishFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("bus_publish").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			busSubscribeFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("bus_subscribe").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			busNextFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("bus_next").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			busCloseFunc(env),
+			[]api.ValueType{api.ValueTypeI32},
+			[]api.ValueType{},
+		).
+		Export("bus_close").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			wsOpenFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("ws_open").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			wsSendFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("ws_send").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			wsRecvFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("ws_recv").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			wsCloseCodeFunc(env),
+			[]api.ValueType{api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("ws_close_code").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			wsCloseFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{},
+		).
+		Export("ws_close").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			mqttConnectFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("mqtt_connect").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			mqttSubscribeFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("mqtt_subscribe").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			mqttRecvFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("mqtt_recv").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			mqttPublishFunc(env),
+			[]api.ValueType{
+				api.ValueTypeI32,                   // handle
+				api.ValueTypeI32, api.ValueTypeI32, // topic
+				api.ValueTypeI32, api.ValueTypeI32, // message
+				api.ValueTypeI32, api.ValueTypeI32, // qos, retain
+			},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("mqtt_publish").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			mqttCloseFunc(env),
+			[]api.ValueType{api.ValueTypeI32},
+			[]api.ValueType{},
+		).
+		Export("mqtt_close").
+		NewFunctionBuilder().
+		WithGoModuleFunction(
+			secretGetFunc(env),
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI32},
+		).
+		Export("secret_get")
 }
 
 func renderFunc(ui UIProvider, log *logger.Logger) api.GoModuleFunc {
 	return func(_ context.Context, mod api.Module, stack []uint64) {
-		ptr := uint32(stack[0])
-		length := uint32(stack[1])
+		_, _ = render(ui, log, mod, uint32(stack[0]), uint32(stack[1]))
+	}
+}
 
-		data, ok := mod.Memory().Read(ptr, length)
-		if !ok {
-			log.Error("render: out-of-bounds memory read")
-			return
+// renderV2Func renders as renderFunc, returning an error number to the
+// plugin and keeping the error to be read with last_error.
+func renderV2Func(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		n, err := render(env.ui, env.log, mod, uint32(stack[0]), uint32(stack[1]))
+		if menv, ok := env.module(mod); ok {
+			menv.setLastError(err)
 		}
+		stack[0] = errno(n)
+	}
+}
 
-		before, after, ok := bytes.Cut(data, []byte{0})
+// lastErrorFunc reads the error of the last render call of the module.
+func lastErrorFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		bufPtr := uint32(stack[0])
+		bufLen := uint32(stack[1])
+
+		menv, ok := env.module(mod)
 		if !ok {
-			log.Error("render: missing null separator in payload")
+			stack[0] = errno(errnoInvalid)
 			return
 		}
+		err := menv.lastErr.Load()
+		if err == nil {
+			stack[0] = 0
+			return
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, []byte((*err).Error()))
+	}
+}
 
-		name := string(before)
-		widgetXML := after
+// render decodes the widget in the payload at ptr and pushes it to the
+// container of the calling module. It returns the error number and error
+// of a failed render.
+func render(ui UIProvider, log *logger.Logger, mod api.Module, ptr, length uint32) (int32, error) {
+	data, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		log.Error("render: out-of-bounds memory read")
+		return errnoInvalid, errors.New("out-of-bounds memory read")
+	}
 
-		log.Trace("render: widget received", lctx.Str("module", name), lctx.Int("bytes", len(widgetXML)))
+	name := mod.Name()
 
-		w, err := client.DecodeWidget(widgetXML)
-		if err != nil {
-			log.Error("render: could not decode widget", lctx.Str("module", name), lctx.Err(err))
-			return
-		}
+	before, widgetXML, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		log.Error("render: missing null separator in payload", lctx.Str("module", name))
+		return errnoInvalid, errors.New("missing null separator in payload")
+	}
+	if string(before) != name {
+		log.Error("render: payload names another module",
+			lctx.Str("module", name), lctx.Str("payload", string(before)))
+		return errnoInvalid, fmt.Errorf("payload names another module %q", before)
+	}
 
-		pusher := ui.ModuleUI(name)
-		if pusher == nil {
-			log.Error("render: module not registered", lctx.Str("module", name))
-			return
-		}
+	return renderWidget(ui, log, name, widgetXML)
+}
 
-		if err = pusher.Update(w); err != nil {
-			log.Error("render: could not update widget", lctx.Str("module", name), lctx.Err(err))
-			return
-		}
+// renderWidget decodes widgetXML and pushes it to the container of the
+// named module.
+func renderWidget(ui UIProvider, log *logger.Logger, name string, widgetXML []byte) (int32, error) {
+	log.Trace("render: widget received", lctx.Str("module", name), lctx.Int("bytes", len(widgetXML)))
+
+	w, err := client.DecodeWidget(widgetXML)
+	if err != nil {
+		log.Error("render: could not decode widget", lctx.Str("module", name), lctx.Err(err))
+		return errnoDecode, fmt.Errorf("could not decode widget: %w", err)
+	}
 
-		log.Trace("render: widget pushed to render node", lctx.Str("module", name))
+	pusher := ui.ModuleUI(name)
+	if pusher == nil {
+		log.Error("render: module not registered", lctx.Str("module", name))
+		return errnoNotFound, errors.New("module not registered")
 	}
+
+	if err = pusher.Update(w); err != nil {
+		log.Error("render: could not update widget", lctx.Str("module", name), lctx.Err(err))
+		return errnoIO, fmt.Errorf("could not update widget: %w", err)
+	}
+
+	log.Trace("render: widget pushed to render node", lctx.Str("module", name))
+	return 0, nil
 }
 
 // httpStreamOpenFunc opens an HTTP request, blocks until response headers
 // are received, and returns a handle for streaming the body.
-func httpStreamOpenFunc(store *streamStore, log *logger.Logger) api.GoModuleFunc {
+func httpStreamOpenFunc(env *hostEnv) api.GoModuleFunc {
+	log := env.log
+
 	return func(ctx context.Context, mod api.Module, stack []uint64) {
 		methodPtr := uint32(stack[0])
 		methodLen := uint32(stack[1])
@@ -194,13 +901,13 @@ func httpStreamOpenFunc(store *streamStore, log *logger.Logger) api.GoModuleFunc
 
 		methodBytes, ok := mod.Memory().Read(methodPtr, methodLen)
 		if !ok {
-			stack[0] = 0xFFFFFFFF // i32(-1): invalid argument
+			stack[0] = errno(errnoInvalid)
 			return
 		}
 
 		urlBytes, ok := mod.Memory().Read(urlPtr, urlLen)
 		if !ok {
-			stack[0] = 0xFFFFFFFF
+			stack[0] = errno(errnoInvalid)
 			return
 		}
 
@@ -209,7 +916,7 @@ func httpStreamOpenFunc(store *streamStore, log *logger.Logger) api.GoModuleFunc
 		if bodyLen > 0 {
 			bodyBytes, ok := mod.Memory().Read(bodyPtr, bodyLen)
 			if !ok {
-				stack[0] = 0xFFFFFFFF
+				stack[0] = errno(errnoInvalid)
 				return
 			}
 			bodyReader = bytes.NewReader(bodyBytes)
@@ -219,7 +926,7 @@ func httpStreamOpenFunc(store *streamStore, log *logger.Logger) api.GoModuleFunc
 		if err != nil {
 			log.Error("http_stream_open: building request failed",
 				lctx.Str("url", string(urlBytes)), lctx.Err(err))
-			stack[0] = 0xFFFFFFFF
+			stack[0] = errno(errnoInvalid)
 			return
 		}
 
@@ -227,34 +934,50 @@ func httpStreamOpenFunc(store *streamStore, log *logger.Logger) api.GoModuleFunc
 		if hdrLen > 0 {
 			hdrBytes, ok := mod.Memory().Read(hdrPtr, hdrLen)
 			if !ok {
-				stack[0] = 0xFFFFFFFF
+				stack[0] = errno(errnoInvalid)
 				return
 			}
-			for line := range strings.SplitSeq(strings.TrimRight(string(hdrBytes), "\n"), "\n") {
-				if k, v, found := strings.Cut(line, ": "); found {
-					req.Header.Set(k, v)
-				}
-			}
+			setHeaders(req.Header, hdrBytes)
+		}
+
+		menv, ok := env.module(mod)
+		if !ok || !menv.perms.allowsRequest(req.Method, req.URL) {
+			log.Warn("http_stream_open: request not permitted",
+				lctx.Str("module", mod.Name()), lctx.Str("method", req.Method), lctx.Str("url", req.URL.Redacted()))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		if !menv.streams.reserve() {
+			log.Warn("http_stream_open: too many open streams",
+				lctx.Str("module", mod.Name()), lctx.Str("url", req.URL.Redacted()))
+			stack[0] = errno(errnoQuota)
+			return
 		}
 
 		//nolint:bodyclose // Closed in `http_stream_close`.
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := menv.client.Do(req)
 		if err != nil {
+			menv.streams.release()
+
+			if urlErr, ok := errors.AsType[*url.Error](err); ok {
+				urlErr.URL = req.URL.Redacted()
+			}
+
 			log.Error("http_stream_open: request failed",
-				lctx.Str("url", string(urlBytes)), lctx.Err(err))
-			stack[0] = 0xFFFFFFFE // i32(-2): I/O error
+				lctx.Str("module", mod.Name()), lctx.Str("url", req.URL.Redacted()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
 			return
 		}
 
-		handle := store.add(&openStream{resp: resp})
+		handle := menv.handles.add(&openStream{resp: resp, quota: menv.streams})
 		stack[0] = uint64(handle)
 	}
 }
 
-func httpStreamStatusFunc(store *streamStore) api.GoModuleFunc {
-	return func(_ context.Context, _ api.Module, stack []uint64) {
+func httpStreamStatusFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
 		handle := int32(stack[0])
-		stream, ok := store.get(handle)
+		stream, ok := env.stream(mod, handle)
 		if !ok {
 			stack[0] = 0
 			return
@@ -263,23 +986,81 @@ func httpStreamStatusFunc(store *streamStore) api.GoModuleFunc {
 	}
 }
 
+// httpStreamHeaderFunc reads the values of a response header into the
+// plugin buffer.
+func httpStreamHeaderFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		namePtr := uint32(stack[1])
+		nameLen := uint32(stack[2])
+		bufPtr := uint32(stack[3])
+		bufLen := uint32(stack[4])
+
+		name, ok := mod.Memory().Read(namePtr, nameLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		stream, ok := env.stream(mod, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		vals := stream.resp.Header.Values(string(name))
+		if len(vals) == 0 {
+			stack[0] = errno(errnoNotFound)
+			return
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, []byte(strings.Join(vals, ", ")))
+	}
+}
+
+// httpStreamHeadersFunc reads all response headers into the plugin buffer.
+func httpStreamHeadersFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		bufPtr := uint32(stack[1])
+		bufLen := uint32(stack[2])
+
+		stream, ok := env.stream(mod, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		var buf bytes.Buffer
+		for _, k := range slices.Sorted(maps.Keys(stream.resp.Header)) {
+			for _, v := range stream.resp.Header[k] {
+				buf.WriteString(k + ": " + v + "\n")
+			}
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, buf.Bytes())
+	}
+}
+
 // httpStreamReadFunc reads up to buf_len bytes from the response body.
 // Blocks until data arrives. Returns bytes read, 0 on EOF, or negative on error.
-func httpStreamReadFunc(store *streamStore) api.GoModuleFunc {
+func httpStreamReadFunc(env *hostEnv) api.GoModuleFunc {
 	return func(ctx context.Context, mod api.Module, stack []uint64) {
 		handle := int32(stack[0])
 		bufPtr := uint32(stack[1])
 		bufLen := uint32(stack[2])
 
-		stream, ok := store.get(handle)
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		stream, ok := getHandle[*openStream](menv.handles, handle)
 		if !ok {
-			stack[0] = 0xFFFFFFFF // i32(-1): bad handle
+			stack[0] = errno(errnoInvalid)
 			return
 		}
 
 		buf, ok := mod.Memory().Read(bufPtr, bufLen)
 		if !ok {
-			stack[0] = 0xFFFFFFFF
+			stack[0] = errno(errnoInvalid)
 			return
 		}
 
@@ -290,6 +1071,11 @@ func httpStreamReadFunc(store *streamStore) api.GoModuleFunc {
 			// (including io.EOF) in the same call; discarding n here would
 			// truncate the response and cause "unexpected EOF" in decoders.
 			if n > 0 {
+				if err = stream.count(n); err != nil {
+					menv.stop(ctx, mod, err)
+					stack[0] = errno(errnoIO)
+					return
+				}
 				stack[0] = uint64(int32(n))
 				return
 			}
@@ -298,7 +1084,7 @@ func httpStreamReadFunc(store *streamStore) api.GoModuleFunc {
 				return
 			}
 			if err != nil {
-				stack[0] = 0xFFFFFFFE // i32(-2): I/O error
+				stack[0] = errno(errnoIO)
 				return
 			}
 			// n == 0, err == nil: the underlying reader has no data ready yet
@@ -306,7 +1092,7 @@ func httpStreamReadFunc(store *streamStore) api.GoModuleFunc {
 			// bufio boundary). Retry until bytes or EOF arrive.
 			select {
 			case <-ctx.Done():
-				stack[0] = 0xFFFFFFFE
+				stack[0] = errno(errnoIO)
 				return
 			default:
 			}
@@ -317,12 +1103,15 @@ func httpStreamReadFunc(store *streamStore) api.GoModuleFunc {
 // httpStreamCloseFunc closes the response body and releases the handle.
 // Does not drain first: draining an SSE stream that never sends EOF
 // would block indefinitely. Closing directly aborts the connection.
-func httpStreamCloseFunc(store *streamStore) api.GoModuleFunc {
-	return func(_ context.Context, _ api.Module, stack []uint64) {
+func httpStreamCloseFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
 		handle := int32(stack[0])
-		stream := store.remove(handle)
-		if stream != nil {
-			_ = stream.resp.Body.Close()
+		menv, ok := env.module(mod)
+		if !ok {
+			return
+		}
+		if stream, ok := removeHandle[*openStream](menv.handles, handle); ok {
+			stream.close()
 		}
 	}
 }
@@ -0,0 +1,565 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/glasslabs/client-go"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestHTTPStreamOpen(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	host := mustParseURL(t, srv.URL).Host
+
+	tests := []struct {
+		name     string
+		perms    *Permissions
+		register bool
+		method   string
+		opens    int
+		want     int32
+		wantLog  string
+	}{
+		{
+			name:     "allows all requests without permissions",
+			register: true,
+			method:   http.MethodGet,
+			opens:    1,
+			want:     1,
+		},
+		{
+			name:     "allows granted host",
+			perms:    &Permissions{HTTP: HTTPPermissions{Hosts: []string{host}}},
+			register: true,
+			method:   http.MethodGet,
+			opens:    1,
+			want:     1,
+		},
+		{
+			name:     "denies host that is not granted",
+			perms:    &Permissions{HTTP: HTTPPermissions{Hosts: []string{"example.com"}}},
+			register: true,
+			method:   http.MethodGet,
+			opens:    1,
+			want:     errnoPermission,
+			wantLog:  `lvl=warn msg="http_stream_open: request not permitted" module=test method=GET url=` + srv.URL + "/test",
+		},
+		{
+			name:     "denies method that is not granted",
+			perms:    &Permissions{HTTP: HTTPPermissions{Hosts: []string{host}, Methods: []string{http.MethodGet}}},
+			register: true,
+			method:   http.MethodPost,
+			opens:    1,
+			want:     errnoPermission,
+		},
+		{
+			name:     "denies streams over the limit",
+			perms:    &Permissions{HTTP: HTTPPermissions{Hosts: []string{host}}, MaxStreams: 1},
+			register: true,
+			method:   http.MethodGet,
+			opens:    2,
+			want:     errnoQuota,
+			wantLog:  `msg="http_stream_open: too many open streams" module=test`,
+		},
+		{
+			name:   "denies unregistered module",
+			method: http.MethodGet,
+			opens:  1,
+			want:   errnoPermission,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+			env := newHostEnv(noopUI{}, "", log)
+			if test.register {
+				menv := mustRegister(t, env, Descriptor{Name: "test", Permissions: test.perms})
+				t.Cleanup(func() { env.unregister(menv) })
+			}
+			mod := newMemModule("test")
+			fn := httpStreamOpenFunc(env)
+
+			var got int32
+			for range test.opens {
+				stack := mod.request(test.method, srv.URL+"/test")
+				fn(t.Context(), mod, stack)
+				got = int32(stack[0])
+			}
+
+			assert.Equal(t, test.want, got)
+			if test.wantLog != "" {
+				assert.Contains(t, buf.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestHTTPStreamOpen_RedactsFailedRequest(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	uri := "http://user:s3cret@" + mustParseURL(t, srv.URL).Host + "/test"
+	srv.Close()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.request(http.MethodGet, uri)
+	httpStreamOpenFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoIO, int32(stack[0]))
+	assert.Contains(t, buf.String(), `msg="http_stream_open: request failed" module=test url=http://user:xxxxx@`)
+	assert.NotContains(t, buf.String(), "s3cret")
+}
+
+func TestHTTPStreamClose_ReleasesStream(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{
+		Name:        "test",
+		Permissions: &Permissions{HTTP: HTTPPermissions{Hosts: []string{mustParseURL(t, srv.URL).Host}}, MaxStreams: 1},
+	})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+	open := httpStreamOpenFunc(env)
+	closeFn := httpStreamCloseFunc(env)
+
+	stack := mod.request(http.MethodGet, srv.URL)
+	open(t.Context(), mod, stack)
+	require.Positive(t, int32(stack[0]))
+
+	closeFn(t.Context(), mod, []uint64{stack[0]})
+
+	stack = mod.request(http.MethodGet, srv.URL)
+	open(t.Context(), mod, stack)
+	assert.Positive(t, int32(stack[0]))
+}
+
+func TestHTTPStreamRead_StopsModuleExceedingMaxResponseBytes(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("0123456789"))
+	}))
+	t.Cleanup(srv.Close)
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test", Limits: Limits{MaxResponseBytes: 4}})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.request(http.MethodGet, srv.URL)
+	httpStreamOpenFunc(env)(t.Context(), mod, stack)
+	require.Positive(t, int32(stack[0]))
+
+	stack = []uint64{stack[0], 512, 8}
+	httpStreamReadFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoIO, int32(stack[0]))
+	assert.Equal(t, uint32(exitCodeLimitExceeded), mod.exitCode)
+	assert.EqualError(t, menv.err(), "response from "+srv.URL+" exceeds 4 bytes")
+	assert.Contains(t, buf.String(), `msg="Module exceeded resource limit, stopping module" module=test`)
+}
+
+func TestHTTPStreamStatus_ScopesHandlesToModule(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	testEnv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(testEnv) })
+	otherEnv := mustRegister(t, env, Descriptor{Name: "other"})
+	t.Cleanup(func() { env.unregister(otherEnv) })
+	mod := newMemModule("test")
+	other := newMemModule("other")
+	status := httpStreamStatusFunc(env)
+
+	stack := mod.request(http.MethodGet, srv.URL)
+	httpStreamOpenFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = []uint64{handle}
+	status(t.Context(), other, stack)
+	assert.Equal(t, uint64(0), stack[0])
+
+	stack = []uint64{handle}
+	status(t.Context(), mod, stack)
+	assert.Equal(t, uint64(http.StatusTeapot), stack[0])
+}
+
+func TestHTTPStreamHeader(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Add("X-Rate-Limit", "10")
+		rw.Header().Add("X-Rate-Limit", "60")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.request(http.MethodGet, srv.URL)
+	httpStreamOpenFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = append([]uint64{handle}, mod.call("x-rate-limit", 32)...)
+	httpStreamHeaderFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(6), stack[0])
+	assert.Equal(t, "10, 60", mod.result(stack[0]))
+
+	stack = append([]uint64{handle}, mod.call("ETag", 32)...)
+	httpStreamHeaderFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoNotFound, int32(stack[0]))
+
+	stack = append([]uint64{handle}, mod.call(256)...)
+	httpStreamHeadersFunc(env)(t.Context(), mod, stack)
+	got := mod.result(stack[0])
+	assert.Contains(t, got, "Content-Type: application/json\n")
+	assert.Contains(t, got, "X-Rate-Limit: 10\nX-Rate-Limit: 60\n")
+	assert.Less(t, strings.Index(got, "Content-Type"), strings.Index(got, "X-Rate-Limit"))
+}
+
+func TestHostEnv_UnregisterClosesStreams(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		<-t.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	mod := newMemModule("test")
+
+	stack := mod.request(http.MethodGet, srv.URL)
+	httpStreamOpenFunc(env)(t.Context(), mod, stack)
+	handle := int32(stack[0])
+	require.Positive(t, handle)
+	stream, ok := getHandle[*openStream](menv.handles, handle)
+	require.True(t, ok)
+
+	env.unregister(menv)
+
+	_, ok = env.module(mod)
+	assert.False(t, ok)
+	_, ok = getHandle[*openStream](menv.handles, handle)
+	assert.False(t, ok)
+	_, err := stream.resp.Body.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), menv.streams.open.Load())
+}
+
+func TestHostEnv_UnregisterKeepsNewerInstance(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	old := mustRegister(t, env, Descriptor{Name: "test"})
+	newer := mustRegister(t, env, Descriptor{Name: "test"})
+
+	env.unregister(old)
+
+	got, ok := env.module(newMemModule("test"))
+	require.True(t, ok)
+	assert.Same(t, newer, got)
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		payload    string
+		wantUpdate bool
+		wantLog    string
+	}{
+		{
+			name:       "renders widget of calling module",
+			payload:    "test\x00<text>hello</text>",
+			wantUpdate: true,
+		},
+		{
+			name:    "rejects payload naming another module",
+			payload: "other\x00<text>hello</text>",
+			wantLog: `msg="render: payload names another module" module=test payload=other`,
+		},
+		{
+			name:    "rejects payload without separator",
+			payload: "<text>hello</text>",
+			wantLog: `msg="render: missing null separator in payload" module=test`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+			updater := &recordingUpdater{}
+			ui := recordingUI{"test": updater, "other": &recordingUpdater{}}
+			mod := newMemModule("test")
+			copy(mod.mem.buf, test.payload)
+
+			renderFunc(ui, log)(t.Context(), mod, []uint64{0, uint64(len(test.payload))})
+
+			assert.Equal(t, test.wantUpdate, updater.updated)
+			if test.wantLog != "" {
+				assert.Contains(t, buf.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestRenderV2(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		module     string
+		payload    string
+		want       int32
+		wantUpdate bool
+		wantErr    string
+	}{
+		{
+			name:       "renders widget of calling module",
+			module:     "test",
+			payload:    "test\x00<text>hello</text>",
+			want:       0,
+			wantUpdate: true,
+		},
+		{
+			name:    "returns invalid for payload naming another module",
+			module:  "test",
+			payload: "other\x00<text>hello</text>",
+			want:    errnoInvalid,
+			wantErr: `payload names another module "other"`,
+		},
+		{
+			name:    "returns decode error for invalid widget",
+			module:  "test",
+			payload: "test\x00<text>hello",
+			want:    errnoDecode,
+			wantErr: "could not decode widget",
+		},
+		{
+			name:    "returns not found for module without container",
+			module:  "missing",
+			payload: "missing\x00<text>hello</text>",
+			want:    errnoNotFound,
+			wantErr: "module not registered",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+			updater := &recordingUpdater{}
+			env := newHostEnv(recordingUI{"test": updater}, "", log)
+			mustRegister(t, env, Descriptor{Name: test.module})
+			mod := newMemModule(test.module)
+
+			stack := mod.call(test.payload)
+			renderV2Func(env)(t.Context(), mod, stack)
+
+			assert.Equal(t, errno(test.want), stack[0])
+			assert.Equal(t, test.wantUpdate, updater.updated)
+
+			stack = mod.call(256)
+			lastErrorFunc(env)(t.Context(), mod, stack)
+
+			if test.wantErr == "" {
+				assert.Equal(t, uint64(0), stack[0])
+				return
+			}
+			assert.Contains(t, mod.result(stack[0]), test.wantErr)
+		})
+	}
+}
+
+func TestRenderV2_ClearsLastError(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(recordingUI{"test": &recordingUpdater{}}, "", log)
+	mustRegister(t, env, Descriptor{Name: "test"})
+	mod := newMemModule("test")
+
+	renderV2Func(env)(t.Context(), mod, mod.call("test\x00<text>"))
+	renderV2Func(env)(t.Context(), mod, mod.call("test\x00<text>hello</text>"))
+
+	stack := mod.call(256)
+	lastErrorFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, uint64(0), stack[0])
+}
+
+type recordingUI map[string]*recordingUpdater
+
+func (recordingUI) CreateModule(_, _, _ string) {}
+func (recordingUI) RemoveModule(_ string)       {}
+func (recordingUI) MoveModule(_, _, _ string)   {}
+func (u recordingUI) ModuleUI(name string) WidgetUpdater {
+	if w, ok := u[name]; ok {
+		return w
+	}
+	return nil
+}
+
+type recordingUpdater struct {
+	updated bool
+}
+
+func (u *recordingUpdater) Update(client.Widget) error {
+	u.updated = true
+	return nil
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
+
+// mustRegister registers the environment of the module described by desc.
+func mustRegister(t *testing.T, env *hostEnv, desc Descriptor) *moduleEnv {
+	t.Helper()
+
+	menv, err := env.register(desc)
+	require.NoError(t, err)
+	return menv
+}
+
+// memModule is a module with a linear memory, for calling host functions.
+type memModule struct {
+	api.Module // nil embedding; panics on any unexpected method call
+
+	name     string
+	mem      *stubMemory
+	exitCode uint32
+}
+
+func newMemModule(name string) *memModule {
+	return &memModule{name: name, mem: &stubMemory{buf: make([]byte, 1024)}}
+}
+
+func (m *memModule) Name() string       { return m.name }
+func (m *memModule) Memory() api.Memory { return m.mem }
+
+func (m *memModule) CloseWithExitCode(_ context.Context, exitCode uint32) error {
+	m.exitCode = exitCode
+	return nil
+}
+
+// request writes the method and url into memory and returns the
+// http_stream_open call stack for them.
+func (m *memModule) request(method, uri string) []uint64 {
+	copy(m.mem.buf, method)
+	copy(m.mem.buf[16:], uri)
+	return []uint64{0, uint64(len(method)), 16, uint64(len(uri)), 0, 0, 0, 0}
+}
+
+// call writes the string arguments into memory and returns the call
+// stack for them, a pointer and length for each string. An int argument
+// is the length of a result buffer.
+func (m *memModule) call(args ...any) []uint64 {
+	var (
+		stack []uint64
+		off   uint32
+	)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			copy(m.mem.buf[off:], v)
+			stack = append(stack, uint64(off), uint64(len(v)))
+			off += uint32(len(v))
+		case int:
+			stack = append(stack, uint64(resultOffset), uint64(v))
+		}
+	}
+	return stack
+}
+
+// result returns the n bytes written to the result buffer.
+func (m *memModule) result(n uint64) string {
+	return string(m.mem.buf[resultOffset : resultOffset+n])
+}
+
+// resultOffset is the memory offset of result buffers.
+const resultOffset = 512
+
+type stubMemory struct {
+	api.Memory // nil embedding; panics on any unexpected method call
+
+	buf []byte
+}
+
+func (m *stubMemory) Read(offset, byteCount uint32) ([]byte, bool) {
+	if uint64(offset)+uint64(byteCount) > uint64(len(m.buf)) {
+		return nil, false
+	}
+	return m.buf[offset : offset+byteCount], true
+}
+
+func (m *stubMemory) Write(offset uint32, v []byte) bool {
+	if uint64(offset)+uint64(len(v)) > uint64(len(m.buf)) {
+		return false
+	}
+	copy(m.buf[offset:], v)
+	return true
+}
@@ -0,0 +1,463 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheHeader is the response header set on responses served through the
+// HTTP cache. Its value is one of "hit", "miss", "revalidated" or "stale".
+// A stale response is served when the origin could not be reached.
+const cacheHeader = "X-Glass-Cache"
+
+// Cache header values.
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheStale       = "stale"
+)
+
+const (
+	defaultMaxStale = 24 * time.Hour
+
+	// maxCacheEntrySize is the maximum size of a cached response body.
+	maxCacheEntrySize = 5 << 20
+)
+
+// HTTPCacheConfig configures the HTTP cache shared by all modules.
+type HTTPCacheConfig struct {
+	// Enabled enables the cache.
+	Enabled bool `yaml:"enabled"`
+	// MaxStale is how long after expiring a response may be served when
+	// the origin cannot be reached. Defaults to 24h.
+	MaxStale time.Duration `yaml:"maxStale"`
+	// TTL overrides how long responses are fresh by host.
+	TTL map[string]time.Duration `yaml:"ttl"`
+}
+
+// Validate validates the HTTP cache configuration.
+func (c HTTPCacheConfig) Validate() error {
+	if c.MaxStale < 0 {
+		return errors.New("config: http cache max stale must be greater than or equal to zero")
+	}
+	for _, host := range slices.Sorted(maps.Keys(c.TTL)) {
+		if c.TTL[host] < 0 {
+			return fmt.Errorf("config: http cache ttl of %q must be greater than or equal to zero", host)
+		}
+	}
+	return nil
+}
+
+// cachedResponse is a response stored in the HTTP cache.
+type cachedResponse struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	StoredAt   time.Time   `json:"storedAt"`
+	Expires    time.Time   `json:"expires"`
+}
+
+// response returns the cached response for req, flagged with status.
+func (r *cachedResponse) response(req *http.Request, status string) *http.Response {
+	h := r.Header.Clone()
+	h.Set(cacheHeader, status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+// httpCache is an HTTP cache shared by all modules. Responses are persisted
+// in dir, or kept in memory if dir is empty.
+//
+// Responses are keyed by their URL, request headers and the partition of
+// the module making the request, so a response is only shared between
+// identical requests made with the same TLS and proxy configuration, and
+// credentials are never shared between modules. As every request header
+// is part of the key, responses always match the headers they vary on.
+// Private responses are not stored.
+type httpCache struct {
+	dir      string
+	maxStale time.Duration
+	ttl      map[string]time.Duration
+
+	grp singleflight.Group
+
+	mu  sync.Mutex
+	mem map[string]*cachedResponse
+
+	log *logger.Logger
+}
+
+// newHTTPCache returns an HTTP cache persisted in dir, removing responses
+// that are too old to be served.
+func newHTTPCache(dir string, cfg HTTPCacheConfig, log *logger.Logger) *httpCache {
+	maxStale := cfg.MaxStale
+	if maxStale == 0 {
+		maxStale = defaultMaxStale
+	}
+
+	c := &httpCache{
+		dir:      dir,
+		maxStale: maxStale,
+		ttl:      cfg.TTL,
+		mem:      map[string]*cachedResponse{},
+		log:      log,
+	}
+	if dir != "" {
+		c.prune()
+	}
+	return c
+}
+
+// prune removes the persisted responses that are too old to be served.
+func (c *httpCache) prune() {
+	err := filepath.WalkDir(c.dir, func(file string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() || filepath.Ext(file) != ".json" {
+			return err
+		}
+		key := strings.TrimSuffix(de.Name(), ".json")
+		if _, ok := c.get(key); !ok {
+			_ = os.Remove(file)
+		}
+		return nil
+	})
+	if err != nil {
+		c.log.Warn("Could not prune http cache", lctx.Err(err))
+	}
+}
+
+// key returns the cache key of req made in partition.
+func (c *httpCache) key(partition string, req *http.Request) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, partition+"\n")
+	_, _ = io.WriteString(h, req.URL.String()+"\n")
+	for _, k := range slices.Sorted(maps.Keys(req.Header)) {
+		_, _ = io.WriteString(h, k+": "+strings.Join(req.Header[k], ", ")+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the response with key, if it can still be served.
+func (c *httpCache) get(key string) (*cachedResponse, bool) {
+	if c.dir == "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		r, ok := c.mem[key]
+		return r, ok && c.servable(r)
+	}
+
+	//nolint:gosec // The key is a hex encoded digest.
+	b, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	var r cachedResponse
+	if err = json.Unmarshal(b, &r); err != nil || !c.servable(&r) {
+		return nil, false
+	}
+	return &r, true
+}
+
+func (c *httpCache) servable(r *cachedResponse) bool {
+	return time.Now().Before(r.Expires.Add(c.maxStale))
+}
+
+func (c *httpCache) put(key string, r *cachedResponse) {
+	if c.dir == "" {
+		c.mu.Lock()
+		c.mem[key] = r
+		c.mu.Unlock()
+		return
+	}
+
+	b, err := json.Marshal(r)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(c.dir, key+".json"), b, 0o600)
+	}
+	if err != nil {
+		c.log.Warn("Could not write http cache entry", lctx.Str("url", r.URL), lctx.Err(err))
+	}
+}
+
+// freshness returns how long resp is fresh for, and whether it may be stored.
+func (c *httpCache) freshness(req *http.Request, resp *http.Response) (time.Duration, bool) {
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	// The cache is shared, so responses meant for a single user are not stored.
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if varyAll(resp.Header) {
+		return 0, false
+	}
+	if ttl, ok := c.ttl[req.URL.Hostname()]; ok {
+		return ttl, true
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, true
+	}
+
+	var age time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+		age = time.Duration(secs) * time.Second
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, true
+			}
+			return time.Duration(secs)*time.Second - age, true
+		}
+	}
+	if exp, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return exp.Sub(date) - age, true
+	}
+	return 0, true
+}
+
+// varyAll reports whether the response varies on more than the request,
+// so it can never be served from the cache.
+func varyAll(h http.Header) bool {
+	for _, v := range h.Values("Vary") {
+		for field := range strings.SplitSeq(v, ",") {
+			if strings.TrimSpace(field) == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for directive := range strings.SplitSeq(v, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if k == "" {
+			continue
+		}
+		cc[strings.ToLower(k)] = strings.Trim(val, `"`)
+	}
+	return cc
+}
+
+// transport returns a round tripper serving the requests of the named
+// module from the cache, making requests with next. Responses are only
+// shared between modules in the same partition, which must identify how
+// next makes requests.
+func (c *httpCache) transport(name, partition string, next http.RoundTripper) http.RoundTripper {
+	return &cachingTransport{cache: c, name: name, partition: partition, next: next}
+}
+
+// cachingTransport serves requests from an HTTP cache.
+type cachingTransport struct {
+	cache     *httpCache
+	name      string
+	partition string
+	next      http.RoundTripper
+}
+
+// fetchResult is the result of a request to the origin. It holds either
+// the cached response, or a response that could not be cached.
+type fetchResult struct {
+	entry  *cachedResponse
+	status string
+	resp   *http.Response
+}
+
+// RoundTrip serves req from the cache, or from the origin if it cannot
+// be served from the cache. Identical requests to the origin are made once.
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := t.cache.key(t.partition, req)
+	entry, ok := t.cache.get(key)
+	if ok && time.Now().Before(entry.Expires) {
+		return entry.response(req, cacheHit), nil
+	}
+
+	// Only the caller that made the request may use an uncached response.
+	var leader bool
+	ch := t.cache.grp.DoChan(key, func() (any, error) {
+		leader = true
+		return t.fetch(req, key, entry)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		r := res.Val.(fetchResult)
+		if r.resp != nil {
+			if leader {
+				return r.resp, nil
+			}
+			return t.next.RoundTrip(req)
+		}
+		return r.entry.response(req, r.status), nil
+	case <-req.Context().Done():
+		go func() {
+			if res := <-ch; leader && res.Err == nil && res.Val.(fetchResult).resp != nil {
+				_ = res.Val.(fetchResult).resp.Body.Close()
+			}
+		}()
+		return nil, req.Context().Err()
+	}
+}
+
+// fetch makes req to the origin, revalidating entry if it is given. The
+// request is not cancelled with its context, as other modules may be
+// waiting on it.
+func (t *cachingTransport) fetch(req *http.Request, key string, entry *cachedResponse) (fetchResult, error) {
+	out := req.Clone(context.WithoutCancel(req.Context()))
+	if entry != nil {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.Header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil || originUnavailable(resp.StatusCode) {
+		if entry != nil {
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+			t.cache.log.Warn("http cache: origin unreachable, serving stale response",
+				lctx.Str("module", t.name), lctx.Str("url", req.URL.Redacted()))
+			return fetchResult{entry: entry, status: cacheStale}, nil
+		}
+		if err != nil {
+			return fetchResult{}, err
+		}
+		return fetchResult{resp: resp}, nil
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		_ = resp.Body.Close()
+
+		ttl, _ := t.cache.freshness(req, resp)
+		updated := *entry
+		updated.Header = entry.Header.Clone()
+		for k, v := range resp.Header {
+			if k != "Content-Length" {
+				updated.Header[k] = v
+			}
+		}
+		updated.StoredAt = time.Now()
+		updated.Expires = updated.StoredAt.Add(ttl)
+		t.cache.put(key, &updated)
+		return fetchResult{entry: &updated, status: cacheRevalidated}, nil
+	}
+
+	ttl, ok := t.cache.freshness(req, resp)
+	if !ok || !cacheableResponse(resp, ttl) {
+		return fetchResult{resp: resp}, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheEntrySize+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return fetchResult{}, err
+	}
+	if len(body) > maxCacheEntrySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return fetchResult{resp: resp}, nil
+	}
+	_ = resp.Body.Close()
+
+	now := time.Now()
+	entry = &cachedResponse{
+		URL:        req.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		StoredAt:   now,
+		Expires:    now.Add(ttl),
+	}
+	t.cache.put(key, entry)
+	return fetchResult{entry: entry, status: cacheMiss}, nil
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport.
+func (t *cachingTransport) CloseIdleConnections() {
+	if tr, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// cacheableRequest reports whether req may be served from the cache.
+// Conditional requests are left to the module.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noStore := cc["no-store"]
+	_, noCache := cc["no-cache"]
+	return !noStore && !noCache
+}
+
+// cacheableResponse reports whether resp may be cached. Responses that may
+// be endless streams, with no length, validator or lifetime, are not cached.
+func cacheableResponse(resp *http.Response, ttl time.Duration) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > maxCacheEntrySize {
+		return false
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "text/event-stream" {
+		return false
+	}
+	return resp.ContentLength >= 0 || ttl > 0 ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+func originUnavailable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
@@ -0,0 +1,344 @@
+package module
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPCacheConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HTTPCacheConfig
+		wantErr string
+	}{
+		{
+			name: "valid config",
+			cfg:  HTTPCacheConfig{Enabled: true, MaxStale: time.Hour, TTL: map[string]time.Duration{"example.com": time.Minute}},
+		},
+		{
+			name:    "handles negative max stale",
+			cfg:     HTTPCacheConfig{MaxStale: -1},
+			wantErr: "config: http cache max stale must be greater than or equal to zero",
+		},
+		{
+			name:    "handles negative ttl",
+			cfg:     HTTPCacheConfig{TTL: map[string]time.Duration{"example.com": -1}},
+			wantErr: `config: http cache ttl of "example.com" must be greater than or equal to zero`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCachingTransport_ServesFreshResponses(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachingClient(t, t.TempDir(), HTTPCacheConfig{})
+
+	status, body := get(t, client, srv.URL)
+	assert.Equal(t, cacheMiss, status)
+	assert.Equal(t, "sunny", body)
+
+	status, body = get(t, client, srv.URL)
+	assert.Equal(t, cacheHit, status)
+	assert.Equal(t, "sunny", body)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestCachingTransport_RevalidatesWithETag(t *testing.T) {
+	t.Parallel()
+
+	var hits, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Cache-Control", "no-cache")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachingClient(t, "", HTTPCacheConfig{})
+
+	status, _ := get(t, client, srv.URL)
+	assert.Equal(t, cacheMiss, status)
+
+	status, body := get(t, client, srv.URL)
+	assert.Equal(t, cacheRevalidated, status)
+	assert.Equal(t, "sunny", body)
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, int32(1), notModified.Load())
+}
+
+func TestCachingTransport_ServesStaleResponsesWhenOffline(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=0")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+
+	client := newCachingClient(t, t.TempDir(), HTTPCacheConfig{})
+
+	status, _ := get(t, client, srv.URL)
+	require.Equal(t, cacheMiss, status)
+
+	srv.Close()
+
+	status, body := get(t, client, srv.URL)
+	assert.Equal(t, cacheStale, status)
+	assert.Equal(t, "sunny", body)
+}
+
+func TestCachingTransport_UsesHostTTL(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "no-cache")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachingClient(t, "", HTTPCacheConfig{TTL: map[string]time.Duration{"127.0.0.1": time.Minute}})
+
+	get(t, client, srv.URL)
+	status, _ := get(t, client, srv.URL)
+
+	assert.Equal(t, cacheHit, status)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestCachingTransport_DoesNotStoreNoStore(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "no-store")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachingClient(t, "", HTTPCacheConfig{})
+
+	get(t, client, srv.URL)
+	status, _ := get(t, client, srv.URL)
+
+	assert.Empty(t, status)
+	assert.Equal(t, int32(2), hits.Load())
+}
+
+func TestCachingTransport_DoesNotStorePrivateResponses(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{
+			name:   "private",
+			header: http.Header{"Cache-Control": {"private, max-age=60"}},
+		},
+		{
+			name:   "vary all",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, *"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				hits.Add(1)
+				for k, v := range test.header {
+					rw.Header()[k] = v
+				}
+				_, _ = rw.Write([]byte("sunny"))
+			}))
+			t.Cleanup(srv.Close)
+
+			client := newCachingClient(t, "", HTTPCacheConfig{})
+
+			get(t, client, srv.URL)
+			status, _ := get(t, client, srv.URL)
+
+			assert.Empty(t, status)
+			assert.Equal(t, int32(2), hits.Load())
+		})
+	}
+}
+
+func TestCachingTransport_HonoursVary(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Accept-Language")
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachingClient(t, "", HTTPCacheConfig{})
+
+	for _, lang := range []string{"en", "nl", "en"} {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Language", lang)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, lang, string(b))
+	}
+	assert.Equal(t, int32(2), hits.Load())
+}
+
+func TestCachingTransport_PartitionsResponses(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	cache := newHTTPCache("", HTTPCacheConfig{}, log)
+	mtls := HTTPConfig{Cert: "cert", Key: "key"}.cachePartition()
+	require.NotEmpty(t, mtls)
+
+	status, _ := get(t, &http.Client{Transport: cache.transport("a", "", http.DefaultTransport)}, srv.URL)
+	assert.Equal(t, cacheMiss, status)
+	status, _ = get(t, &http.Client{Transport: cache.transport("b", mtls, http.DefaultTransport)}, srv.URL)
+	assert.Equal(t, cacheMiss, status)
+	status, _ = get(t, &http.Client{Transport: cache.transport("c", "", http.DefaultTransport)}, srv.URL)
+	assert.Equal(t, cacheHit, status)
+	assert.Equal(t, int32(2), hits.Load())
+}
+
+func TestCachingTransport_DeduplicatesRequests(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		<-release
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	cache := newHTTPCache("", HTTPCacheConfig{}, log)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for i := range bodies {
+		client := &http.Client{Transport: cache.transport("test", "", http.DefaultTransport)}
+		wg.Go(func() {
+			resp, err := client.Get(srv.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			b, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			bodies[i] = string(b)
+		})
+	}
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, []string{"sunny", "sunny", "sunny"}, bodies)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestHTTPCache_PersistsResponses(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	get(t, newCachingClient(t, dir, HTTPCacheConfig{}), srv.URL)
+
+	status, body := get(t, newCachingClient(t, dir, HTTPCacheConfig{}), srv.URL)
+
+	assert.Equal(t, cacheHit, status)
+	assert.Equal(t, "sunny", body)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func newCachingClient(t *testing.T, dir string, cfg HTTPCacheConfig) *http.Client {
+	t.Helper()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	cache := newHTTPCache(dir, cfg, log)
+	return &http.Client{Transport: cache.transport("test", "", http.DefaultTransport)}
+}
+
+// get makes a GET request to uri, returning the cache header and body.
+func get(t *testing.T, client *http.Client, uri string) (string, string) {
+	t.Helper()
+
+	resp, err := client.Get(uri)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.Header.Get(cacheHeader), string(b)
+}
@@ -0,0 +1,166 @@
+package module
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Default HTTP client timeouts.
+const (
+	defaultConnectTimeout  = 10 * time.Second
+	defaultResponseTimeout = 30 * time.Second
+)
+
+// maxRedirects is the number of redirects followed by a module HTTP client.
+const maxRedirects = 10
+
+// HTTPConfig configures the HTTP client of a module.
+type HTTPConfig struct {
+	// CAFiles are PEM files of certificate authorities trusted in
+	// addition to the system roots.
+	CAFiles []string `yaml:"caFiles"`
+	// Cert and Key are the PEM encoded client certificate and key used
+	// for mutual TLS.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Proxy is the URL of the proxy requests are made through. The
+	// proxy from the environment is used if it is empty.
+	Proxy string `yaml:"proxy"`
+	// InsecureSkipVerify disables verification of server certificates.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// ConnectTimeout is the maximum time to wait for a connection.
+	// Defaults to 10s.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// ResponseTimeout is the maximum time to wait for response headers
+	// once a request has been sent. Defaults to 30s.
+	ResponseTimeout time.Duration `yaml:"responseTimeout"`
+}
+
+// Validate validates the HTTP configuration.
+func (c HTTPConfig) Validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("http: a client certificate and key must be given together")
+	}
+	if c.Proxy != "" {
+		if u, err := url.Parse(c.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("http: invalid proxy url %q", c.Proxy)
+		}
+	}
+	if c.ConnectTimeout < 0 {
+		return errors.New("http: connect timeout must be greater than or equal to zero")
+	}
+	if c.ResponseTimeout < 0 {
+		return errors.New("http: response timeout must be greater than or equal to zero")
+	}
+	return nil
+}
+
+// cachePartition returns the HTTP cache partition of clients configured
+// by c. Clients with the default TLS and proxy configuration share a
+// partition, others only share it with clients configured the same way.
+func (c HTTPConfig) cachePartition() string {
+	if len(c.CAFiles) == 0 && c.Cert == "" && c.Proxy == "" && !c.InsecureSkipVerify {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, file := range c.CAFiles {
+		_, _ = io.WriteString(h, "ca: "+file+"\n")
+	}
+	_, _ = io.WriteString(h, "cert: "+c.Cert+"\n")
+	_, _ = io.WriteString(h, "key: "+c.Key+"\n")
+	_, _ = io.WriteString(h, "proxy: "+c.Proxy+"\n")
+	_, _ = io.WriteString(h, "insecure: "+strconv.FormatBool(c.InsecureSkipVerify)+"\n")
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newHTTPClient returns an HTTP client configured by cfg with its own
+// cookie jar. Redirects are only followed when perms allows them.
+func newHTTPClient(cfg HTTPConfig, perms *Permissions) (*http.Client, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // Opt-in for self-signed LAN devices.
+	}
+	if len(cfg.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range cfg.CAFiles {
+			b, err := os.ReadFile(filepath.Clean(file))
+			if err != nil {
+				return nil, fmt.Errorf("reading ca file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("ca file %s contains no certificates", file)
+			}
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.Cert != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.Cert), []byte(cfg.Key))
+		if err != nil {
+			return nil, fmt.Errorf("parsing client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy url: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	connectTimeout := cfg.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	responseTimeout := cfg.ResponseTimeout
+	if responseTimeout == 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = proxy
+	tr.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = connectTimeout
+	tr.ResponseHeaderTimeout = responseTimeout
+	tr.TLSClientConfig = tlsCfg
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, fmt.Errorf("creating cookie jar: %w", err)
+	}
+
+	return &http.Client{
+		Transport: tr,
+		Jar:       jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !perms.allowsRequest(req.Method, req.URL) {
+				return fmt.Errorf("redirect to %s is not permitted", req.URL.Redacted())
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,169 @@
+package module
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HTTPConfig
+		wantErr string
+	}{
+		{
+			name: "valid config",
+			cfg:  HTTPConfig{Proxy: "http://proxy:3128", ConnectTimeout: time.Second, ResponseTimeout: time.Second},
+		},
+		{
+			name:    "handles cert without key",
+			cfg:     HTTPConfig{Cert: "cert"},
+			wantErr: "http: a client certificate and key must be given together",
+		},
+		{
+			name:    "handles invalid proxy",
+			cfg:     HTTPConfig{Proxy: "proxy"},
+			wantErr: `http: invalid proxy url "proxy"`,
+		},
+		{
+			name:    "handles negative connect timeout",
+			cfg:     HTTPConfig{ConnectTimeout: -1},
+			wantErr: "http: connect timeout must be greater than or equal to zero",
+		},
+		{
+			name:    "handles negative response timeout",
+			cfg:     HTTPConfig{ResponseTimeout: -1},
+			wantErr: "http: response timeout must be greater than or equal to zero",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNewHTTPClient_TrustsCAFiles(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, b, 0o600))
+
+	client, err := newHTTPClient(HTTPConfig{}, nil)
+	require.NoError(t, err)
+	_, err = client.Get(srv.URL)
+	require.Error(t, err, "the server certificate is not trusted by default")
+
+	client, err = newHTTPClient(HTTPConfig{CAFiles: []string{caFile}}, nil)
+	require.NoError(t, err)
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	client, err = newHTTPClient(HTTPConfig{InsecureSkipVerify: true}, nil)
+	require.NoError(t, err)
+	resp, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+}
+
+func TestNewHTTPClient_HandlesInvalidFiles(t *testing.T) {
+	t.Parallel()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+	_, err := newHTTPClient(HTTPConfig{CAFiles: []string{caFile}}, nil)
+	assert.EqualError(t, err, "ca file "+caFile+" contains no certificates")
+
+	_, err = newHTTPClient(HTTPConfig{Cert: "cert", Key: "key"}, nil)
+	assert.ErrorContains(t, err, "parsing client certificate: ")
+}
+
+func TestNewHTTPClient_KeepsCookies(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, err := req.Cookie("session"); err != nil {
+			http.SetCookie(rw, &http.Cookie{Name: "session", Value: "abc"})
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := newHTTPClient(HTTPConfig{}, nil)
+	require.NoError(t, err)
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNewHTTPClient_HandlesResponseTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := newHTTPClient(HTTPConfig{ResponseTimeout: 20 * time.Millisecond}, nil)
+	require.NoError(t, err)
+
+	_, err = client.Get(srv.URL)
+
+	assert.ErrorContains(t, err, "timeout awaiting response headers")
+}
+
+func TestNewHTTPClient_UsesProxy(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.URL.String()
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(proxy.Close)
+
+	client, err := newHTTPClient(HTTPConfig{Proxy: proxy.URL}, nil)
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://example.com/weather")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, "http://example.com/weather", got)
+}
@@ -0,0 +1,317 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// defaultStorageQuota is the storage quota of a module without one.
+const defaultStorageQuota = 1 << 20
+
+// maxKVKeyLen is the maximum length of a key in the key-value store.
+const maxKVKeyLen = 256
+
+var (
+	errInvalidKey    = errors.New("invalid key")
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// kvStore is a module's persistent key-value store. The store is kept
+// in memory and written to a JSON file on every change.
+type kvStore struct {
+	file  string
+	quota int64
+
+	mu     sync.Mutex
+	loaded bool
+	data   map[string][]byte
+	size   int64
+}
+
+// newKVStore returns the store of the named module in dir. If dir is
+// empty, the store is not persisted.
+func newKVStore(dir, name string, quota int64) *kvStore {
+	if quota <= 0 {
+		quota = defaultStorageQuota
+	}
+
+	var file string
+	if dir != "" {
+		file = filepath.Join(dir, name+".json")
+	}
+	return &kvStore{file: file, quota: quota}
+}
+
+// get returns the value of key.
+func (s *kvStore) get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, false, err
+	}
+
+	v, ok := s.data[key]
+	return v, ok, nil
+}
+
+// set sets the value of key.
+func (s *kvStore) set(key string, value []byte) error {
+	if key == "" || len(key) > maxKVKeyLen || strings.ContainsRune(key, '\n') {
+		return errInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	old, existed := s.data[key]
+	size := s.size + int64(len(key)+len(value))
+	if existed {
+		size -= int64(len(key) + len(old))
+	}
+	if size > s.quota {
+		return errQuotaExceeded
+	}
+
+	s.data[key] = slices.Clone(value)
+	if err := s.save(); err != nil {
+		if existed {
+			s.data[key] = old
+		} else {
+			delete(s.data, key)
+		}
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// delete deletes key. Deleting a key that does not exist is not an error.
+func (s *kvStore) delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	old, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+
+	delete(s.data, key)
+	if err := s.save(); err != nil {
+		s.data[key] = old
+		return err
+	}
+	s.size -= int64(len(key) + len(old))
+	return nil
+}
+
+// list returns the keys with the given prefix in order.
+func (s *kvStore) list(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, k := range slices.Sorted(maps.Keys(s.data)) {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (s *kvStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	s.data = map[string][]byte{}
+	if s.file != "" {
+		b, err := os.ReadFile(s.file)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("reading store: %w", err)
+		default:
+			if err = json.Unmarshal(b, &s.data); err != nil {
+				return fmt.Errorf("decoding store: %w", err)
+			}
+		}
+	}
+
+	s.size = 0
+	for k, v := range s.data {
+		s.size += int64(len(k) + len(v))
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *kvStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(s.file, b, 0o600); err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	return nil
+}
+
+// kvGetFunc reads the value of a key into the plugin buffer.
+func kvGetFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		keyPtr := uint32(stack[0])
+		keyLen := uint32(stack[1])
+		bufPtr := uint32(stack[2])
+		bufLen := uint32(stack[3])
+
+		store, ok := env.kvStore(mod, "kv_get")
+		if !ok {
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		key, ok := mod.Memory().Read(keyPtr, keyLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		v, found, err := store.get(string(key))
+		switch {
+		case err != nil:
+			env.log.Error("kv_get: could not read store", lctx.Str("module", mod.Name()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+		case !found:
+			stack[0] = errno(errnoNotFound)
+		default:
+			stack[0] = writeResult(mod, bufPtr, bufLen, v)
+		}
+	}
+}
+
+// kvSetFunc sets the value of a key.
+func kvSetFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		keyPtr := uint32(stack[0])
+		keyLen := uint32(stack[1])
+		valPtr := uint32(stack[2])
+		valLen := uint32(stack[3])
+
+		store, ok := env.kvStore(mod, "kv_set")
+		if !ok {
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		key, ok := mod.Memory().Read(keyPtr, keyLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		val, ok := mod.Memory().Read(valPtr, valLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		err := store.set(string(key), val)
+		switch {
+		case errors.Is(err, errInvalidKey):
+			stack[0] = errno(errnoInvalid)
+		case errors.Is(err, errQuotaExceeded):
+			env.log.Warn("kv_set: storage quota exceeded", lctx.Str("module", mod.Name()), lctx.Str("key", string(key)))
+			stack[0] = errno(errnoQuota)
+		case err != nil:
+			env.log.Error("kv_set: could not write store", lctx.Str("module", mod.Name()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+		default:
+			stack[0] = 0
+		}
+	}
+}
+
+// kvDeleteFunc deletes a key.
+func kvDeleteFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		keyPtr := uint32(stack[0])
+		keyLen := uint32(stack[1])
+
+		store, ok := env.kvStore(mod, "kv_delete")
+		if !ok {
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		key, ok := mod.Memory().Read(keyPtr, keyLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		if err := store.delete(string(key)); err != nil {
+			env.log.Error("kv_delete: could not write store", lctx.Str("module", mod.Name()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+		stack[0] = 0
+	}
+}
+
+// kvListFunc reads the keys with a prefix into the plugin buffer.
+func kvListFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		prefixPtr := uint32(stack[0])
+		prefixLen := uint32(stack[1])
+		bufPtr := uint32(stack[2])
+		bufLen := uint32(stack[3])
+
+		store, ok := env.kvStore(mod, "kv_list")
+		if !ok {
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		prefix, ok := mod.Memory().Read(prefixPtr, prefixLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		keys, err := store.list(string(prefix))
+		if err != nil {
+			env.log.Error("kv_list: could not read store", lctx.Str("module", mod.Name()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+
+		var b []byte
+		for _, k := range keys {
+			b = append(append(b, k...), '\n')
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, b)
+	}
+}
@@ -0,0 +1,189 @@
+package module
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_PersistsValues(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	store := newKVStore(dir, "test", 0)
+	require.NoError(t, store.set("a", []byte("1")))
+	require.NoError(t, store.set("b", []byte("2")))
+	require.NoError(t, store.delete("b"))
+
+	store = newKVStore(dir, "test", 0)
+	v, ok, err := store.get("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+	_, ok, err = store.get("b")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.FileExists(t, filepath.Join(dir, "test.json"))
+}
+
+func TestKVStore_NamespacesModules(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	require.NoError(t, newKVStore(dir, "first", 0).set("a", []byte("1")))
+
+	_, ok, err := newKVStore(dir, "second", 0).get("a")
+
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestKVStore_SetHandlesQuota(t *testing.T) {
+	t.Parallel()
+
+	store := newKVStore(t.TempDir(), "test", 10)
+
+	require.NoError(t, store.set("a", []byte("123456789")))
+	err := store.set("b", []byte("1"))
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	// Replacing a value only counts the new value.
+	require.NoError(t, store.set("a", []byte("12345678")))
+	require.NoError(t, store.delete("a"))
+	require.NoError(t, store.set("b", []byte("12345678")))
+}
+
+func TestKVStore_SetHandlesInvalidKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{
+			name: "empty key",
+			key:  "",
+		},
+		{
+			name: "key with newline",
+			key:  "a\nb",
+		},
+		{
+			name: "key too long",
+			key:  strings.Repeat("a", maxKVKeyLen+1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := newKVStore("", "test", 0).set(test.key, []byte("1"))
+
+			assert.ErrorIs(t, err, errInvalidKey)
+		})
+	}
+}
+
+func TestKVStore_List(t *testing.T) {
+	t.Parallel()
+
+	store := newKVStore("", "test", 0)
+	for _, k := range []string{"token", "forecast/2", "forecast/1"} {
+		require.NoError(t, store.set(k, []byte("v")))
+	}
+
+	got, err := store.list("forecast/")
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"forecast/1", "forecast/2"}, got)
+}
+
+func TestKVStore_HandlesCorruptFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.json"), []byte("{"), 0o600))
+
+	_, _, err := newKVStore(dir, "test", 0).get("a")
+
+	assert.ErrorContains(t, err, "decoding store")
+}
+
+func TestKVHostFuncs(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, t.TempDir(), log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("key", "value")
+	kvSetFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = mod.call("key", 3)
+	kvGetFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, uint64(5), stack[0], "returns the length when the buffer is too small")
+
+	stack = mod.call("key", 16)
+	kvGetFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(5), stack[0])
+	assert.Equal(t, "value", mod.result(stack[0]))
+
+	stack = mod.call("", 16)
+	kvListFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(4), stack[0])
+	assert.Equal(t, "key\n", mod.result(stack[0]))
+
+	stack = mod.call("key")
+	kvDeleteFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = mod.call("key", 16)
+	kvGetFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoNotFound, int32(stack[0]))
+}
+
+func TestKVHostFuncs_HandlesQuota(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test", Limits: Limits{MaxStorageBytes: 4}})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("key", "value")
+	kvSetFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoQuota, int32(stack[0]))
+	assert.Contains(t, buf.String(), `msg="kv_set: storage quota exceeded" module=test key=key`)
+}
+
+func TestKVHostFuncs_HandlesPermissionDenied(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test", Permissions: &Permissions{}})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("key", "value")
+	kvSetFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoPermission, int32(stack[0]))
+	assert.Contains(t, buf.String(), `msg="kv_set: storage not permitted" module=test`)
+}
@@ -0,0 +1,93 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// exitCodeLimitExceeded is the exit code of a module stopped for
+// exceeding a resource limit.
+const exitCodeLimitExceeded = 137
+
+// wasmPageSize is the size of a WebAssembly memory page.
+const wasmPageSize = 65536
+
+// Limits describes the resources a module may use.
+// Zero values mean no limit unless stated otherwise.
+type Limits struct {
+	// MemoryPages is the maximum number of 64KiB linear memory pages.
+	MemoryPages uint32 `yaml:"memoryPages"`
+	// MaxResponseBytes is the maximum size of a single HTTP response body.
+	MaxResponseBytes int64 `yaml:"maxResponseBytes"`
+	// Watchdog is the maximum time a module may run without yielding
+	// to the host.
+	Watchdog time.Duration `yaml:"watchdog"`
+	// MaxStorageBytes is the maximum size of the module's key-value
+	// store. Zero means the default of 1MiB.
+	MaxStorageBytes int64 `yaml:"maxStorageBytes"`
+}
+
+// Validate validates the limits.
+func (l Limits) Validate() error {
+	if l.MemoryPages > 65536 {
+		return errors.New("limits: memory pages must be less than or equal to 65536")
+	}
+	if l.MaxResponseBytes < 0 {
+		return errors.New("limits: max response bytes must be greater than or equal to zero")
+	}
+	if l.Watchdog < 0 {
+		return errors.New("limits: watchdog must be greater than or equal to zero")
+	}
+	if l.MaxStorageBytes < 0 {
+		return errors.New("limits: max storage bytes must be greater than or equal to zero")
+	}
+	return nil
+}
+
+// memoryAllocator returns an allocator limiting linear memory to the
+// memory page limit, or nil if memory is not limited.
+func (l Limits) memoryAllocator(env *moduleEnv) experimental.MemoryAllocator {
+	if l.MemoryPages == 0 {
+		return nil
+	}
+
+	limit := uint64(l.MemoryPages) * wasmPageSize
+	return experimental.MemoryAllocatorFunc(func(capacity, maximum uint64) experimental.LinearMemory {
+		return &limitedMemory{
+			buf:   make([]byte, 0, min(capacity, limit)),
+			limit: limit,
+			env:   env,
+		}
+	})
+}
+
+// limitedMemory is a linear memory that refuses to grow past its limit.
+type limitedMemory struct {
+	buf   []byte
+	limit uint64
+	env   *moduleEnv
+}
+
+func (m *limitedMemory) Reallocate(size uint64) []byte {
+	if size > m.limit {
+		// The plugin sees a failed memory.grow, which it cannot recover from.
+		m.env.exceed(fmt.Errorf("memory of %d bytes exceeds limit of %d pages", size, m.limit/wasmPageSize))
+		return nil
+	}
+
+	if size <= uint64(cap(m.buf)) {
+		m.buf = m.buf[:size]
+		return m.buf
+	}
+	buf := make([]byte, size, min(max(size, 2*uint64(cap(m.buf))), m.limit))
+	copy(buf, m.buf)
+	m.buf = buf
+	return m.buf
+}
+
+func (m *limitedMemory) Free() {
+	m.buf = nil
+}
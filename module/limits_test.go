@@ -0,0 +1,92 @@
+package module
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr string
+	}{
+		{
+			name:   "valid empty limits",
+			limits: Limits{},
+		},
+		{
+			name:   "valid limits",
+			limits: Limits{MemoryPages: 256, MaxResponseBytes: 1 << 20, Watchdog: time.Second},
+		},
+		{
+			name:    "handles too many memory pages",
+			limits:  Limits{MemoryPages: 65537},
+			wantErr: "limits: memory pages must be less than or equal to 65536",
+		},
+		{
+			name:    "handles negative max response bytes",
+			limits:  Limits{MaxResponseBytes: -1},
+			wantErr: "limits: max response bytes must be greater than or equal to zero",
+		},
+		{
+			name:    "handles negative watchdog",
+			limits:  Limits{Watchdog: -time.Second},
+			wantErr: "limits: watchdog must be greater than or equal to zero",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := test.limits.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLimits_MemoryAllocator(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+	env, err := newModuleEnv(Descriptor{Name: "test"}, "", log)
+	require.NoError(t, err)
+
+	alloc := Limits{MemoryPages: 2}.memoryAllocator(env)
+	require.NotNil(t, alloc)
+	mem := alloc.Allocate(wasmPageSize, 10*wasmPageSize)
+
+	buf := mem.Reallocate(wasmPageSize)
+	require.Len(t, buf, wasmPageSize)
+	buf[0] = 1
+
+	buf = mem.Reallocate(2 * wasmPageSize)
+	require.Len(t, buf, 2*wasmPageSize)
+	assert.Equal(t, byte(1), buf[0])
+	assert.NoError(t, env.err())
+
+	buf = mem.Reallocate(3 * wasmPageSize)
+	assert.Nil(t, buf)
+	assert.EqualError(t, env.err(), "memory of 196608 bytes exceeds limit of 2 pages")
+}
+
+func TestLimits_MemoryAllocatorWithoutLimit(t *testing.T) {
+	t.Parallel()
+
+	alloc := Limits{}.memoryAllocator(nil)
+
+	assert.Nil(t, alloc)
+}
@@ -0,0 +1,121 @@
+package module
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestSection is the name of the custom WASM section holding the
+// module manifest.
+const ManifestSection = "looking-glass.manifest"
+
+// Host ABI versions.
+const (
+	// ABIv1 is the original host ABI, imported from the "looking-glass"
+	// host module.
+	ABIv1 = "looking-glass/v1"
+	// ABIv2 is imported from the "looking-glass/v2" host module. Its render
+	// returns an error number, and the error can be read with last_error.
+	ABIv2 = "looking-glass/v2"
+)
+
+// HostABI is the latest host ABI version implemented by this host.
+const HostABI = ABIv2
+
+// Host module names of the ABI versions.
+const (
+	hostModuleV1 = "looking-glass"
+	hostModuleV2 = ABIv2
+)
+
+// supportedABIs are the host ABI versions modules may require. They are
+// advertised to modules in the HOST_ABI environment variable.
+var supportedABIs = []string{ABIv1, ABIv2}
+
+// Manifest describes a module. It is embedded in the module as JSON in
+// the ManifestSection custom section.
+type Manifest struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	Author  string `yaml:"author"`
+	// ABI is the host ABI version the module requires, e.g.
+	// "looking-glass/v1". Modules without one are assumed to require v1.
+	ABI string `yaml:"abi"`
+	// Permissions are the permissions the module requests.
+	Permissions *Permissions `yaml:"permissions"`
+	// ConfigSchema is the JSON Schema of the module configuration.
+	ConfigSchema map[string]any `yaml:"configSchema"`
+}
+
+// CheckABI checks that the host supports the ABI required by the module.
+func (m Manifest) CheckABI() error {
+	if m.ABI == "" || slices.Contains(supportedABIs, m.ABI) {
+		return nil
+	}
+	return fmt.Errorf("module requires host ABI %q, but the host supports %s", m.ABI, strings.Join(supportedABIs, ", "))
+}
+
+// warnMissingPermissions logs the permissions the module requests in its
+// manifest that its configuration does not grant, as the calls needing them
+// will fail.
+func warnMissingPermissions(log *logger.Logger, desc Descriptor, m Manifest) {
+	missing := desc.Permissions.missing(m.Permissions)
+	if len(missing) == 0 {
+		return
+	}
+	log.Warn("Module requests permissions it is not granted",
+		lctx.Str("module", desc.Name),
+		lctx.Strs("missing", missing),
+	)
+}
+
+var wasmMagic = []byte("\x00asm\x01\x00\x00\x00")
+
+// ReadManifest reads the manifest embedded in the WASM module b. It
+// reports false if the module has no manifest.
+func ReadManifest(b []byte) (Manifest, bool, error) {
+	if !bytes.HasPrefix(b, wasmMagic) {
+		return Manifest{}, false, errors.New("manifest: not a wasm module")
+	}
+
+	b = b[len(wasmMagic):]
+	for len(b) > 0 {
+		id := b[0]
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || size > uint64(len(b)-1-n) {
+			return Manifest{}, false, errors.New("manifest: invalid wasm section")
+		}
+		payload := b[1+n : 1+n+int(size)]
+		b = b[1+n+int(size):]
+
+		// Custom sections have the id 0, and start with their name.
+		if id != 0 {
+			continue
+		}
+		nameLen, n := binary.Uvarint(payload)
+		if n <= 0 || nameLen > uint64(len(payload)-n) {
+			return Manifest{}, false, errors.New("manifest: invalid wasm custom section")
+		}
+		if string(payload[n:n+int(nameLen)]) != ManifestSection {
+			continue
+		}
+
+		var m Manifest
+		if err := yaml.Unmarshal(payload[n+int(nameLen):], &m); err != nil {
+			return Manifest{}, false, fmt.Errorf("manifest: %w", err)
+		}
+		if err := m.Permissions.Validate(); err != nil {
+			return Manifest{}, false, fmt.Errorf("manifest: %w", err)
+		}
+		return m, true, nil
+	}
+	return Manifest{}, false, nil
+}
@@ -0,0 +1,130 @@
+package module
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadManifest(t *testing.T) {
+	wasm, err := os.ReadFile("./testdata/minimal.wasm")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		wasm    []byte
+		want    Manifest
+		wantOK  bool
+		wantErr string
+	}{
+		{
+			name: "reads the manifest",
+			wasm: withManifest(wasm, `{
+				"name": "clock",
+				"version": "1.2.0",
+				"author": "glasslabs",
+				"abi": "looking-glass/v1",
+				"permissions": {"http": {"hosts": ["example.com"]}, "maxStreams": 2},
+				"configSchema": {"type": "object"}
+			}`),
+			want: Manifest{
+				Name:    "clock",
+				Version: "1.2.0",
+				Author:  "glasslabs",
+				ABI:     "looking-glass/v1",
+				Permissions: &Permissions{
+					HTTP:       HTTPPermissions{Hosts: []string{"example.com"}},
+					MaxStreams: 2,
+				},
+				ConfigSchema: map[string]any{"type": "object"},
+			},
+			wantOK: true,
+		},
+		{
+			name: "handles no manifest",
+			wasm: wasm,
+		},
+		{
+			name:    "handles invalid manifest",
+			wasm:    withManifest(wasm, `{"name": `),
+			wantErr: "manifest: yaml: line 1: did not find expected node content",
+		},
+		{
+			name:    "handles invalid permissions",
+			wasm:    withManifest(wasm, `{"permissions": {"maxStreams": -1}}`),
+			wantErr: "manifest: permissions: max streams must be greater than or equal to zero",
+		},
+		{
+			name:    "handles not wasm",
+			wasm:    []byte("not-wasm"),
+			wantErr: "manifest: not a wasm module",
+		},
+		{
+			name:    "handles truncated section",
+			wasm:    append(append([]byte{}, wasmMagic...), 0, 10, 1),
+			wantErr: "manifest: invalid wasm section",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok, err := ReadManifest(test.wasm)
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.wantOK, ok)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestManifest_CheckABI(t *testing.T) {
+	tests := []struct {
+		name    string
+		abi     string
+		wantErr string
+	}{
+		{
+			name: "supports the host abi",
+			abi:  HostABI,
+		},
+		{
+			name: "supports no abi",
+		},
+		{
+			name:    "handles unsupported abi",
+			abi:     "looking-glass/v9",
+			wantErr: `module requires host ABI "looking-glass/v9", but the host supports looking-glass/v1, looking-glass/v2`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Manifest{ABI: test.abi}.CheckABI()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// withManifest returns wasm with a manifest custom section appended.
+func withManifest(wasm []byte, manifest string) []byte {
+	payload := binary.AppendUvarint(nil, uint64(len(ManifestSection)))
+	payload = append(payload, ManifestSection...)
+	payload = append(payload, manifest...)
+
+	b := append([]byte{}, wasm...)
+	b = append(b, 0)
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
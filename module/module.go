@@ -2,15 +2,24 @@ package module
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/glasslabs/client-go"
 	"github.com/hamba/logger/v2"
 	lctx "github.com/hamba/logger/v2/ctx"
+	"gopkg.in/yaml.v3"
 )
 
 // Module positions.
@@ -66,14 +75,89 @@ func (p *Position) UnmarshalYAML(unmarshal func(any) error) error {
 	return nil
 }
 
+// Module runtimes.
+const (
+	// RuntimeWASI runs modules built for GOOS=wasip1 against the
+	// looking-glass host ABI. It is the default runtime.
+	RuntimeWASI = "wasi"
+	// RuntimeExtism runs Extism plugins, such as those built with the
+	// Extism PDKs for Rust, AssemblyScript, Zig or JS.
+	RuntimeExtism = "extism"
+	// RuntimeNative runs native executables in a process of their own,
+	// talking to the host over stdio. Native modules are not sandboxed.
+	RuntimeNative = "native"
+	// RuntimeGo runs Go modules registered in-process with
+	// RegisterGoModule. It is selected by a go:// module URI.
+	RuntimeGo = "go"
+)
+
 var modNameRegex = regexp.MustCompile(`^[a-zA-Z0-9\-_]+$`)
 
 // Descriptor describes the module and its configuration.
 type Descriptor struct {
-	Name     string         `yaml:"name"`
-	URI      string         `yaml:"uri"`
-	Position Position       `yaml:"position"`
-	Config   map[string]any `yaml:"config"`
+	Name        string         `yaml:"name"`
+	URI         string         `yaml:"uri"`
+	Path        string         `yaml:"path"`
+	Version     string         `yaml:"version"`
+	Runtime     string         `yaml:"runtime"`
+	SHA256      string         `yaml:"sha256"`
+	Signature   string         `yaml:"signature"`
+	Position    Position       `yaml:"position"`
+	Config      map[string]any `yaml:"config"`
+	Restart     RestartPolicy  `yaml:"restart"`
+	Permissions *Permissions   `yaml:"permissions"`
+	Secrets     []string       `yaml:"secrets"`
+	HTTP        HTTPConfig     `yaml:"http"`
+	Limits      Limits         `yaml:"limits"`
+	// Interval is how often modules of runtimes driven by the host, such
+	// as Extism, are updated. It defaults to a minute.
+	Interval time.Duration `yaml:"interval"`
+
+	// configLines are the lines of the config values in the config file.
+	configLines configLines
+}
+
+// UnmarshalYAML unmarshals a Descriptor from YAML, keeping the lines of
+// its config values to report config errors.
+func (d *Descriptor) UnmarshalYAML(n *yaml.Node) error {
+	type descriptor Descriptor
+	var v descriptor
+	if err := n.Decode(&v); err != nil {
+		return err
+	}
+	*d = Descriptor(v)
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "config" {
+			d.configLines = newConfigLines(n.Content[i+1])
+			d.configLines[""] = n.Content[i].Line
+		}
+	}
+	return nil
+}
+
+// InProcess reports whether the module is a Go module run in-process,
+// which has nothing to download.
+func (d Descriptor) InProcess() bool {
+	_, ok := goModuleName(d.URI)
+	return ok
+}
+
+// checkNativePinned checks that a native module downloaded from a remote
+// URL has a digest or signature, as it runs on the host unsandboxed.
+func (d Descriptor) checkNativePinned() error {
+	if d.Runtime != RuntimeNative || d.SHA256 != "" || d.Signature != "" {
+		return nil
+	}
+
+	remote := d.Path != ""
+	if u, err := url.Parse(d.URI); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		remote = true
+	}
+	if remote {
+		return fmt.Errorf("%s: remote native modules must have a sha256 or a signature", d.Name)
+	}
+	return nil
 }
 
 // Validate validates a module descriptor.
@@ -85,11 +169,59 @@ func (d Descriptor) Validate() error {
 		return fmt.Errorf("%s: module names may only contain letters, numbers, '-' and '_'", d.Name)
 	}
 
-	if d.URI == "" {
-		return fmt.Errorf("%s: module must have a URI", d.Name)
+	switch {
+	case d.URI == "" && d.Path == "":
+		return fmt.Errorf("%s: module must have a URI or a path", d.Name)
+	case d.URI != "" && d.Path != "":
+		return fmt.Errorf("%s: module must have either a URI or a path, not both", d.Name)
+	case d.URI != "":
+		if d.Version != "" {
+			return fmt.Errorf("%s: module version can only be used with a path", d.Name)
+		}
+		if _, err := url.Parse(d.URI); err != nil {
+			return fmt.Errorf("%s: module URI has an error: %w", d.Name, err)
+		}
+	}
+
+	isGo := d.InProcess()
+	switch d.Runtime {
+	case "", RuntimeWASI, RuntimeExtism, RuntimeNative, RuntimeGo:
+	default:
+		return fmt.Errorf("%s: unknown module runtime %q", d.Name, d.Runtime)
 	}
-	if _, err := url.Parse(d.URI); err != nil {
-		return fmt.Errorf("%s: module URI has an error: %w", d.Name, err)
+	switch {
+	case isGo && d.Runtime != "" && d.Runtime != RuntimeGo:
+		return fmt.Errorf("%s: go modules cannot use the %s runtime", d.Name, d.Runtime)
+	case !isGo && d.Runtime == RuntimeGo:
+		return fmt.Errorf("%s: the go runtime needs a go:// module URI", d.Name)
+	}
+	if d.Interval < 0 {
+		return fmt.Errorf("%s: module interval must be greater than or equal to zero", d.Name)
+	}
+	if err := d.checkNativePinned(); err != nil {
+		return err
+	}
+
+	if d.SHA256 != "" {
+		if b, err := hex.DecodeString(d.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%s: module sha256 must be a hex encoded SHA-256 digest", d.Name)
+		}
+	}
+
+	if err := d.Restart.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if err := d.Permissions.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if err := d.Limits.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if err := d.HTTP.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if slices.Contains(d.Secrets, "") {
+		return fmt.Errorf("%s: secret names must not be empty", d.Name)
 	}
 
 	return nil
@@ -109,6 +241,15 @@ type UIProvider interface {
 	ModuleUI(name string) WidgetUpdater
 }
 
+// UIMover is implemented by a UIProvider that can remove and move module
+// containers, letting modules be unloaded and moved while running.
+type UIMover interface {
+	// RemoveModule removes the named module container.
+	RemoveModule(name string)
+	// MoveModule moves the named module container to a new grid position.
+	MoveModule(name, vert, horiz string)
+}
+
 // PluginInstance is a running WASM plugin driven by the host.
 type PluginInstance interface {
 	// Run is a long-running call that drives the plugin until ctx is canceled.
@@ -121,14 +262,56 @@ type PluginInstance interface {
 
 // Runner compiles and instantiates WASM plugin modules.
 type Runner interface {
-	Load(ctx context.Context, name string, wasmBytes []byte, cfg map[string]any) (PluginInstance, error)
+	// Load instantiates the module described by desc from wasmBytes.
+	// The descriptor name is normalized before it is passed to the runner.
+	Load(ctx context.Context, desc Descriptor, wasmBytes []byte) (PluginInstance, error)
 	Close(ctx context.Context) error
 }
 
+// runtimes is a Runner loading modules with the runner of their runtime.
+type runtimes map[string]Runner
+
+func (r runtimes) Load(ctx context.Context, desc Descriptor, wasmBytes []byte) (PluginInstance, error) {
+	rt := desc.Runtime
+	if desc.InProcess() {
+		rt = RuntimeGo
+	}
+	if rt == "" {
+		rt = RuntimeWASI
+	}
+	runner, ok := r[rt]
+	if !ok {
+		return nil, fmt.Errorf("module %s: unsupported runtime %q", desc.Name, rt)
+	}
+	return runner.Load(ctx, desc, wasmBytes)
+}
+
+func (r runtimes) Close(ctx context.Context) error {
+	var errs []error
+	for _, runner := range r {
+		if err := runner.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // ExecContext contains context for module execution.
 type ExecContext struct {
-	CachePath  string
-	AssetsPath string
+	CachePath     string
+	AssetsPath    string
+	DataPath      string
+	HTTPCachePath string
+	MQTT          MQTTConfig
+	HTTPCache     HTTPCacheConfig
+	Scheduler     *SchedulerConfig
+	Secrets       *Secrets
+	// Transport, when set, makes the HTTP requests of modules instead of
+	// the network, e.g. to fake responses in tests.
+	Transport http.RoundTripper
+	// Clock, when set, is the clock of modules and times their restarts
+	// instead of the system clock.
+	Clock Clock
 }
 
 // Loader loads and drives modules.
@@ -136,20 +319,50 @@ type Loader struct {
 	ui     UIProvider
 	d      *Downloader
 	runner Runner
-	log    *logger.Logger
+	clock  Clock
+
+	mu   sync.Mutex
+	mods map[string]*loadedModule
+
+	log *logger.Logger
+}
+
+// loadedModule tracks a module started by the Loader.
+type loadedModule struct {
+	sup    *supervisor
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-// New returns a module Loader backed by a wazero Runner.
+// New returns a module Loader backed by Runners, one for each module
+// runtime.
 func New(ctx context.Context, ui UIProvider, d *Downloader, execCtx ExecContext, log *logger.Logger) (*Loader, error) {
-	runner, err := newWazeroRunner(ctx, ui, execCtx.CachePath, execCtx.AssetsPath, log)
+	wasi, err := newWazeroRunner(ctx, ui, execCtx, log)
 	if err != nil {
 		return nil, fmt.Errorf("could not create runner: %w", err)
 	}
+	extism, err := newExtismRunner(ctx, wasi)
+	if err != nil {
+		_ = wasi.Close(ctx)
+		return nil, fmt.Errorf("could not create extism runner: %w", err)
+	}
+	nativeDir := filepath.Join(os.TempDir(), "looking-glass-native")
+	if execCtx.CachePath != "" {
+		nativeDir = filepath.Join(execCtx.CachePath, "native")
+	}
+	runner := runtimes{
+		RuntimeWASI:   wasi,
+		RuntimeExtism: extism,
+		RuntimeNative: newNativeRunner(wasi, nativeDir),
+		RuntimeGo:     newGoRunner(wasi),
+	}
 
 	return &Loader{
 		ui:     ui,
 		d:      d,
 		runner: runner,
+		clock:  execCtx.Clock,
+		mods:   map[string]*loadedModule{},
 		log:    log,
 	}, nil
 }
@@ -161,52 +374,215 @@ func NewWithRunner(ui UIProvider, d *Downloader, runner Runner, log *logger.Logg
 		ui:     ui,
 		d:      d,
 		runner: runner,
+		mods:   map[string]*loadedModule{},
 		log:    log,
 	}, nil
 }
 
 // Load downloads, registers, and starts a module described by desc.
-// Setup is called once with the module configuration, then Run is started in a
-// goroutine where the plugin manages its own update cadence until ctx is cancelled.
+// The plugin is run in a goroutine where it manages its own update cadence
+// until ctx is cancelled or the module is unloaded. When the plugin stops, it
+// is restarted according to the restart policy of the module.
 func (l *Loader) Load(ctx context.Context, desc Descriptor) {
-	name := strings.ReplaceAll(desc.Name, " ", "_")
+	name := moduleName(desc.Name)
 	pos := desc.Position
 
 	log := l.log.With(lctx.Str("module", name))
 
-	log.Debug("Downloading module bytes", lctx.Str("uri", desc.URI))
-
-	wasmBytes, err := l.d.DownloadBytes(ctx, desc.URI)
-	if err != nil {
-		l.log.Error("Could not read module", lctx.Err(err))
-		return
+	uri := desc.URI
+	if desc.Path != "" {
+		var err error
+		uri, err = l.d.Resolve(ctx, desc.Path, desc.Version)
+		if err != nil {
+			l.log.Error("Could not resolve module", lctx.Str("module", name), lctx.Err(err))
+			return
+		}
 	}
 
-	log.Debug("Module downloaded", lctx.Int("bytes", len(wasmBytes)))
+	// Go modules are compiled into the binary, there is nothing to download.
+	var wasmBytes []byte
+	if !desc.InProcess() {
+		log.Debug("Downloading module bytes", lctx.Str("uri", uri))
+
+		var err error
+		wasmBytes, err = l.d.DownloadBytes(ctx, uri, Integrity{SHA256: desc.SHA256, Signature: desc.Signature})
+		if err != nil {
+			l.log.Error("Could not read module", lctx.Err(err))
+			return
+		}
+
+		log.Debug("Module downloaded", lctx.Int("bytes", len(wasmBytes)))
+	}
 
 	l.ui.CreateModule(name, pos.Vertical, pos.Horizontal)
 
 	log.Debug("Module created", lctx.Str("module", name))
 
-	go func() {
-		instance, err := l.runner.Load(ctx, name, wasmBytes, desc.Config)
-		if err != nil {
-			log.Error("Could not load module", lctx.Err(err))
-			return
-		}
-		defer func() {
-			_ = instance.Close(context.WithoutCancel(ctx))
-		}()
+	desc.Name = name
+	l.start(ctx, desc, wasmBytes)
+}
+
+// Replace replaces the plugin of the module described by desc with one
+// running wasmBytes, keeping its container, or loads the module if it is
+// not loaded. It swaps in a module rebuilt from source.
+func (l *Loader) Replace(ctx context.Context, desc Descriptor, wasmBytes []byte) error {
+	desc.Name = moduleName(desc.Name)
+	if err := l.stopOrCreate(ctx, desc); err != nil {
+		return err
+	}
+
+	l.start(ctx, desc, wasmBytes)
+	return nil
+}
+
+// Fail stops the plugin of the module described by desc, keeping its
+// container, and shows err in its place, e.g. the errors of a failed
+// build. The module is loaded as failed if it is not loaded.
+func (l *Loader) Fail(ctx context.Context, desc Descriptor, err error) error {
+	desc.Name = moduleName(desc.Name)
+	if stopErr := l.stopOrCreate(ctx, desc); stopErr != nil {
+		return stopErr
+	}
 
-		l.log.Info("Starting module", lctx.Str("module", name))
+	desc.Restart = RestartPolicy{Policy: RestartNever}
+	l.supervise(ctx, desc.Name, newSupervisor(desc.Name, desc.Restart, func(context.Context) (PluginInstance, error) {
+		return nil, err
+	}, l.log))
 
-		if runErr := instance.Run(ctx); runErr != nil && ctx.Err() == nil {
-			l.log.Error("Plugin run error", lctx.Str("module", name), lctx.Err(runErr))
+	if pusher := l.ui.ModuleUI(desc.Name); pusher != nil {
+		return pusher.Update(errorWidget(err))
+	}
+	return nil
+}
+
+// errorWidget returns a widget showing the lines of err.
+func errorWidget(err error) client.Widget {
+	lines := strings.Split(strings.TrimRight(err.Error(), "\n"), "\n")
+	stack := &client.VStack{Children: make([]client.Widget, 0, len(lines))}
+	for _, line := range lines {
+		stack.Children = append(stack.Children, &client.Text{Content: line, Color: "#e5534b", FontSize: 14})
+	}
+	return stack
+}
+
+// stopOrCreate stops the plugin of the module described by desc, keeping
+// its container, or creates the container if the module is not loaded.
+func (l *Loader) stopOrCreate(ctx context.Context, desc Descriptor) error {
+	ok, err := l.stop(ctx, desc.Name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		l.ui.CreateModule(desc.Name, desc.Position.Vertical, desc.Position.Horizontal)
+	}
+	return nil
+}
+
+// start runs the plugin of the module described by desc in its container.
+func (l *Loader) start(ctx context.Context, desc Descriptor, wasmBytes []byte) {
+	// The wasm bytes are kept for restarts, so the runner can reuse the
+	// module it already compiled for them.
+	l.supervise(ctx, desc.Name, newSupervisor(desc.Name, desc.Restart, func(ctx context.Context) (PluginInstance, error) {
+		inst, err := l.runner.Load(ctx, desc, wasmBytes)
+		if isPermanent(err) {
+			// The module will not be restarted, the error is shown in its place.
+			if pusher := l.ui.ModuleUI(desc.Name); pusher != nil {
+				_ = pusher.Update(errorWidget(err))
+			}
 		}
+		return inst, err
+	}, l.log))
+}
+
+func (l *Loader) supervise(ctx context.Context, name string, sup *supervisor) {
+	sup.clock = l.clock
+
+	ctx, cancel := context.WithCancel(ctx)
+	mod := &loadedModule{sup: sup, cancel: cancel, done: make(chan struct{})}
+
+	l.mu.Lock()
+	l.mods[name] = mod
+	l.mu.Unlock()
+
+	go func() {
+		defer close(mod.done)
+
+		sup.run(ctx)
 	}()
 }
 
+// stop stops the plugin of the named module and waits for it to close,
+// reporting if the module was loaded.
+func (l *Loader) stop(ctx context.Context, name string) (bool, error) {
+	l.mu.Lock()
+	mod, ok := l.mods[name]
+	delete(l.mods, name)
+	l.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	mod.cancel()
+	select {
+	case <-mod.done:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// Status returns the status of all loaded modules, ordered by name.
+func (l *Loader) Status() []Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]Status, 0, len(l.mods))
+	for _, mod := range l.mods {
+		statuses = append(statuses, mod.sup.Status())
+	}
+	slices.SortFunc(statuses, func(a, b Status) int { return strings.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+// Unload stops the named module, waits for its plugin instance to close
+// and removes its container from the UI.
+func (l *Loader) Unload(ctx context.Context, name string) error {
+	name = moduleName(name)
+
+	l.log.Info("Stopping module", lctx.Str("module", name))
+
+	ok, err := l.stop(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("module %q is not loaded", name)
+	}
+
+	if mover, ok := l.ui.(UIMover); ok {
+		mover.RemoveModule(name)
+	}
+	return nil
+}
+
+// Move moves the named module to a new position, keeping it running.
+// The module is not moved when the UI cannot move module containers.
+func (l *Loader) Move(name string, pos Position) {
+	name = moduleName(name)
+
+	mover, ok := l.ui.(UIMover)
+	if !ok {
+		l.log.Warn("UI cannot move modules, restart to apply the position", lctx.Str("module", name))
+		return
+	}
+	mover.MoveModule(name, pos.Vertical, pos.Horizontal)
+}
+
 // Close closes the Loader and releases its underlying runner resources.
 func (l *Loader) Close(ctx context.Context) error {
 	return l.runner.Close(ctx)
 }
+
+func moduleName(name string) string {
+	return strings.ReplaceAll(name, " ", "_")
+}
@@ -3,8 +3,10 @@ package module_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/glasslabs/client-go"
 	"github.com/glasslabs/looking-glass/module"
 	"github.com/hamba/logger/v2"
 	"github.com/hamba/testutils/retry"
@@ -93,9 +95,99 @@ func TestDescriptor_Validate(t *testing.T) {
 			wantErr: "test@modile: module names may only contain letters, numbers, '-' and '_'",
 		},
 		{
-			name:    "handles no path",
+			name:    "valid path descriptor",
+			desc:    module.Descriptor{Name: "test-module", Path: "github.com/glasslabs/clock", Version: "v1.0.0"},
+			wantErr: "",
+		},
+		{
+			name:    "valid go module descriptor",
+			desc:    module.Descriptor{Name: "test-module", URI: "go://clock"},
+			wantErr: "",
+		},
+		{
+			name:    "handles no uri or path",
 			desc:    module.Descriptor{Name: "test-module", URI: ""},
-			wantErr: "test-module: module must have a URI",
+			wantErr: "test-module: module must have a URI or a path",
+		},
+		{
+			name:    "handles uri and path",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Path: "github.com/glasslabs/clock"},
+			wantErr: "test-module: module must have either a URI or a path, not both",
+		},
+		{
+			name:    "handles version with uri",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Version: "v1.0.0"},
+			wantErr: "test-module: module version can only be used with a path",
+		},
+		{
+			name:    "handles invalid sha256",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", SHA256: "abc"},
+			wantErr: "test-module: module sha256 must be a hex encoded SHA-256 digest",
+		},
+		{
+			name:    "handles invalid restart policy",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Restart: module.RestartPolicy{Policy: "test"}},
+			wantErr: `test-module: invalid restart policy "test"`,
+		},
+		{
+			name:    "handles invalid permissions",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Permissions: &module.Permissions{MaxStreams: -1}},
+			wantErr: "test-module: permissions: max streams must be greater than or equal to zero",
+		},
+		{
+			name:    "handles invalid limits",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Limits: module.Limits{Watchdog: -1}},
+			wantErr: "test-module: limits: watchdog must be greater than or equal to zero",
+		},
+		{
+			name:    "handles invalid http config",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", HTTP: module.HTTPConfig{Proxy: "proxy"}},
+			wantErr: `test-module: http: invalid proxy url "proxy"`,
+		},
+		{
+			name:    "handles empty secret name",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Secrets: []string{""}},
+			wantErr: "test-module: secret names must not be empty",
+		},
+		{
+			name:    "handles unknown runtime",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Runtime: "jvm"},
+			wantErr: `test-module: unknown module runtime "jvm"`,
+		},
+		{
+			name:    "handles invalid interval",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Runtime: module.RuntimeExtism, Interval: -1},
+			wantErr: "test-module: module interval must be greater than or equal to zero",
+		},
+		{
+			name:    "handles go module with another runtime",
+			desc:    module.Descriptor{Name: "test-module", URI: "go://test", Runtime: module.RuntimeExtism},
+			wantErr: "test-module: go modules cannot use the extism runtime",
+		},
+		{
+			name:    "valid pinned remote native module",
+			desc:    module.Descriptor{Name: "test-module", URI: "https://example.com/mod", Runtime: module.RuntimeNative, SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			wantErr: "",
+		},
+		{
+			name:    "valid local native module",
+			desc:    module.Descriptor{Name: "test-module", URI: "file:///opt/mod", Runtime: module.RuntimeNative},
+			wantErr: "",
+		},
+		{
+			name:    "handles unpinned remote native module",
+			desc:    module.Descriptor{Name: "test-module", URI: "https://example.com/mod", Runtime: module.RuntimeNative},
+			wantErr: "test-module: remote native modules must have a sha256 or a signature",
+		},
+		{
+			name:    "handles unpinned native module path",
+			desc:    module.Descriptor{Name: "test-module", Path: "github.com/glasslabs/gpio", Runtime: module.RuntimeNative},
+			wantErr: "test-module: remote native modules must have a sha256 or a signature",
+		},
+		{
+			name:    "handles go runtime without go module",
+			desc:    module.Descriptor{Name: "test-module", URI: "test", Runtime: module.RuntimeGo},
+			wantErr: "test-module: the go runtime needs a go:// module URI",
 		},
 	}
 
@@ -128,7 +220,7 @@ func TestLoader_Load(t *testing.T) {
 	inst.On("Close", mock.Anything).Maybe().Return(nil)
 
 	runner := &mockRunner{}
-	runner.On("Load", mock.Anything, "test", mock.AnythingOfType("[]uint8"), mock.Anything).
+	runner.On("Load", mock.Anything, mock.MatchedBy(descriptorNamed("test")), mock.AnythingOfType("[]uint8")).
 		Once().Return(inst, nil)
 
 	d, err := module.NewDownloader("./testdata", log)
@@ -179,12 +271,220 @@ func TestLoader_LoadWithWazeroIntegration(t *testing.T) {
 	})
 }
 
+func TestLoader_Unload(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	ui := &mockUIProvider{}
+	ui.On("CreateModule", "test", "top", "right").Once()
+	ui.On("RemoveModule", "test").Once()
+
+	inst := &mockPluginInstance{}
+	inst.On("Run", mock.Anything).Once().Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil)
+	inst.On("Close", mock.Anything).Once().Return(nil)
+
+	runner := &mockRunner{}
+	runner.On("Load", mock.Anything, mock.MatchedBy(descriptorNamed("test")), mock.AnythingOfType("[]uint8")).
+		Once().Return(inst, nil)
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(ui, d, runner, log)
+	require.NoError(t, err)
+
+	desc := module.Descriptor{
+		Name:     "test",
+		URI:      "minimal.wasm",
+		Position: module.Position{Vertical: module.Top, Horizontal: module.Right},
+	}
+	loader.Load(t.Context(), desc)
+
+	retry.Run(t, func(t *retry.SubT) {
+		inst.AssertCalled(t, "Run", mock.Anything)
+	})
+	status := loader.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, "test", status[0].Name)
+	assert.Equal(t, module.StateRunning, status[0].State)
+
+	err = loader.Unload(t.Context(), "test")
+
+	require.NoError(t, err)
+	ui.AssertExpectations(t)
+	inst.AssertExpectations(t)
+}
+
+func TestLoader_UnloadHandlesUnknownModule(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(&mockUIProvider{}, d, &mockRunner{}, log)
+	require.NoError(t, err)
+
+	err = loader.Unload(t.Context(), "test")
+
+	assert.EqualError(t, err, `module "test" is not loaded`)
+}
+
+func TestLoader_Move(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+
+	ui := &mockUIProvider{}
+	ui.On("MoveModule", "test", "bottom", "left").Once()
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(ui, d, &mockRunner{}, log)
+	require.NoError(t, err)
+
+	loader.Move("test", module.Position{Vertical: module.Bottom, Horizontal: module.Left})
+
+	ui.AssertExpectations(t)
+}
+
+func TestLoader_Replace(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+
+	ui := &mockUIProvider{}
+	ui.On("CreateModule", "test", "top", "right").Once()
+
+	oldInst := &mockPluginInstance{}
+	oldInst.On("Run", mock.Anything).Once().Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil)
+	oldInst.On("Close", mock.Anything).Once().Return(nil)
+	newInst := &mockPluginInstance{}
+	newInst.On("Run", mock.Anything).Once().Return(nil)
+	newInst.On("Close", mock.Anything).Once().Return(nil)
+
+	runner := &mockRunner{}
+	runner.On("Load", mock.Anything, mock.MatchedBy(descriptorNamed("test")), []byte("old")).
+		Once().Return(oldInst, nil)
+	runner.On("Load", mock.Anything, mock.MatchedBy(descriptorNamed("test")), []byte("new")).
+		Once().Return(newInst, nil)
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(ui, d, runner, log)
+	require.NoError(t, err)
+
+	desc := module.Descriptor{
+		Name:     "test",
+		Position: module.Position{Vertical: module.Top, Horizontal: module.Right},
+		Restart:  module.RestartPolicy{Policy: module.RestartNever},
+	}
+	require.NoError(t, loader.Replace(t.Context(), desc, []byte("old")))
+	retry.Run(t, func(t *retry.SubT) {
+		oldInst.AssertCalled(t, "Run", mock.Anything)
+	})
+
+	err = loader.Replace(t.Context(), desc, []byte("new"))
+
+	require.NoError(t, err)
+	retry.Run(t, func(t *retry.SubT) {
+		ui.AssertExpectations(t)
+		oldInst.AssertExpectations(t)
+		newInst.AssertExpectations(t)
+		runner.AssertExpectations(t)
+	})
+}
+
+func TestLoader_Fail(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+
+	updater := &mockWidgetUpdater{}
+	updater.On("Update", mock.MatchedBy(func(w client.Widget) bool {
+		stack, ok := w.(*client.VStack)
+		return ok && len(stack.Children) == 2 && stack.Children[1].(*client.Text).Content == "main.go:3:1: syntax error"
+	})).Once().Return(nil)
+
+	ui := &mockUIProvider{}
+	ui.On("CreateModule", "test", "top", "right").Once()
+	ui.On("ModuleUI", "test").Once().Return(updater)
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(ui, d, &mockRunner{}, log)
+	require.NoError(t, err)
+
+	desc := module.Descriptor{
+		Name:     "test",
+		Position: module.Position{Vertical: module.Top, Horizontal: module.Right},
+	}
+	err = loader.Fail(t.Context(), desc, errors.New("# example.com/clock\nmain.go:3:1: syntax error"))
+
+	require.NoError(t, err)
+	ui.AssertExpectations(t)
+	updater.AssertExpectations(t)
+	retry.Run(t, func(t *retry.SubT) {
+		status := loader.Status()
+		require.Len(t, status, 1)
+		assert.Equal(t, module.StateFailed, status[0].State)
+	})
+}
+
+func TestLoader_MoveHandlesUIWithoutMover(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	d, err := module.NewDownloader("./testdata", log)
+	require.NoError(t, err)
+
+	loader, err := module.NewWithRunner(staticUI{}, d, &mockRunner{}, log)
+	require.NoError(t, err)
+
+	loader.Move("test", module.Position{Vertical: module.Bottom, Horizontal: module.Left})
+
+	assert.Contains(t, buf.String(), `msg="UI cannot move modules, restart to apply the position" module=test`)
+}
+
+// staticUI is a UI that cannot remove or move module containers.
+type staticUI struct{}
+
+func (staticUI) CreateModule(_, _, _ string) {}
+
+func (staticUI) ModuleUI(_ string) module.WidgetUpdater { return nil }
+
+type mockWidgetUpdater struct{ mock.Mock }
+
+func (m *mockWidgetUpdater) Update(w client.Widget) error {
+	return m.Called(w).Error(0)
+}
+
 type mockUIProvider struct{ mock.Mock }
 
 func (m *mockUIProvider) CreateModule(name, vert, horiz string) {
 	m.Called(name, vert, horiz)
 }
 
+func (m *mockUIProvider) RemoveModule(name string) {
+	m.Called(name)
+}
+
+func (m *mockUIProvider) MoveModule(name, vert, horiz string) {
+	m.Called(name, vert, horiz)
+}
+
 func (m *mockUIProvider) ModuleUI(name string) module.WidgetUpdater {
 	args := m.Called(name)
 	if v := args.Get(0); v != nil {
@@ -195,13 +495,17 @@ func (m *mockUIProvider) ModuleUI(name string) module.WidgetUpdater {
 
 type mockRunner struct{ mock.Mock }
 
-func (m *mockRunner) Load(ctx context.Context, name string, wasmBytes []byte, cfg map[string]any) (module.PluginInstance, error) {
-	args := m.Called(ctx, name, wasmBytes, cfg)
+func (m *mockRunner) Load(ctx context.Context, desc module.Descriptor, wasmBytes []byte) (module.PluginInstance, error) {
+	args := m.Called(ctx, desc, wasmBytes)
 	return args.Get(0).(module.PluginInstance), args.Error(1)
 }
 
 func (m *mockRunner) Close(context.Context) error { return nil }
 
+func descriptorNamed(name string) func(module.Descriptor) bool {
+	return func(desc module.Descriptor) bool { return desc.Name == name }
+}
+
 type mockPluginInstance struct{ mock.Mock }
 
 func (m *mockPluginInstance) Setup(ctx context.Context, cfg map[string]any) error {
@@ -0,0 +1,435 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	// mqttSubscribeQoS is the QoS of broker subscriptions.
+	mqttSubscribeQoS = 1
+
+	mqttConnectTimeout    = 10 * time.Second
+	mqttDisconnectQuiesce = 250 // milliseconds
+)
+
+// MQTTConfig configures the MQTT brokers modules may connect to.
+type MQTTConfig struct {
+	Brokers []MQTTBroker `yaml:"brokers"`
+}
+
+// MQTTBroker configures an MQTT broker.
+type MQTTBroker struct {
+	// Name is the name modules connect to the broker by.
+	Name string `yaml:"name"`
+	// URL is the URL of the broker, e.g. tcp://localhost:1883.
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// ClientID is the client ID of the connection. The broker assigns
+	// a client ID if it is empty.
+	ClientID string `yaml:"clientId"`
+}
+
+// Validate validates the MQTT configuration.
+func (c MQTTConfig) Validate() error {
+	names := map[string]bool{}
+	urls := map[string]bool{}
+	for _, b := range c.Brokers {
+		if b.Name == "" {
+			return errors.New("config: an mqtt broker must have a name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("config: mqtt broker name %q is a duplicate. broker names must be unique", b.Name)
+		}
+		names[b.Name] = true
+
+		u, err := url.Parse(b.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("config: mqtt broker %q must have a valid url", b.Name)
+		}
+		if urls[b.URL] {
+			return fmt.Errorf("config: mqtt broker url %q is used by more than one broker", u.Redacted())
+		}
+		urls[b.URL] = true
+	}
+	return nil
+}
+
+// mqttBroker manages the connection to an MQTT broker shared by all
+// modules. The broker is connected while a module holds a reference to it.
+type mqttBroker struct {
+	cfg MQTTBroker
+	log *logger.Logger
+
+	// mu guards the connection, and serializes subscription changes.
+	mu     sync.Mutex
+	client mqtt.Client
+	refs   int
+
+	subsMu  sync.Mutex
+	filters map[string]map[*subscription]struct{}
+}
+
+func newMQTTBroker(cfg MQTTBroker, log *logger.Logger) *mqttBroker {
+	return &mqttBroker{
+		cfg:     cfg,
+		log:     log,
+		filters: map[string]map[*subscription]struct{}{},
+	}
+}
+
+// newMQTTBrokers returns the configured brokers by name.
+func newMQTTBrokers(cfg MQTTConfig, log *logger.Logger) map[string]*mqttBroker {
+	brokers := make(map[string]*mqttBroker, len(cfg.Brokers))
+	for _, b := range cfg.Brokers {
+		brokers[b.Name] = newMQTTBroker(b, log)
+	}
+	return brokers
+}
+
+// acquire takes a reference to the broker, connecting to it if this is
+// the first reference.
+func (b *mqttBroker) acquire(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refs == 0 {
+		opts := mqtt.NewClientOptions().
+			AddBroker(b.cfg.URL).
+			SetClientID(b.cfg.ClientID).
+			SetUsername(b.cfg.Username).
+			SetPassword(b.cfg.Password).
+			SetConnectTimeout(mqttConnectTimeout).
+			SetOnConnectHandler(b.resubscribe)
+		client := mqtt.NewClient(opts)
+		if err := waitToken(ctx, client.Connect()); err != nil {
+			client.Disconnect(0)
+			return err
+		}
+		b.client = client
+	}
+	b.refs++
+	return nil
+}
+
+// release releases a reference to the broker, disconnecting from it if
+// this was the last reference.
+func (b *mqttBroker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.releaseLocked()
+}
+
+func (b *mqttBroker) releaseLocked() {
+	b.refs--
+	if b.refs == 0 {
+		b.client.Disconnect(mqttDisconnectQuiesce)
+		b.client = nil
+	}
+}
+
+// resubscribe restores the broker subscriptions after a reconnect.
+func (b *mqttBroker) resubscribe(client mqtt.Client) {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+
+	for filter := range b.filters {
+		client.Subscribe(filter, mqttSubscribeQoS, b.handler(filter))
+	}
+}
+
+// subscribe subscribes to filter. The broker must be connected.
+//
+// Every subscription is made with the broker, so the broker sends its
+// retained messages to the new subscription as well as any existing
+// subscriptions to the same filter.
+func (b *mqttBroker) subscribe(ctx context.Context, filter string) (*subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := newSubscription(filter)
+	sub.unsubscribe = b.unsubscribe
+
+	b.subsMu.Lock()
+	subs, ok := b.filters[filter]
+	if !ok {
+		subs = map[*subscription]struct{}{}
+		b.filters[filter] = subs
+	}
+	subs[sub] = struct{}{}
+	b.subsMu.Unlock()
+
+	if err := waitToken(ctx, b.client.Subscribe(filter, mqttSubscribeQoS, b.handler(filter))); err != nil {
+		b.remove(sub)
+		return nil, err
+	}
+	b.refs++
+	return sub, nil
+}
+
+func (b *mqttBroker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.remove(sub) {
+		b.client.Unsubscribe(sub.topic)
+	}
+	b.releaseLocked()
+}
+
+// remove removes sub, reporting whether it was the last subscription
+// to its filter.
+func (b *mqttBroker) remove(sub *subscription) bool {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+
+	subs := b.filters[sub.topic]
+	delete(subs, sub)
+	if len(subs) > 0 {
+		return false
+	}
+	delete(b.filters, sub.topic)
+	return true
+}
+
+// handler returns the message handler for filter, delivering messages as
+// the topic and payload separated by a null byte.
+func (b *mqttBroker) handler(filter string) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		data := make([]byte, 0, len(msg.Topic())+1+len(msg.Payload()))
+		data = append(data, msg.Topic()...)
+		data = append(data, 0)
+		data = append(data, msg.Payload()...)
+
+		b.subsMu.Lock()
+		var dropped int
+		for sub := range b.filters[filter] {
+			if !sub.deliver(data) {
+				dropped++
+			}
+		}
+		b.subsMu.Unlock()
+
+		if dropped > 0 {
+			b.log.Warn("mqtt: subscribers are not keeping up, dropped oldest messages",
+				lctx.Str("broker", b.cfg.Name), lctx.Str("topic", msg.Topic()), lctx.Int("subscribers", dropped))
+		}
+	}
+}
+
+// publish publishes msg to topic.
+func (b *mqttBroker) publish(ctx context.Context, topic string, qos byte, retain bool, msg []byte) error {
+	b.mu.Lock()
+	client := b.client
+	b.mu.Unlock()
+
+	return waitToken(ctx, client.Publish(topic, qos, retain, msg))
+}
+
+// waitToken waits for tok to complete or ctx to be done.
+func waitToken(ctx context.Context, tok mqtt.Token) error {
+	select {
+	case <-tok.Done():
+		return tok.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mqttConn is a module's reference to a broker.
+type mqttConn struct {
+	broker *mqttBroker
+}
+
+func (c *mqttConn) close() {
+	c.broker.release()
+}
+
+// mqttSubscription is a module's subscription to a broker.
+type mqttSubscription struct {
+	*subscription
+}
+
+// mqttConnectFunc connects to a configured broker and returns a handle
+// for it.
+func mqttConnectFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		namePtr := uint32(stack[0])
+		nameLen := uint32(stack[1])
+
+		name, ok := mod.Memory().Read(namePtr, nameLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok || !menv.perms.allowsBroker(string(name)) {
+			env.log.Warn("mqtt_connect: broker not permitted", lctx.Str("module", mod.Name()), lctx.Str("broker", string(name)))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		broker, ok := env.brokers[string(name)]
+		if !ok {
+			env.log.Warn("mqtt_connect: unknown broker", lctx.Str("module", mod.Name()), lctx.Str("broker", string(name)))
+			stack[0] = errno(errnoNotFound)
+			return
+		}
+
+		if err := broker.acquire(ctx); err != nil {
+			env.log.Error("mqtt_connect: connection failed",
+				lctx.Str("module", mod.Name()), lctx.Str("broker", string(name)), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+
+		handle := menv.handles.add(&mqttConn{broker: broker})
+		stack[0] = uint64(handle)
+	}
+}
+
+// mqttSubscribeFunc subscribes to a topic filter on a broker and returns
+// a handle for reading its messages.
+func mqttSubscribeFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		filterPtr := uint32(stack[1])
+		filterLen := uint32(stack[2])
+
+		filter, ok := mod.Memory().Read(filterPtr, filterLen)
+		if !ok || filterLen == 0 {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		conn, ok := getHandle[*mqttConn](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		sub, err := conn.broker.subscribe(ctx, string(filter))
+		if err != nil {
+			env.log.Error("mqtt_subscribe: subscription failed",
+				lctx.Str("module", mod.Name()), lctx.Str("filter", string(filter)), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+
+		stack[0] = uint64(menv.handles.add(&mqttSubscription{subscription: sub}))
+	}
+}
+
+// mqttRecvFunc reads the next message of a subscription into the plugin
+// buffer. Blocks until a message is received.
+func mqttRecvFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		bufPtr := uint32(stack[1])
+		bufLen := uint32(stack[2])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		sub, ok := getHandle[*mqttSubscription](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		msg, ok := sub.next(ctx)
+		if !ok {
+			stack[0] = errno(errnoIO)
+			return
+		}
+
+		// A message that does not fit is kept for the next call.
+		sub.pending = nil
+		if len(msg) > int(bufLen) {
+			sub.pending = msg
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, msg)
+	}
+}
+
+// mqttPublishFunc publishes a message to a broker.
+func mqttPublishFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		topicPtr := uint32(stack[1])
+		topicLen := uint32(stack[2])
+		msgPtr := uint32(stack[3])
+		msgLen := uint32(stack[4])
+		qos := uint32(stack[5])
+		retain := uint32(stack[6]) != 0
+
+		topic, ok := mod.Memory().Read(topicPtr, topicLen)
+		if !ok || topicLen == 0 || qos > 2 || strings.ContainsAny(string(topic), "+#") {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		msg, ok := mod.Memory().Read(msgPtr, msgLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		conn, ok := getHandle[*mqttConn](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		if err := conn.broker.publish(ctx, string(topic), byte(qos), retain, msg); err != nil {
+			env.log.Error("mqtt_publish: publish failed",
+				lctx.Str("module", mod.Name()), lctx.Str("topic", string(topic)), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+		stack[0] = 0
+	}
+}
+
+// mqttCloseFunc closes a broker connection or subscription and releases
+// the handle.
+func mqttCloseFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			return
+		}
+		if conn, ok := removeHandle[*mqttConn](menv.handles, handle); ok {
+			conn.close()
+			return
+		}
+		if sub, ok := removeHandle[*mqttSubscription](menv.handles, handle); ok {
+			sub.close()
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package module
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/hamba/logger/v2"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     MQTTConfig
+		wantErr string
+	}{
+		{
+			name: "valid config",
+			cfg: MQTTConfig{Brokers: []MQTTBroker{
+				{Name: "home", URL: "tcp://localhost:1883"},
+				{Name: "work", URL: "ssl://example.com:8883"},
+			}},
+		},
+		{
+			name:    "handles no name",
+			cfg:     MQTTConfig{Brokers: []MQTTBroker{{URL: "tcp://localhost:1883"}}},
+			wantErr: "config: an mqtt broker must have a name",
+		},
+		{
+			name:    "handles invalid url",
+			cfg:     MQTTConfig{Brokers: []MQTTBroker{{Name: "home", URL: "localhost"}}},
+			wantErr: `config: mqtt broker "home" must have a valid url`,
+		},
+		{
+			name: "handles duplicate name",
+			cfg: MQTTConfig{Brokers: []MQTTBroker{
+				{Name: "home", URL: "tcp://localhost:1883"},
+				{Name: "home", URL: "tcp://localhost:1884"},
+			}},
+			wantErr: `config: mqtt broker name "home" is a duplicate. broker names must be unique`,
+		},
+		{
+			name: "handles duplicate url",
+			cfg: MQTTConfig{Brokers: []MQTTBroker{
+				{Name: "home", URL: "tcp://localhost:1883"},
+				{Name: "other", URL: "tcp://localhost:1883"},
+			}},
+			wantErr: `config: mqtt broker url "tcp://localhost:1883" is used by more than one broker`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMQTTHostFuncs(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	env.brokers = newMQTTBrokers(MQTTConfig{Brokers: []MQTTBroker{
+		{Name: "home", URL: newTestBroker(t), Username: "mirror", Password: "secret"},
+	}}, log)
+	subEnv := mustRegister(t, env, Descriptor{Name: "weather"})
+	t.Cleanup(func() { env.unregister(subEnv) })
+	pubEnv := mustRegister(t, env, Descriptor{Name: "sensors"})
+	t.Cleanup(func() { env.unregister(pubEnv) })
+	sub := newMemModule("weather")
+	pub := newMemModule("sensors")
+
+	stack := sub.call("home")
+	mqttConnectFunc(env)(t.Context(), sub, stack)
+	subConn := stack[0]
+	require.Positive(t, int32(subConn))
+
+	stack = pub.call("home")
+	mqttConnectFunc(env)(t.Context(), pub, stack)
+	pubConn := stack[0]
+	require.Positive(t, int32(pubConn))
+
+	broker := env.brokers["home"]
+	assert.Equal(t, 2, broker.refs, "shares the connection")
+
+	stack = append([]uint64{subConn}, sub.call("sensors/+")...)
+	mqttSubscribeFunc(env)(t.Context(), sub, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = append([]uint64{pubConn}, pub.call("sensors/temp", "21")...)
+	stack = append(stack, 1, 0)
+	mqttPublishFunc(env)(t.Context(), pub, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = []uint64{handle, resultOffset, 3}
+	mqttRecvFunc(env)(t.Context(), sub, stack)
+	assert.Equal(t, uint64(15), stack[0], "returns the length when the buffer is too small")
+
+	stack = []uint64{handle, resultOffset, 32}
+	mqttRecvFunc(env)(t.Context(), sub, stack)
+	require.Equal(t, uint64(15), stack[0])
+	assert.Equal(t, "sensors/temp\x0021", sub.result(stack[0]))
+
+	mqttCloseFunc(env)(t.Context(), sub, []uint64{subConn})
+	mqttCloseFunc(env)(t.Context(), pub, []uint64{pubConn})
+	assert.Equal(t, 1, broker.refs, "the subscription keeps the connection")
+
+	mqttCloseFunc(env)(t.Context(), sub, []uint64{handle})
+	assert.Equal(t, 0, broker.refs)
+	assert.Nil(t, broker.client)
+	assert.Empty(t, broker.filters)
+}
+
+func TestMQTTSubscribe_ReceivesRetainedMessage(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	env.brokers = newMQTTBrokers(MQTTConfig{Brokers: []MQTTBroker{
+		{Name: "home", URL: newTestBroker(t), Username: "mirror", Password: "secret"},
+	}}, log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("home")
+	mqttConnectFunc(env)(t.Context(), mod, stack)
+	conn := stack[0]
+	require.Positive(t, int32(conn))
+
+	stack = append([]uint64{conn}, mod.call("sensors/temp", "21")...)
+	stack = append(stack, 1, 1)
+	mqttPublishFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = append([]uint64{conn}, mod.call("sensors/#")...)
+	mqttSubscribeFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = []uint64{handle, resultOffset, 32}
+	mqttRecvFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(15), stack[0])
+	assert.Equal(t, "sensors/temp\x0021", mod.result(stack[0]))
+
+	env.unregister(menv)
+
+	assert.Equal(t, 0, env.brokers["home"].refs)
+}
+
+func TestMQTTConnect_HandlesErrors(t *testing.T) {
+	t.Parallel()
+
+	url := newTestBroker(t)
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	env.brokers = newMQTTBrokers(MQTTConfig{Brokers: []MQTTBroker{
+		{Name: "home", URL: url, Username: "mirror", Password: "wrong"},
+		{Name: "work", URL: "tcp://example.com:1883"},
+	}}, log)
+	menv := mustRegister(t, env, Descriptor{
+		Name:        "test",
+		Permissions: &Permissions{MQTT: []string{"home", "other"}},
+	})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("work")
+	mqttConnectFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoPermission, int32(stack[0]))
+	assert.Contains(t, buf.String(), `msg="mqtt_connect: broker not permitted" module=test broker=work`)
+
+	stack = mod.call("other")
+	mqttConnectFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoNotFound, int32(stack[0]))
+
+	stack = mod.call("home")
+	mqttConnectFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoIO, int32(stack[0]))
+	assert.Equal(t, 0, env.brokers["home"].refs)
+}
+
+// newTestBroker starts an MQTT broker accepting the user "mirror" with the
+// password "secret", and returns its URL.
+func newTestBroker(t *testing.T) string {
+	t.Helper()
+
+	srv := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	err := srv.AddHook(new(auth.Hook), &auth.Options{
+		Ledger: &auth.Ledger{Auth: auth.AuthRules{{Username: "mirror", Password: "secret", Allow: true}}},
+	})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, srv.AddListener(listeners.NewNet("test", ln)))
+	require.NoError(t, srv.Serve())
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return "tcp://" + ln.Addr().String()
+}
@@ -0,0 +1,218 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Permissions describes the capabilities granted to a module.
+// A module without permissions is granted all capabilities; once
+// permissions are given, only what they grant is allowed.
+type Permissions struct {
+	HTTP HTTPPermissions `yaml:"http"`
+	Bus  BusPermissions  `yaml:"bus"`
+	// MQTT are the names of the MQTT brokers the module may connect to.
+	MQTT []string `yaml:"mqtt"`
+	// Assets controls whether the assets directory is mounted.
+	Assets bool `yaml:"assets"`
+	// Storage controls whether the key-value store may be used.
+	Storage bool `yaml:"storage"`
+	// MaxStreams is the maximum number of concurrently open HTTP streams
+	// and WebSocket connections.
+	// Zero means no limit.
+	MaxStreams int `yaml:"maxStreams"`
+}
+
+// HTTPPermissions describes the HTTP requests a module may make.
+type HTTPPermissions struct {
+	// Hosts are the allowed hosts. A host may be prefixed with "*." to
+	// allow all of its subdomains.
+	Hosts []string `yaml:"hosts"`
+	// URLs are the allowed URL prefixes.
+	URLs []string `yaml:"urls"`
+	// Methods are the allowed HTTP methods. All methods are allowed if empty.
+	Methods []string `yaml:"methods"`
+}
+
+// BusPermissions describes the message bus topics a module may use.
+// Topics are matched with path.Match, so "weather/*" matches "weather/current".
+type BusPermissions struct {
+	// Publish are the topics the module may publish to.
+	Publish []string `yaml:"publish"`
+	// Subscribe are the topics the module may subscribe to.
+	Subscribe []string `yaml:"subscribe"`
+}
+
+// Validate validates the permissions.
+func (p *Permissions) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	if p.MaxStreams < 0 {
+		return errors.New("permissions: max streams must be greater than or equal to zero")
+	}
+	for _, prefix := range p.HTTP.URLs {
+		u, err := url.Parse(prefix)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("permissions: invalid url prefix %q", prefix)
+		}
+	}
+	for _, pattern := range slices.Concat(p.Bus.Publish, p.Bus.Subscribe) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("permissions: invalid bus topic %q", pattern)
+		}
+	}
+	return nil
+}
+
+// allowsAssets reports whether the assets directory may be mounted.
+func (p *Permissions) allowsAssets() bool {
+	return p == nil || p.Assets
+}
+
+// allowsStorage reports whether the key-value store may be used.
+func (p *Permissions) allowsStorage() bool {
+	return p == nil || p.Storage
+}
+
+// allowsBroker reports whether the module may connect to the named MQTT broker.
+func (p *Permissions) allowsBroker(name string) bool {
+	return p == nil || slices.Contains(p.MQTT, name)
+}
+
+// allowsPublish reports whether the module may publish to topic.
+func (p *Permissions) allowsPublish(topic string) bool {
+	return p == nil || matchTopic(p.Bus.Publish, topic)
+}
+
+// allowsSubscribe reports whether the module may subscribe to topic.
+func (p *Permissions) allowsSubscribe(topic string) bool {
+	return p == nil || matchTopic(p.Bus.Subscribe, topic)
+}
+
+// missing returns the permissions of req that p does not grant, e.g. the
+// permissions a module requests in its manifest that its configuration
+// does not grant it.
+func (p *Permissions) missing(req *Permissions) []string {
+	if p == nil || req == nil {
+		return nil
+	}
+
+	var missing []string
+	methods := req.HTTP.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	for _, h := range req.HTTP.Hosts {
+		if !p.allowsAll(methods, &url.URL{Scheme: "https", Host: h, Path: "/"}) {
+			missing = append(missing, "http host "+h)
+		}
+	}
+	for _, prefix := range req.HTTP.URLs {
+		u, err := url.Parse(prefix)
+		if err != nil || !p.allowsAll(methods, u) {
+			missing = append(missing, "http url "+prefix)
+		}
+	}
+	for _, topic := range req.Bus.Publish {
+		if !p.allowsPublish(topic) {
+			missing = append(missing, "bus publish "+topic)
+		}
+	}
+	for _, topic := range req.Bus.Subscribe {
+		if !p.allowsSubscribe(topic) {
+			missing = append(missing, "bus subscribe "+topic)
+		}
+	}
+	for _, name := range req.MQTT {
+		if !p.allowsBroker(name) {
+			missing = append(missing, "mqtt "+name)
+		}
+	}
+	if req.Assets && !p.allowsAssets() {
+		missing = append(missing, "assets")
+	}
+	if req.Storage && !p.allowsStorage() {
+		missing = append(missing, "storage")
+	}
+	if p.MaxStreams > 0 && req.MaxStreams > p.MaxStreams {
+		missing = append(missing, "max streams "+strconv.Itoa(req.MaxStreams))
+	}
+	return missing
+}
+
+func (p *Permissions) allowsAll(methods []string, u *url.URL) bool {
+	return !slices.ContainsFunc(methods, func(m string) bool {
+		return !p.allowsRequest(m, u)
+	})
+}
+
+func matchTopic(patterns []string, topic string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, topic)
+		return ok
+	})
+}
+
+// allowsRequest reports whether a request with method to u is allowed.
+func (p *Permissions) allowsRequest(method string, u *url.URL) bool {
+	if p == nil {
+		return true
+	}
+
+	if len(p.HTTP.Methods) > 0 && !slices.ContainsFunc(p.HTTP.Methods, func(m string) bool {
+		return strings.EqualFold(m, method)
+	}) {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, h := range p.HTTP.Hosts {
+		h = strings.ToLower(h)
+		if suffix, ok := strings.CutPrefix(h, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if h == host || h == strings.ToLower(u.Host) {
+			return true
+		}
+	}
+
+	for _, prefix := range p.HTTP.URLs {
+		pu, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(pu.Scheme, u.Scheme) && strings.EqualFold(pu.Host, u.Host) && matchPathPrefix(pu.Path, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPrefix reports whether the path of u is prefix, or below it.
+// The path is cleaned first, so dot segments cannot climb out of prefix,
+// and paths with escaped dot segments are refused, as servers may not
+// agree on what they refer to.
+func matchPathPrefix(prefix string, u *url.URL) bool {
+	for seg := range strings.SplitSeq(u.EscapedPath(), "/") {
+		if strings.Contains(seg, "%") {
+			if dec, err := url.PathUnescape(seg); err != nil || dec == "." || dec == ".." {
+				return false
+			}
+		}
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	p := path.Clean("/" + u.Path)
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,299 @@
+package module
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissions_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		perms   *Permissions
+		wantErr string
+	}{
+		{
+			name:  "valid nil permissions",
+			perms: nil,
+		},
+		{
+			name: "valid permissions",
+			perms: &Permissions{
+				HTTP:       HTTPPermissions{Hosts: []string{"*.example.com"}, URLs: []string{"https://api.example.com/v1/"}},
+				MaxStreams: 2,
+			},
+		},
+		{
+			name:    "handles negative max streams",
+			perms:   &Permissions{MaxStreams: -1},
+			wantErr: "permissions: max streams must be greater than or equal to zero",
+		},
+		{
+			name:    "handles invalid bus topic",
+			perms:   &Permissions{Bus: BusPermissions{Publish: []string{"weather/["}}},
+			wantErr: `permissions: invalid bus topic "weather/["`,
+		},
+		{
+			name:    "handles url prefix without host",
+			perms:   &Permissions{HTTP: HTTPPermissions{URLs: []string{"/v1/"}}},
+			wantErr: `permissions: invalid url prefix "/v1/"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := test.perms.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPermissions_AllowsRequest(t *testing.T) {
+	t.Parallel()
+
+	perms := &Permissions{
+		HTTP: HTTPPermissions{
+			Hosts:   []string{"example.com", "*.example.org", "localhost:8080"},
+			URLs:    []string{"https://api.example.net/v1/"},
+			Methods: []string{"get", "POST"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		perms  *Permissions
+		method string
+		url    string
+		want   bool
+	}{
+		{
+			name:   "allows everything without permissions",
+			method: "DELETE",
+			url:    "https://anything.test/",
+			want:   true,
+		},
+		{
+			name:   "allows host",
+			perms:  perms,
+			method: "GET",
+			url:    "https://example.com/path",
+			want:   true,
+		},
+		{
+			name:   "allows host ignoring case",
+			perms:  perms,
+			method: "GET",
+			url:    "https://EXAMPLE.com/path",
+			want:   true,
+		},
+		{
+			name:   "allows host with port",
+			perms:  perms,
+			method: "GET",
+			url:    "http://localhost:8080/",
+			want:   true,
+		},
+		{
+			name:   "allows wildcard subdomain",
+			perms:  perms,
+			method: "GET",
+			url:    "https://a.b.example.org/",
+			want:   true,
+		},
+		{
+			name:   "denies wildcard apex",
+			perms:  perms,
+			method: "GET",
+			url:    "https://example.org/",
+			want:   false,
+		},
+		{
+			name:   "denies other host",
+			perms:  perms,
+			method: "GET",
+			url:    "https://example.net/",
+			want:   false,
+		},
+		{
+			name:   "allows url prefix",
+			perms:  perms,
+			method: "POST",
+			url:    "https://api.example.net/v1/items?a=b",
+			want:   true,
+		},
+		{
+			name:   "denies url outside prefix",
+			perms:  perms,
+			method: "GET",
+			url:    "https://api.example.net/v2/items",
+			want:   false,
+		},
+		{
+			name:   "allows url prefix without trailing slash",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api/items",
+			want:   true,
+		},
+		{
+			name:   "allows url prefix path",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api",
+			want:   true,
+		},
+		{
+			name:   "denies url sharing prefix without segment boundary",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/apiary",
+			want:   false,
+		},
+		{
+			name:   "denies url climbing out of prefix",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api/../admin",
+			want:   false,
+		},
+		{
+			name:   "denies url with escaped dot segments",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api/%2e%2e/admin",
+			want:   false,
+		},
+		{
+			name:   "denies url with escaped dot segment in prefix",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api/%2E./x/../items",
+			want:   false,
+		},
+		{
+			name:   "allows url with escaped characters",
+			perms:  &Permissions{HTTP: HTTPPermissions{URLs: []string{"https://api.example.net/api"}}},
+			method: "GET",
+			url:    "https://api.example.net/api/a%20b",
+			want:   true,
+		},
+		{
+			name:   "denies url prefix on other host",
+			perms:  perms,
+			method: "GET",
+			url:    "https://api.example.net.test/v1/items",
+			want:   false,
+		},
+		{
+			name:   "denies url prefix on other scheme",
+			perms:  perms,
+			method: "GET",
+			url:    "http://api.example.net/v1/items",
+			want:   false,
+		},
+		{
+			name:   "denies method",
+			perms:  perms,
+			method: "DELETE",
+			url:    "https://example.com/",
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(test.url)
+			assert.NoError(t, err)
+
+			got := test.perms.allowsRequest(test.method, u)
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestPermissions_Missing(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		granted *Permissions
+		req     *Permissions
+		want    []string
+	}{
+		{
+			name:    "handles all granted",
+			granted: nil,
+			req:     &Permissions{HTTP: HTTPPermissions{Hosts: []string{"api.example.com"}}, Storage: true},
+		},
+		{
+			name:    "handles nothing requested",
+			granted: &Permissions{},
+			req:     nil,
+		},
+		{
+			name: "handles granted permissions",
+			granted: &Permissions{
+				HTTP:       HTTPPermissions{Hosts: []string{"*.example.com"}, URLs: []string{"https://other.com/api/"}},
+				Bus:        BusPermissions{Publish: []string{"weather/*"}},
+				MQTT:       []string{"home"},
+				Storage:    true,
+				MaxStreams: 4,
+			},
+			req: &Permissions{
+				HTTP:       HTTPPermissions{Hosts: []string{"api.example.com"}, URLs: []string{"https://other.com/api/v1"}},
+				Bus:        BusPermissions{Publish: []string{"weather/current"}},
+				MQTT:       []string{"home"},
+				Storage:    true,
+				MaxStreams: 2,
+			},
+		},
+		{
+			name: "handles missing permissions",
+			granted: &Permissions{
+				HTTP:       HTTPPermissions{Hosts: []string{"api.example.com"}, Methods: []string{"GET"}},
+				MaxStreams: 1,
+			},
+			req: &Permissions{
+				HTTP:       HTTPPermissions{Hosts: []string{"api.example.com", "*.other.com"}, Methods: []string{"GET", "POST"}},
+				Bus:        BusPermissions{Publish: []string{"weather/current"}, Subscribe: []string{"calendar/*"}},
+				MQTT:       []string{"home"},
+				Assets:     true,
+				Storage:    true,
+				MaxStreams: 2,
+			},
+			want: []string{
+				"http host api.example.com",
+				"http host *.other.com",
+				"bus publish weather/current",
+				"bus subscribe calendar/*",
+				"mqtt home",
+				"assets",
+				"storage",
+				"max streams 2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := test.granted.missing(test.req)
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package module
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, process groups are not supported.
+func setProcessGroup(*exec.Cmd) {}
+
+// killProcessGroup kills p, as it cannot be asked to stop.
+func killProcessGroup(p *os.Process, _ bool) error {
+	return p.Kill()
+}
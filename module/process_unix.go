@@ -0,0 +1,25 @@
+//go:build unix
+
+package module
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so the
+// processes it starts can be stopped with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup asks the process group of p to stop, or kills it when
+// force is true.
+func killProcessGroup(p *os.Process, force bool) error {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-p.Pid, sig)
+}
@@ -0,0 +1,316 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+// Index types.
+const (
+	IndexGitHub = "github"
+	IndexJSON   = "json"
+)
+
+// VersionLatest is the version resolving to the latest release of a module.
+const VersionLatest = "latest"
+
+const (
+	defaultGitHubURL    = "https://github.com"
+	defaultGitHubAPIURL = "https://api.github.com"
+
+	pinsFile = "pins.json"
+)
+
+// IndexConfig configures how module paths and versions are resolved
+// to release artifacts.
+type IndexConfig struct {
+	// Type is the index type, either "github" or "json". Defaults to "github".
+	Type string `yaml:"type"`
+	// URL is the base URL release artifacts are downloaded from for "github"
+	// indexes, defaulting to https://github.com, or the URL of the index
+	// document for "json" indexes.
+	URL string `yaml:"url"`
+	// APIURL is the GitHub API URL used to find the latest release for
+	// "github" indexes. Defaults to https://api.github.com.
+	APIURL string `yaml:"apiUrl"`
+}
+
+// Validate validates the index configuration.
+func (c IndexConfig) Validate() error {
+	switch c.Type {
+	case "", IndexGitHub:
+	case IndexJSON:
+		if c.URL == "" {
+			return errors.New("config: a json index must have a url")
+		}
+	default:
+		return fmt.Errorf("config: unsupported index type %q", c.Type)
+	}
+	return nil
+}
+
+// jsonIndex is the document served by a "json" index.
+//
+// Example:
+//
+//	{
+//	  "modules": {
+//	    "github.com/glasslabs/clock": {
+//	      "latest": "v1.0.0",
+//	      "versions": {
+//	        "v1.0.0": {"url": "https://example.com/clock/v1.0.0/clock.wasm"}
+//	      }
+//	    }
+//	  }
+//	}
+type jsonIndex struct {
+	Modules map[string]jsonIndexModule `json:"modules"`
+}
+
+type jsonIndexModule struct {
+	Latest   string                      `json:"latest"`
+	Versions map[string]jsonIndexVersion `json:"versions"`
+}
+
+type jsonIndexVersion struct {
+	URL string `json:"url"`
+}
+
+// Resolve resolves a module path and version to the URI of its release
+// artifact. The "latest" version is pinned to the concrete version it
+// resolves to and its URI, which are used when the index cannot be reached.
+func (d *Downloader) Resolve(ctx context.Context, path, version string) (string, error) {
+	if version == "" {
+		version = VersionLatest
+	}
+
+	// A json index is fetched once, so the version and its URL are read
+	// from the same index.
+	index := sync.OnceValues(func() (jsonIndex, error) {
+		return d.fetchIndex(ctx)
+	})
+
+	var resolvedLatest bool
+	if version == VersionLatest {
+		v, err := d.latestVersion(ctx, path, index)
+		switch {
+		case err == nil:
+			resolvedLatest = true
+		default:
+			pinned, ok := d.pinned(path)
+			if !ok {
+				return "", fmt.Errorf("resolving latest version of %s: %w", path, err)
+			}
+
+			d.log.Warn("Could not resolve latest version, using pinned version",
+				lctx.Str("path", path), lctx.Str("version", pinned.Version), lctx.Err(err))
+
+			v = pinned.Version
+		}
+		version = v
+	}
+
+	d.log.Debug("Resolved module version", lctx.Str("path", path), lctx.Str("version", version))
+
+	uri, err := d.artifactURL(path, version, index)
+	if err != nil {
+		// A json index that cannot be reached is replaced by the URI
+		// pinned with the version.
+		if _, idxErr := index(); d.index.Type != IndexJSON || idxErr == nil {
+			return "", err
+		}
+		pinned, ok := d.pinned(path)
+		if !ok || pinned.Version != version || pinned.URL == "" {
+			return "", err
+		}
+
+		d.log.Warn("Could not fetch module index, using pinned url",
+			lctx.Str("path", path), lctx.Str("version", version), lctx.Err(err))
+
+		return pinned.URL, nil
+	}
+
+	if resolvedLatest {
+		if err = d.pin(path, modulePin{Version: version, URL: uri}); err != nil {
+			d.log.Warn("Could not pin module version", lctx.Str("path", path), lctx.Err(err))
+		}
+	}
+	return uri, nil
+}
+
+// artifactURL returns the URI of the release artifact of a module version.
+func (d *Downloader) artifactURL(path, version string, index func() (jsonIndex, error)) (string, error) {
+	switch d.index.Type {
+	case IndexJSON:
+		idx, err := index()
+		if err != nil {
+			return "", err
+		}
+		mod, ok := idx.Modules[path]
+		if !ok {
+			return "", fmt.Errorf("module %s not found in index", path)
+		}
+		ver, ok := mod.Versions[version]
+		if !ok || ver.URL == "" {
+			return "", fmt.Errorf("version %s of module %s not found in index", version, path)
+		}
+		return ver.URL, nil
+	default:
+		owner, repo, err := splitGitHubPath(path)
+		if err != nil {
+			return "", err
+		}
+		base := strings.TrimSuffix(withDefault(d.index.URL, defaultGitHubURL), "/")
+		return base + "/" + owner + "/" + repo + "/releases/download/" + url.PathEscape(version) + "/" + repo + ".wasm", nil
+	}
+}
+
+func (d *Downloader) latestVersion(ctx context.Context, path string, index func() (jsonIndex, error)) (string, error) {
+	switch d.index.Type {
+	case IndexJSON:
+		idx, err := index()
+		if err != nil {
+			return "", err
+		}
+		mod, ok := idx.Modules[path]
+		if !ok || mod.Latest == "" {
+			return "", fmt.Errorf("module %s has no latest version in index", path)
+		}
+		return mod.Latest, nil
+	default:
+		owner, repo, err := splitGitHubPath(path)
+		if err != nil {
+			return "", err
+		}
+		base := strings.TrimSuffix(withDefault(d.index.APIURL, defaultGitHubAPIURL), "/")
+
+		var release struct {
+			TagName string `json:"tag_name"`
+		}
+		if err = d.getJSON(ctx, base+"/repos/"+owner+"/"+repo+"/releases/latest", &release); err != nil {
+			return "", err
+		}
+		if release.TagName == "" {
+			return "", fmt.Errorf("latest release of %s has no tag", path)
+		}
+		return release.TagName, nil
+	}
+}
+
+func (d *Downloader) fetchIndex(ctx context.Context) (jsonIndex, error) {
+	var idx jsonIndex
+	if err := d.getJSON(ctx, d.index.URL, &idx); err != nil {
+		return jsonIndex{}, fmt.Errorf("fetching module index: %w", err)
+	}
+	return idx, nil
+}
+
+func (d *Downloader) getJSON(ctx context.Context, uri string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// modulePin is the version "latest" last resolved to, and its URI.
+type modulePin struct {
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+}
+
+func (d *Downloader) pinned(path string) (modulePin, bool) {
+	d.pinsMu.Lock()
+	defer d.pinsMu.Unlock()
+
+	pins, err := d.readPins()
+	if err != nil {
+		return modulePin{}, false
+	}
+	p, ok := pins[path]
+	return p, ok
+}
+
+func (d *Downloader) pin(path string, p modulePin) error {
+	d.pinsMu.Lock()
+	defer d.pinsMu.Unlock()
+
+	pins, err := d.readPins()
+	if err != nil {
+		return err
+	}
+	if pins[path] == p {
+		return nil
+	}
+	pins[path] = p
+
+	b, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(d.cachePath, pinsFile), b, 0o600)
+}
+
+func (d *Downloader) readPins() (map[string]modulePin, error) {
+	pins := map[string]modulePin{}
+
+	b, err := os.ReadFile(filepath.Join(d.cachePath, pinsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("decoding pins: %w", err)
+	}
+	return pins, nil
+}
+
+// splitGitHubPath splits a module path in the form github.com/owner/repo.
+func splitGitHubPath(path string) (owner, repo string, err error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("invalid module path %q: expected github.com/owner/repo", path)
+	}
+	if parts[0] != "github.com" {
+		return "", "", fmt.Errorf("invalid module path %q: only github.com modules are resolved from releases", path)
+	}
+	return parts[1], parts[2], nil
+}
+
+func withDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
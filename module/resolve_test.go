@@ -0,0 +1,281 @@
+package module_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     module.IndexConfig
+		wantErr string
+	}{
+		{
+			name: "default index",
+			cfg:  module.IndexConfig{},
+		},
+		{
+			name: "json index",
+			cfg:  module.IndexConfig{Type: module.IndexJSON, URL: "https://example.com/index.json"},
+		},
+		{
+			name:    "handles json index without url",
+			cfg:     module.IndexConfig{Type: module.IndexJSON},
+			wantErr: "config: a json index must have a url",
+		},
+		{
+			name:    "handles unknown index type",
+			cfg:     module.IndexConfig{Type: "test"},
+			wantErr: `config: unsupported index type "test"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDownloader_ResolveGitHub(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/repos/glasslabs/clock/releases/latest" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"tag_name":"v1.2.3"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name    string
+		path    string
+		version string
+		want    string
+		wantErr require.ErrorAssertionFunc
+	}{
+		{
+			name:    "resolves a version",
+			path:    "github.com/glasslabs/clock",
+			version: "v1.0.0",
+			want:    "https://github.com/glasslabs/clock/releases/download/v1.0.0/clock.wasm",
+			wantErr: require.NoError,
+		},
+		{
+			name:    "resolves latest",
+			path:    "github.com/glasslabs/clock",
+			version: "latest",
+			want:    "https://github.com/glasslabs/clock/releases/download/v1.2.3/clock.wasm",
+			wantErr: require.NoError,
+		},
+		{
+			name:    "resolves empty version as latest",
+			path:    "github.com/glasslabs/clock",
+			want:    "https://github.com/glasslabs/clock/releases/download/v1.2.3/clock.wasm",
+			wantErr: require.NoError,
+		},
+		{
+			name:    "handles unknown module",
+			path:    "github.com/glasslabs/unknown",
+			wantErr: require.Error,
+		},
+		{
+			name:    "handles invalid path",
+			path:    "github.com/glasslabs",
+			version: "v1.0.0",
+			wantErr: require.Error,
+		},
+		{
+			name:    "handles other hosts",
+			path:    "gitlab.com/glasslabs/clock",
+			version: "v1.0.0",
+			wantErr: require.Error,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			d, err := module.NewDownloader(t.TempDir(), log, module.WithIndex(module.IndexConfig{APIURL: srv.URL}))
+			require.NoError(t, err)
+
+			got, err := d.Resolve(t.Context(), test.path, test.version)
+
+			test.wantErr(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestDownloader_ResolveJSON(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"modules":{"github.com/glasslabs/clock":{"latest":"v1.1.0","versions":{
+			"v1.0.0":{"url":"https://example.com/clock/v1.0.0/clock.wasm"},
+			"v1.1.0":{"url":"https://example.com/clock/v1.1.0/clock.wasm"}
+		}}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name    string
+		path    string
+		version string
+		want    string
+		wantErr require.ErrorAssertionFunc
+	}{
+		{
+			name:    "resolves a version",
+			path:    "github.com/glasslabs/clock",
+			version: "v1.0.0",
+			want:    "https://example.com/clock/v1.0.0/clock.wasm",
+			wantErr: require.NoError,
+		},
+		{
+			name:    "resolves latest",
+			path:    "github.com/glasslabs/clock",
+			version: "latest",
+			want:    "https://example.com/clock/v1.1.0/clock.wasm",
+			wantErr: require.NoError,
+		},
+		{
+			name:    "handles unknown version",
+			path:    "github.com/glasslabs/clock",
+			version: "v2.0.0",
+			wantErr: require.Error,
+		},
+		{
+			name:    "handles unknown module",
+			path:    "github.com/glasslabs/unknown",
+			version: "v1.0.0",
+			wantErr: require.Error,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			idx := module.IndexConfig{Type: module.IndexJSON, URL: srv.URL}
+			d, err := module.NewDownloader(t.TempDir(), log, module.WithIndex(idx))
+			require.NoError(t, err)
+
+			got, err := d.Resolve(t.Context(), test.path, test.version)
+
+			test.wantErr(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestDownloader_ResolveJSONFetchesIndexOnce(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		_, _ = rw.Write([]byte(`{"modules":{"github.com/glasslabs/clock":{"latest":"v1.0.0","versions":{
+			"v1.0.0":{"url":"https://example.com/clock/v1.0.0/clock.wasm"}
+		}}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	idx := module.IndexConfig{Type: module.IndexJSON, URL: srv.URL}
+	d, err := module.NewDownloader(t.TempDir(), log, module.WithIndex(idx))
+	require.NoError(t, err)
+
+	got, err := d.Resolve(t.Context(), "github.com/glasslabs/clock", "latest")
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/clock/v1.0.0/clock.wasm", got)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestDownloader_ResolveUsesPinnedVersion(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	var unavailable atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if unavailable.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"tag_name":"v1.2.3"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := t.TempDir()
+	idx := module.WithIndex(module.IndexConfig{APIURL: srv.URL})
+
+	d, err := module.NewDownloader(cachePath, log, idx)
+	require.NoError(t, err)
+	_, err = d.Resolve(t.Context(), "github.com/glasslabs/clock", "latest")
+	require.NoError(t, err)
+
+	unavailable.Store(true)
+	d, err = module.NewDownloader(cachePath, log, idx)
+	require.NoError(t, err)
+
+	got, err := d.Resolve(t.Context(), "github.com/glasslabs/clock", "latest")
+
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.com/glasslabs/clock/releases/download/v1.2.3/clock.wasm", got)
+}
+
+func TestDownloader_ResolveJSONUsesPinnedURL(t *testing.T) {
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+
+	var unavailable atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if unavailable.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"modules":{"github.com/glasslabs/clock":{"latest":"v1.1.0","versions":{
+			"v1.1.0":{"url":"https://example.com/clock/v1.1.0/clock.wasm"}
+		}}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := t.TempDir()
+	idx := module.WithIndex(module.IndexConfig{Type: module.IndexJSON, URL: srv.URL})
+
+	d, err := module.NewDownloader(cachePath, log, idx)
+	require.NoError(t, err)
+	_, err = d.Resolve(t.Context(), "github.com/glasslabs/clock", "latest")
+	require.NoError(t, err)
+
+	unavailable.Store(true)
+	d, err = module.NewDownloader(cachePath, log, idx)
+	require.NoError(t, err)
+
+	got, err := d.Resolve(t.Context(), "github.com/glasslabs/clock", "latest")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/clock/v1.1.0/clock.wasm", got)
+
+	got, err = d.Resolve(t.Context(), "github.com/glasslabs/clock", "v1.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/clock/v1.1.0/clock.wasm", got)
+
+	_, err = d.Resolve(t.Context(), "github.com/glasslabs/clock", "v1.0.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,275 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go4org/hashtriemap"
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// defaultExtismInterval is how often Extism plugins are updated when
+// their module has no interval.
+const defaultExtismInterval = time.Minute
+
+// extismUpdateFunc is the function Extism plugins export to be updated.
+// Its output is the widget XML of the module.
+const extismUpdateFunc = "update"
+
+// extismRunner runs Extism plugins. It shares the runtime, compiled
+// modules and module environments of the wazero runner, so plugins use
+// the same render and HTTP facilities as WASI modules.
+type extismRunner struct {
+	wasi    *wazeroRunner
+	env     *hostEnv
+	kernels hashtriemap.HashTrieMap[string, *extismKernel]
+
+	log *logger.Logger
+}
+
+func newExtismRunner(ctx context.Context, wasi *wazeroRunner) (*extismRunner, error) {
+	r := &extismRunner{
+		wasi: wasi,
+		env:  wasi.env,
+		log:  wasi.log,
+	}
+
+	// Calls into the kernel are tracked for the watchdog.
+	hostCtx := experimental.WithFunctionListenerFactory(ctx, wasi.env)
+	if err := buildExtismModule(hostCtx, wasi.runtime, r); err != nil {
+		return nil, fmt.Errorf("building extism kernel: %w", err)
+	}
+	return r, nil
+}
+
+// Load compiles (or retrieves from cache) an Extism plugin and returns a
+// PluginInstance updating it on the interval of the module.
+func (r *extismRunner) Load(ctx context.Context, desc Descriptor, wasmBytes []byte) (PluginInstance, error) {
+	name := desc.Name
+
+	comp, err := r.wasi.compileModule(ctx, name, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, _, err := ReadManifest(wasmBytes)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("reading manifest of %s: %w", name, err))
+	}
+	warnMissingPermissions(r.log, desc, manifest)
+
+	cfg := desc.Config
+	if manifest.ConfigSchema != nil {
+		if cfg, err = schemaConfig(desc, manifest.ConfigSchema); err != nil {
+			return nil, permanent(err)
+		}
+	}
+	config, err := extismConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encoding config for %s: %w", name, err)
+	}
+
+	modCfg := withClock(wazero.NewModuleConfig(), r.wasi.clock).
+		WithStartFunctions(). // Plugins are initialized by Run.
+		WithEnv("MODULE_NAME", name).
+		WithStderr(newPluginLogWriter(name, r.env.secrets, r.log)).
+		WithName(name)
+
+	if r.wasi.assetsPath != "" && desc.Permissions.allowsAssets() {
+		modCfg = modCfg.WithFSConfig(
+			wazero.NewFSConfig().WithReadOnlyDirMount(r.wasi.assetsPath, "/assets"),
+		)
+	}
+
+	r.log.Debug("Instantiating extism plugin", lctx.Str("module", name))
+
+	env, err := r.env.register(desc)
+	if err != nil {
+		return nil, fmt.Errorf("registering module %s: %w", name, err)
+	}
+
+	limit := uint64(defaultKernelMemory)
+	if desc.Limits.MemoryPages > 0 {
+		limit = uint64(desc.Limits.MemoryPages) * wasmPageSize
+	}
+	kernel := newExtismKernel(config, limit)
+	r.kernels.Store(name, kernel)
+
+	mod, err := r.wasi.runtime.InstantiateModule(experimental.WithMemoryAllocator(ctx, desc.Limits.memoryAllocator(env)), comp, modCfg)
+	if err != nil {
+		r.kernels.CompareAndDelete(name, kernel)
+		r.env.unregister(env)
+		return nil, fmt.Errorf("instantiating module %s: %w", name, err)
+	}
+
+	r.log.Info("Module instantiated", lctx.Str("module", name))
+
+	interval := desc.Interval
+	if interval == 0 {
+		interval = defaultExtismInterval
+	}
+	return &extismInstance{
+		mod:      mod,
+		name:     name,
+		interval: interval,
+		runner:   r,
+		kernel:   kernel,
+		env:      env,
+	}, nil
+}
+
+// extismConfig maps the module config to the Extism plugin config. Strings
+// are kept as they are, other values are encoded as JSON.
+func extismConfig(cfg map[string]any) (map[string]string, error) {
+	config := make(map[string]string, len(cfg))
+	for k, v := range cfg {
+		if s, ok := v.(string); ok {
+			config[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		config[k] = string(b)
+	}
+	return config, nil
+}
+
+// Close is a no-op, the runtime is closed by the wazero runner.
+func (r *extismRunner) Close(context.Context) error {
+	return nil
+}
+
+// extismInstance wraps an Extism plugin instance, calling its update
+// function on an interval.
+type extismInstance struct {
+	mod      api.Module
+	name     string
+	interval time.Duration
+	runner   *extismRunner
+	kernel   *extismKernel
+	env      *moduleEnv
+}
+
+// extismCallError is an error returned by a plugin function, as opposed
+// to a trap.
+type extismCallError struct {
+	fn   string
+	code uint32
+	msg  string
+}
+
+func (e *extismCallError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("%s returned %d", e.fn, e.code)
+	}
+	return fmt.Sprintf("%s returned %d: %s", e.fn, e.code, e.msg)
+}
+
+// Run initializes the plugin and calls its update function on every
+// interval until ctx is canceled, rendering its output. Errors returned by
+// the plugin are logged, while a trap stops the plugin.
+func (i *extismInstance) Run(ctx context.Context) error {
+	if i.env.limits.Watchdog > 0 {
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go watch(watchCtx, i.env, i.mod, i.env.limits.Watchdog)
+	}
+
+	if err := i.init(ctx); err != nil {
+		return i.runErr(ctx, err)
+	}
+
+	ticker := time.NewTicker(i.interval)
+	defer ticker.Stop()
+
+	for {
+		out, err := i.call(ctx, extismUpdateFunc, nil)
+		switch {
+		case errors.As(err, new(*extismCallError)):
+			i.runner.log.Error("Module update failed", lctx.Str("module", i.name), lctx.Err(err))
+		case err != nil:
+			return i.runErr(ctx, err)
+		case len(out) > 0:
+			_, _ = renderWidget(i.runner.env.ui, i.runner.log, i.name, out)
+		}
+
+		// Waiting for the next update is not running guest code.
+		i.env.enterHost()
+		select {
+		case <-ctx.Done():
+			i.env.exitHost()
+			return nil
+		case <-ticker.C:
+		}
+		i.env.exitHost()
+	}
+}
+
+func (i *extismInstance) runErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if limitErr := i.env.err(); limitErr != nil {
+		return fmt.Errorf("run: %w", limitErr)
+	}
+	return fmt.Errorf("run: %w", err)
+}
+
+// init initializes the language runtime of the plugin, as WASI reactors
+// and commands built as libraries expect.
+func (i *extismInstance) init(ctx context.Context) error {
+	for _, name := range []string{"_initialize", "__wasm_call_ctors"} {
+		if fn := i.mod.ExportedFunction(name); fn != nil {
+			_, err := fn.Call(ctx)
+			return err
+		}
+	}
+	return nil
+}
+
+// call calls the plugin function fn with input, returning its output.
+func (i *extismInstance) call(ctx context.Context, fn string, input []byte) ([]byte, error) {
+	f := i.mod.ExportedFunction(fn)
+	if f == nil {
+		return nil, fmt.Errorf("plugin does not export %s", fn)
+	}
+
+	i.kernel.reset()
+	i.kernel.setInput(input)
+
+	res, err := f.Call(ctx)
+	if exitErr, ok := errors.AsType[*sys.ExitError](err); ok && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out, msg := i.kernel.result()
+	var code uint32
+	if len(res) > 0 {
+		code = api.DecodeU32(res[0])
+	}
+	if code != 0 || msg != "" {
+		return nil, &extismCallError{fn: fn, code: code, msg: msg}
+	}
+	return out, nil
+}
+
+// Close releases the plugin instance and its kernel.
+func (i *extismInstance) Close(ctx context.Context) error {
+	i.runner.kernels.CompareAndDelete(i.name, i.kernel)
+	i.runner.env.unregister(i.env)
+	return i.mod.Close(ctx)
+}
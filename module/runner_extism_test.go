@@ -0,0 +1,216 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtismInstance_Call(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		file    string
+		config  map[string]any
+		want    string
+		wantErr string
+	}{
+		{
+			name: "returns output",
+			file: "./testdata/extism_hello.wasm",
+			want: "Hello, world!",
+		},
+		{
+			name:    "returns plugin error",
+			file:    "./testdata/extism_fail.wasm",
+			wantErr: "run_test returned 1: Some error message",
+		},
+		{
+			name:   "reads config",
+			file:   "./testdata/extism_config.wasm",
+			config: map[string]any{"thing": "hello"},
+			want:   `{"config": "hello"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			runner := newTestExtismRunner(t, noopUI{}, logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info))
+
+			wasmBytes, err := os.ReadFile(test.file)
+			require.NoError(t, err)
+
+			inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Config: test.config}, wasmBytes)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+			got, err := inst.(*extismInstance).call(t.Context(), "run_test", nil)
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, string(got))
+		})
+	}
+}
+
+func TestExtismInstance_RunRendersUpdate(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	runner := newTestExtismRunner(t, recordingUI{"test": &recordingUpdater{}}, log)
+
+	wasmBytes, err := os.ReadFile("./testdata/extism_hello.wasm")
+	require.NoError(t, err)
+	wasmBytes = renameExport(t, wasmBytes, "run_test", extismUpdateFunc)
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Interval: time.Hour}, wasmBytes)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	ctx, cancel := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer cancel()
+	err = inst.Run(ctx)
+
+	// The greeting of the plugin is not a widget, but it must be rendered.
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `msg="render: could not decode widget" module=test`)
+}
+
+func TestExtismRunner_HTTPRequestUsesModuleClient(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Test", req.Header.Get("Accept"))
+		_, _ = rw.Write([]byte("<text>hello</text>"))
+	}))
+	t.Cleanup(srv.Close)
+
+	runner := newTestExtismRunner(t, noopUI{}, logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info))
+	perms := &Permissions{HTTP: HTTPPermissions{Hosts: []string{"127.0.0.1"}}}
+	mustRegister(t, runner.env, Descriptor{Name: "test", Permissions: perms})
+	k := newExtismKernel(nil, defaultKernelMemory)
+	runner.kernels.Store("test", k)
+
+	req := k.write([]byte(`{"url": "` + srv.URL + `", "headers": {"Accept": "text/xml"}}`))
+	stack := []uint64{req, 0}
+	extismHTTPRequestFunc(runner)(t.Context(), newMemModule("test"), stack)
+
+	got, ok := k.block(stack[0])
+	require.True(t, ok)
+	assert.Equal(t, "<text>hello</text>", string(got))
+	assert.Equal(t, int32(http.StatusOK), k.httpStatus)
+	assert.Equal(t, "text/xml", k.httpHeaders["x-test"])
+}
+
+func TestExtismRunner_HTTPRequestTrapsWhenNotPermitted(t *testing.T) {
+	t.Parallel()
+
+	runner := newTestExtismRunner(t, noopUI{}, logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info))
+	perms := &Permissions{HTTP: HTTPPermissions{Hosts: []string{"api.example.com"}}}
+	mustRegister(t, runner.env, Descriptor{Name: "test", Permissions: perms})
+	k := newExtismKernel(nil, defaultKernelMemory)
+	runner.kernels.Store("test", k)
+
+	req := k.write([]byte(`{"url": "https://example.com/"}`))
+
+	assert.PanicsWithError(t, "HTTP request to 'https://example.com/' is not allowed", func() {
+		extismHTTPRequestFunc(runner)(t.Context(), newMemModule("test"), []uint64{req, 0})
+	})
+}
+
+func TestExtismKernel(t *testing.T) {
+	t.Parallel()
+
+	k := newExtismKernel(map[string]string{"units": "metric"}, 16)
+
+	offs := k.write([]byte("hello"))
+	got, ok := k.block(offs)
+	require.True(t, ok)
+	assert.Equal(t, "hello", string(got))
+	assert.Zero(t, k.alloc(12), "allocations past the limit must fail")
+
+	k.reset()
+	_, ok = k.block(offs)
+	assert.False(t, ok)
+	assert.Equal(t, offs, k.alloc(16), "reset must free the memory")
+}
+
+func TestExtismConfig(t *testing.T) {
+	t.Parallel()
+
+	got, err := extismConfig(map[string]any{
+		"units":   "metric",
+		"maxDays": 3,
+		"feeds":   []any{"a", "b"},
+	})
+
+	require.NoError(t, err)
+	want := map[string]string{
+		"units":   "metric",
+		"maxDays": "3",
+		"feeds":   `["a","b"]`,
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestRuntimes_LoadHandlesUnsupportedRuntime(t *testing.T) {
+	t.Parallel()
+
+	r := runtimes{RuntimeWASI: nil}
+
+	_, err := r.Load(t.Context(), Descriptor{Name: "test", Runtime: RuntimeExtism}, nil)
+
+	assert.EqualError(t, err, `module test: unsupported runtime "extism"`)
+}
+
+func newTestExtismRunner(t *testing.T, ui UIProvider, log *logger.Logger) *extismRunner {
+	t.Helper()
+
+	wasi, err := newWazeroRunner(t.Context(), ui, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wasi.Close(context.Background()) })
+
+	runner, err := newExtismRunner(t.Context(), wasi)
+	require.NoError(t, err)
+	return runner
+}
+
+// renameExport renames the export from of the WASM module b to to.
+func renameExport(t *testing.T, b []byte, from, to string) []byte {
+	t.Helper()
+
+	out := append([]byte{}, b[:len(wasmMagic)]...)
+	b = b[len(wasmMagic):]
+	for len(b) > 0 {
+		id := b[0]
+		size, n := binary.Uvarint(b[1:])
+		payload := b[1+n : 1+n+int(size)]
+		b = b[1+n+int(size):]
+
+		if id == 7 {
+			payload = bytes.Replace(payload,
+				append([]byte{byte(len(from))}, from...),
+				append([]byte{byte(len(to))}, to...), 1)
+		}
+		out = append(out, id)
+		out = binary.AppendUvarint(out, uint64(len(payload)))
+		out = append(out, payload...)
+	}
+	return out
+}
@@ -0,0 +1,112 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+// goRunner runs the Go modules registered with RegisterGoModule. It shares
+// the module environments of the wazero runner, so Go modules use the same
+// HTTP clients as WASM modules.
+type goRunner struct {
+	env        *hostEnv
+	assetsPath string
+
+	log *logger.Logger
+}
+
+func newGoRunner(wasi *wazeroRunner) *goRunner {
+	return &goRunner{
+		env:        wasi.env,
+		assetsPath: wasi.assetsPath,
+		log:        wasi.log,
+	}
+}
+
+// Load returns a PluginInstance running the Go module named by the URI of
+// desc. The module bytes are not used.
+func (r *goRunner) Load(_ context.Context, desc Descriptor, _ []byte) (PluginInstance, error) {
+	name := desc.Name
+
+	modName, ok := goModuleName(desc.URI)
+	if !ok {
+		return nil, fmt.Errorf("module %s: %q is not a go module URI", name, desc.URI)
+	}
+	mod, ok := lookupGoModule(modName)
+	if !ok {
+		return nil, fmt.Errorf("module %s: go module %q is not registered", name, modName)
+	}
+
+	cfgJSON, err := json.Marshal(desc.Config)
+	if err != nil {
+		return nil, fmt.Errorf("encoding config for %s: %w", name, err)
+	}
+
+	env, err := r.env.register(desc)
+	if err != nil {
+		return nil, fmt.Errorf("registering module %s: %w", name, err)
+	}
+
+	client := *env.client
+	client.Transport = permittedTransport{perms: env.perms, next: env.client.Transport}
+
+	host := &Host{
+		name:   name,
+		config: cfgJSON,
+		client: &client,
+		render: func(widgetXML []byte) error {
+			_, err := renderWidget(r.env.ui, r.log, name, widgetXML)
+			return err
+		},
+	}
+	if desc.Permissions.allowsAssets() {
+		host.assetsPath = r.assetsPath
+	}
+
+	r.log.Info("Module instantiated", lctx.Str("module", name))
+
+	return &goInstance{
+		mod:  mod,
+		host: host,
+		env:  env,
+		run:  r,
+	}, nil
+}
+
+// Close is a no-op, Go modules are stopped by their instance.
+func (r *goRunner) Close(context.Context) error {
+	return nil
+}
+
+// goInstance runs a Go module.
+type goInstance struct {
+	mod  GoModule
+	host *Host
+	env  *moduleEnv
+	run  *goRunner
+}
+
+// Run runs the module until it returns or ctx is canceled. A panic in the
+// module is returned as an error, as a trap would be.
+func (i *goInstance) Run(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("run: panic: %v", r)
+		}
+	}()
+
+	if err = i.mod.Run(ctx, i.host); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	return nil
+}
+
+// Close releases the host resources of the module.
+func (i *goInstance) Close(context.Context) error {
+	i.run.env.unregister(i.env)
+	return nil
+}
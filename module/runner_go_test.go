@@ -0,0 +1,144 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/glasslabs/client-go"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoInstance_RunRendersWidget(t *testing.T) {
+	t.Parallel()
+
+	RegisterGoModule("test-render", GoModuleFunc(func(_ context.Context, host *Host) error {
+		var cfg struct {
+			Greeting string `json:"greeting"`
+		}
+		if err := host.ParseConfig(&cfg); err != nil {
+			return err
+		}
+		return host.Render(&client.Text{Content: cfg.Greeting})
+	}))
+
+	updater := &recordingUpdater{}
+	runner := newTestGoRunner(t, recordingUI{"test": updater})
+	desc := Descriptor{Name: "test", URI: "go://test-render", Config: map[string]any{"greeting": "hello"}}
+
+	inst, err := runner.Load(t.Context(), desc, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	require.NoError(t, err)
+	assert.True(t, updater.updated)
+}
+
+func TestGoInstance_RunHandlesErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		module  string
+		mod     GoModuleFunc
+		wantErr string
+	}{
+		{
+			name:   "returns error",
+			module: "test-error",
+			mod: func(context.Context, *Host) error {
+				return errors.New("test error")
+			},
+			wantErr: "run: test error",
+		},
+		{
+			name:   "returns panic",
+			module: "test-panic",
+			mod: func(context.Context, *Host) error {
+				panic("test panic")
+			},
+			wantErr: "run: panic: test panic",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			RegisterGoModule(test.module, test.mod)
+			runner := newTestGoRunner(t, noopUI{})
+
+			inst, err := runner.Load(t.Context(), Descriptor{Name: "test", URI: "go://" + test.module}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+			err = inst.Run(t.Context())
+
+			assert.EqualError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestGoRunner_LoadHandlesUnregisteredModule(t *testing.T) {
+	t.Parallel()
+
+	runner := newTestGoRunner(t, noopUI{})
+
+	_, err := runner.Load(t.Context(), Descriptor{Name: "test", URI: "go://test-missing"}, nil)
+
+	assert.EqualError(t, err, `module test: go module "test-missing" is not registered`)
+}
+
+func TestGoRunner_HTTPClientChecksPermissions(t *testing.T) {
+	t.Parallel()
+
+	var host *Host
+	RegisterGoModule("test-http", GoModuleFunc(func(_ context.Context, h *Host) error {
+		host = h
+		return nil
+	}))
+
+	runner := newTestGoRunner(t, noopUI{})
+	perms := &Permissions{HTTP: HTTPPermissions{Hosts: []string{"api.example.com"}}}
+	desc := Descriptor{Name: "test", URI: "go://test-http", Permissions: perms}
+
+	inst, err := runner.Load(t.Context(), desc, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+	require.NoError(t, inst.Run(t.Context()))
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	_, err = host.HTTPClient().Do(req) //nolint:bodyclose // The request fails.
+
+	assert.ErrorContains(t, err, `GET request to "https://example.com/" is not permitted`)
+}
+
+func TestRegisterGoModule_PanicsOnDuplicate(t *testing.T) {
+	t.Parallel()
+
+	mod := GoModuleFunc(func(context.Context, *Host) error { return nil })
+	RegisterGoModule("test-duplicate", mod)
+
+	assert.PanicsWithValue(t, "module: go module test-duplicate is already registered", func() {
+		RegisterGoModule("test-duplicate", mod)
+	})
+	assert.Contains(t, GoModules(), "test-duplicate")
+}
+
+func newTestGoRunner(t *testing.T, ui UIProvider) *goRunner {
+	t.Helper()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	wasi, err := newWazeroRunner(t.Context(), ui, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wasi.Close(context.Background()) })
+
+	return newGoRunner(wasi)
+}
@@ -0,0 +1,463 @@
+package module
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// NativeProtocol is the version of the protocol native modules use to
+// talk to the host.
+//
+// Native modules exchange frames with the host over stdin and stdout. A
+// frame is its length as a uint32 followed by its body. Numbers are big
+// endian.
+//
+//	call:   'c' | id uint32 | name_len uint8 | name | args
+//	result: 'r' | id uint32 | result int64 | data
+//
+// A module sends a call frame for each host call, and the host answers
+// with a result frame of the same id. Byte string arguments are sent as
+// their length as a uint32 followed by the bytes, and integer arguments as
+// an int32. Results and data are those of the host function of the same
+// name: a negative result is an error number, and data holds what the
+// function writes to its buffer, which the host sizes. Calls are handled
+// in order, so a blocking call such as bus_next blocks later calls.
+//
+// The host calls are:
+//
+//	render(widget_xml) -> result
+//	last_error() -> n, message
+//	kv_get(key) -> n, value
+//	kv_set(key, value) -> result
+//	kv_delete(key) -> result
+//	kv_list(prefix) -> n, keys
+//	bus_publish(topic, msg) -> result
+//	bus_subscribe(topic) -> handle
+//	bus_next(handle) -> n, msg
+//	bus_close(handle)
+//	secret_get(name) -> n, value
+//
+// render takes the widget XML without the module name, and otherwise
+// behaves as the looking-glass/v2 render. Lines written to stderr are
+// logged, as for WASM modules.
+const NativeProtocol = "looking-glass-native/v1"
+
+const (
+	frameCall   = 'c'
+	frameResult = 'r'
+
+	// maxFrameSize is the maximum size of a frame body.
+	maxFrameSize = 8 << 20
+
+	// nativeResultSize is the size of the buffer host functions write
+	// their data to.
+	nativeResultSize = 4 << 20
+
+	// nativeStopTimeout is how long a native module has to exit once it
+	// is asked to stop, before it is killed.
+	nativeStopTimeout = 5 * time.Second
+)
+
+// nativeEnvVars are the host environment variables passed on to native
+// modules. The rest of the host environment, which may hold credentials
+// such as the secrets key, is withheld.
+var nativeEnvVars = []string{"PATH", "HOME", "TZ"}
+
+// nativeCall describes the arguments of a host call over the native
+// protocol: 'b' is a byte string, 'w' a widget prefixed with the module
+// name as render expects, 'i' an integer and 'o' the result buffer.
+type nativeCall struct {
+	fn      func(*hostEnv) api.GoModuleFunc
+	args    string
+	results int
+}
+
+var nativeCalls = map[string]nativeCall{
+	"render":        {fn: renderV2Func, args: "w", results: 1},
+	"last_error":    {fn: lastErrorFunc, args: "o", results: 1},
+	"kv_get":        {fn: kvGetFunc, args: "bo", results: 1},
+	"kv_set":        {fn: kvSetFunc, args: "bb", results: 1},
+	"kv_delete":     {fn: kvDeleteFunc, args: "b", results: 1},
+	"kv_list":       {fn: kvListFunc, args: "bo", results: 1},
+	"bus_publish":   {fn: busPublishFunc, args: "bb", results: 1},
+	"bus_subscribe": {fn: busSubscribeFunc, args: "b", results: 1},
+	"bus_next":      {fn: busNextFunc, args: "io", results: 1},
+	"bus_close":     {fn: busCloseFunc, args: "i"},
+	"secret_get":    {fn: secretGetFunc, args: "bo", results: 1},
+}
+
+// nativeRunner runs native executables as modules, each in its own
+// process group. Modules are written to dir, named by their digest, so
+// they can be executed. It shares the module environments of the wazero
+// runner, so native modules use the same storage, bus and secrets.
+type nativeRunner struct {
+	dir string
+	env *hostEnv
+
+	log *logger.Logger
+}
+
+func newNativeRunner(wasi *wazeroRunner, dir string) *nativeRunner {
+	return &nativeRunner{
+		dir: dir,
+		env: wasi.env,
+		log: wasi.log,
+	}
+}
+
+// Load writes the executable of the module and returns a PluginInstance
+// running it. Remote modules must be pinned by a digest or signature.
+func (r *nativeRunner) Load(_ context.Context, desc Descriptor, b []byte) (PluginInstance, error) {
+	name := desc.Name
+
+	if err := desc.checkNativePinned(); err != nil {
+		return nil, permanent(err)
+	}
+
+	cfgJSON, err := json.Marshal(desc.Config)
+	if err != nil {
+		return nil, fmt.Errorf("encoding config for %s: %w", name, err)
+	}
+
+	path, err := r.writeExecutable(b)
+	if err != nil {
+		return nil, fmt.Errorf("writing executable of %s: %w", name, err)
+	}
+
+	env, err := r.env.register(desc)
+	if err != nil {
+		return nil, fmt.Errorf("registering module %s: %w", name, err)
+	}
+
+	return &nativeInstance{
+		path:   path,
+		name:   name,
+		config: string(cfgJSON),
+		host:   r.env,
+		env:    env,
+		log:    r.log,
+	}, nil
+}
+
+func (r *nativeRunner) writeExecutable(b []byte) (string, error) {
+	hash := sha256.Sum256(b)
+	path := filepath.Join(r.dir, hex.EncodeToString(hash[:]))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(r.dir, 0o750); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(r.dir, "module-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0o700); err != nil { //nolint:gosec // The module must be executable.
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// Close is a no-op, native modules are stopped by their instance.
+func (r *nativeRunner) Close(context.Context) error {
+	return nil
+}
+
+// nativeInstance runs a native module in a process.
+type nativeInstance struct {
+	path   string
+	name   string
+	config string
+	host   *hostEnv
+	env    *moduleEnv
+
+	mu   sync.Mutex
+	proc *os.Process
+
+	log *logger.Logger
+}
+
+// Run starts the process of the module and serves its host calls until
+// it exits or ctx is canceled. The process group of the module is asked
+// to stop when ctx is canceled, and killed if it does not.
+func (i *nativeInstance) Run(ctx context.Context) error {
+	//nolint:gosec // Running the module is the point.
+	cmd := exec.Command(i.path)
+	cmd.Env = append(nativeEnv(),
+		"MODULE_NAME="+i.name,
+		"MODULE_CONFIG="+i.config,
+		"HOST_PROTOCOL="+NativeProtocol,
+	)
+	cmd.Stderr = newPluginLogWriter(i.name, i.host.secrets, i.log)
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("run: starting module: %w", err)
+	}
+
+	i.mu.Lock()
+	i.proc = cmd.Process
+	i.mu.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		serveErr := i.serve(ctx, stdout, stdin)
+		if serveErr != nil {
+			// The module broke the protocol, it cannot be talked to.
+			i.signal(true)
+		}
+		exited <- errors.Join(serveErr, cmd.Wait())
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		i.signal(false)
+		select {
+		case <-exited:
+		case <-time.After(nativeStopTimeout):
+			i.log.Warn("Module did not stop, killing it", lctx.Str("module", i.name))
+			i.signal(true)
+			<-exited
+		}
+		return nil
+	}
+
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	return nil
+}
+
+// nativeEnv returns the host environment variables native modules see.
+func nativeEnv() []string {
+	env := make([]string, 0, len(nativeEnvVars)+3)
+	for _, k := range nativeEnvVars {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// serve answers the host calls of the module until it closes stdout.
+func (i *nativeInstance) serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	mod := &callModule{name: i.name}
+	for {
+		body, err := readFrame(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id, result, data, err := i.call(ctx, mod, body)
+		if err != nil {
+			return err
+		}
+		if err = writeResultFrame(w, id, result, data); err != nil {
+			// The module exited while the call was handled.
+			return nil //nolint:nilerr
+		}
+	}
+}
+
+// call handles the host call in body, returning its id, result and data.
+func (i *nativeInstance) call(ctx context.Context, mod *callModule, body []byte) (uint32, int64, []byte, error) {
+	if len(body) < 6 || body[0] != frameCall {
+		return 0, 0, nil, errors.New("protocol: invalid call frame")
+	}
+	id := binary.BigEndian.Uint32(body[1:5])
+	nameLen := int(body[5])
+	if len(body) < 6+nameLen {
+		return 0, 0, nil, errors.New("protocol: invalid call frame")
+	}
+	name := string(body[6 : 6+nameLen])
+	args := body[6+nameLen:]
+
+	call, ok := nativeCalls[name]
+	if !ok {
+		i.log.Warn("Unknown host call", lctx.Str("module", i.name), lctx.Str("call", name))
+		return id, int64(errnoInvalid), nil, nil
+	}
+
+	mod.reset()
+	var (
+		stack []uint64
+		out   [2]uint32
+	)
+	for _, kind := range call.args {
+		switch kind {
+		case 'b', 'w':
+			if len(args) < 4 || uint64(len(args)-4) < uint64(binary.BigEndian.Uint32(args)) {
+				return 0, 0, nil, fmt.Errorf("protocol: invalid arguments to %s", name)
+			}
+			n := binary.BigEndian.Uint32(args)
+			arg := args[4 : 4+n]
+			args = args[4+n:]
+			if kind == 'w' {
+				arg = append([]byte(i.name+"\x00"), arg...)
+			}
+			ptr := mod.write(arg)
+			stack = append(stack, uint64(ptr), uint64(len(arg)))
+		case 'i':
+			if len(args) < 4 {
+				return 0, 0, nil, fmt.Errorf("protocol: invalid arguments to %s", name)
+			}
+			stack = append(stack, uint64(binary.BigEndian.Uint32(args)))
+			args = args[4:]
+		case 'o':
+			out = [2]uint32{mod.alloc(nativeResultSize), nativeResultSize}
+			stack = append(stack, uint64(out[0]), uint64(out[1]))
+		}
+	}
+	stack = append(stack, make([]uint64, max(call.results-len(stack), 0))...)
+
+	call.fn(i.host)(ctx, mod, stack)
+
+	if call.results == 0 {
+		return id, 0, nil, nil
+	}
+	result := int64(int32(uint32(stack[0]))) //nolint:gosec // Results are i32.
+	var data []byte
+	if out[1] > 0 && result > 0 && result <= int64(out[1]) {
+		data, _ = mod.Memory().Read(out[0], uint32(result))
+	}
+	return id, result, data, nil
+}
+
+// Close kills the process group of the module and releases its host
+// resources. The group is killed even when the module has exited, as
+// children left behind by the module are stopped with it.
+func (i *nativeInstance) Close(context.Context) error {
+	i.signal(true)
+
+	i.host.unregister(i.env)
+	return nil
+}
+
+// signal asks the process group of the module to stop, or kills it when
+// force is true. The group outlives the module while its children run,
+// and its id cannot be reused while any of them are alive.
+func (i *nativeInstance) signal(force bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.proc != nil {
+		_ = killProcessGroup(i.proc, force)
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("protocol: frame of %d bytes exceeds %d bytes", n, maxFrameSize)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("protocol: %w", err)
+	}
+	return body, nil
+}
+
+func writeResultFrame(w io.Writer, id uint32, result int64, data []byte) error {
+	frame := make([]byte, 0, 4+13+len(data))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(13+len(data))) //nolint:gosec // Data is smaller than a frame.
+	frame = append(frame, frameResult)
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(result)) //nolint:gosec // Results are i32.
+	frame = append(frame, data...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// callModule is the module host functions see for a host call of a native
+// module. The arguments of the call are laid out in its memory.
+type callModule struct {
+	api.Module // nil embedding; only Name and Memory are used
+
+	name string
+	mem  callMemory
+}
+
+func (m *callModule) Name() string       { return m.name }
+func (m *callModule) Memory() api.Memory { return &m.mem }
+
+func (m *callModule) reset() {
+	m.mem.buf = m.mem.buf[:0]
+}
+
+// write appends b to the memory, returning its offset.
+func (m *callModule) write(b []byte) uint32 {
+	ptr := uint32(len(m.mem.buf)) //nolint:gosec // Frames are small.
+	m.mem.buf = append(m.mem.buf, b...)
+	return ptr
+}
+
+// alloc appends n zero bytes to the memory, returning their offset.
+func (m *callModule) alloc(n int) uint32 {
+	ptr := uint32(len(m.mem.buf)) //nolint:gosec // Frames are small.
+	m.mem.buf = append(m.mem.buf, make([]byte, n)...)
+	return ptr
+}
+
+type callMemory struct {
+	api.Memory // nil embedding; only Read and Write are used
+
+	buf []byte
+}
+
+func (m *callMemory) Read(offset, byteCount uint32) ([]byte, bool) {
+	if uint64(offset)+uint64(byteCount) > uint64(len(m.buf)) {
+		return nil, false
+	}
+	return m.buf[offset : offset+byteCount], true
+}
+
+func (m *callMemory) Write(offset uint32, v []byte) bool {
+	if uint64(offset)+uint64(len(v)) > uint64(len(m.buf)) {
+		return false
+	}
+	copy(m.buf[offset:], v)
+	return true
+}
@@ -0,0 +1,329 @@
+package module
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs the test binary as a native module when it is started by
+// the native runner.
+func TestMain(m *testing.M) {
+	if os.Getenv("HOST_PROTOCOL") == NativeProtocol {
+		os.Exit(nativeHelper())
+	}
+	os.Exit(m.Run())
+}
+
+func TestNativeRunner_LoadRefusesUnpinnedRemoteModule(t *testing.T) {
+	t.Parallel()
+
+	runner := newTestNativeRunner(t, noopUI{})
+
+	desc := Descriptor{Name: "test", URI: "https://example.com/test", Runtime: RuntimeNative}
+	_, err := runner.Load(t.Context(), desc, testExecutable(t))
+
+	require.EqualError(t, err, "test: remote native modules must have a sha256 or a signature")
+	assert.True(t, isPermanent(err))
+}
+
+func TestNativeInstance_RunRendersWidget(t *testing.T) {
+	t.Parallel()
+
+	updater := &recordingUpdater{}
+	runner := newTestNativeRunner(t, recordingUI{"test": updater})
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Config: map[string]any{"helper": "render"}}, testExecutable(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	require.NoError(t, err)
+	assert.True(t, updater.updated)
+}
+
+func TestNativeInstance_RunHandlesExitCode(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	runner := newTestNativeRunner(t, noopUI{})
+	runner.log = logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Config: map[string]any{"helper": "fail"}}, testExecutable(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	assert.EqualError(t, err, "run: exit status 2")
+	assert.Contains(t, buf.String(), `msg="something broke" module=test`)
+}
+
+func TestNativeInstance_RunWithholdsHostEnv(t *testing.T) {
+	t.Setenv("LOOKING_GLASS_TEST_HOST_VAR", "leaked")
+
+	runner := newTestNativeRunner(t, noopUI{})
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Config: map[string]any{"helper": "env"}}, testExecutable(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	require.NoError(t, err)
+}
+
+func TestNativeInstance_RunStopsProcessGroup(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not supported")
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	runner := newTestNativeRunner(t, noopUI{})
+
+	desc := Descriptor{Name: "test", Config: map[string]any{"helper": "spawn", "pidFile": pidFile}}
+	inst, err := runner.Load(t.Context(), desc, testExecutable(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- inst.Run(ctx) }()
+
+	var pid int
+	require.Eventually(t, func() bool {
+		b, err := os.ReadFile(pidFile)
+		if err != nil || len(b) == 0 {
+			return false
+		}
+		pid, err = strconv.Atoi(string(b))
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Eventually(t, func() bool {
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return true
+		}
+		return errors.Is(proc.Signal(syscall.Signal(0)), os.ErrProcessDone) ||
+			errors.Is(proc.Signal(syscall.Signal(0)), syscall.ESRCH)
+	}, 10*time.Second, 10*time.Millisecond, "the child of the module must be stopped")
+}
+
+func TestNativeInstance_CloseStopsLeftBehindChildren(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not supported")
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	runner := newTestNativeRunner(t, noopUI{})
+
+	desc := Descriptor{Name: "test", Config: map[string]any{"helper": "orphan", "pidFile": pidFile}}
+	inst, err := runner.Load(t.Context(), desc, testExecutable(t))
+	require.NoError(t, err)
+
+	err = inst.Run(t.Context())
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(string(b))
+	require.NoError(t, err)
+	proc, err := os.FindProcess(pid)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = proc.Kill() })
+	require.False(t, processStopped(pid), "the child of the module must outlive it")
+
+	err = inst.Close(context.Background())
+
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return processStopped(pid)
+	}, 10*time.Second, 10*time.Millisecond, "the child of the module must be stopped")
+}
+
+// processStopped reports whether the process pid has exited. Orphans may
+// be left as zombies when nothing reaps them.
+func processStopped(pid int) bool {
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// The state follows the command name, which is in parentheses.
+		if i := bytes.LastIndexByte(b, ')'); i >= 0 && i+2 < len(b) && b[i+2] == 'Z' {
+			return true
+		}
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH)
+}
+
+func TestNativeInstance_CallHandlesUnknownCall(t *testing.T) {
+	t.Parallel()
+
+	runner := newTestNativeRunner(t, noopUI{})
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test"}, []byte("#!/bin/sh\n"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	body := append([]byte{frameCall, 0, 0, 0, 7, 4}, "nope"...)
+	id, result, _, err := inst.(*nativeInstance).call(t.Context(), &callModule{name: "test"}, body)
+
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), id)
+	assert.Equal(t, int64(errnoInvalid), result)
+}
+
+func TestReadFrame_HandlesOversizedFrame(t *testing.T) {
+	t.Parallel()
+
+	_, err := readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+
+	assert.EqualError(t, err, "protocol: frame of 4294967295 bytes exceeds 8388608 bytes")
+}
+
+func newTestNativeRunner(t *testing.T, ui UIProvider) *nativeRunner {
+	t.Helper()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+	wasi, err := newWazeroRunner(t.Context(), ui, ExecContext{DataPath: t.TempDir()}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wasi.Close(context.Background()) })
+
+	return newNativeRunner(wasi, t.TempDir())
+}
+
+// testExecutable returns the test binary, which acts as a native module.
+func testExecutable(t *testing.T) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(os.Args[0])
+	require.NoError(t, err)
+	return b
+}
+
+// nativeHelper is a native module, acting as the helper in its config.
+func nativeHelper() int {
+	var cfg struct {
+		Helper  string `json:"helper"`
+		PIDFile string `json:"pidFile"`
+	}
+	if err := json.Unmarshal([]byte(os.Getenv("MODULE_CONFIG")), &cfg); err != nil {
+		return 1
+	}
+
+	c := &nativeHelperClient{r: bufio.NewReader(os.Stdin), w: os.Stdout}
+	switch cfg.Helper {
+	case "render":
+		if res, _ := c.call("kv_set", []byte("text"), []byte("hello")); res != 0 {
+			return 3
+		}
+		res, text := c.call("kv_get", []byte("text"))
+		if res != 5 {
+			return 3
+		}
+		if res, _ = c.call("render", []byte("<text>"+string(text)+"</text>")); res != 0 {
+			return 3
+		}
+		return 0
+	case "fail":
+		_, _ = fmt.Fprintln(os.Stderr, "something broke")
+		return 2
+	case "spawn":
+		//nolint:gosec // The child is the test binary.
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), `MODULE_CONFIG={"helper":"sleep"}`)
+		if err := cmd.Start(); err != nil {
+			return 3
+		}
+		if err := os.WriteFile(cfg.PIDFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0o600); err != nil {
+			return 3
+		}
+		_ = cmd.Wait()
+		return 0
+	case "orphan":
+		// The child is left running when the module exits.
+		//nolint:gosec // The child is the test binary.
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), `MODULE_CONFIG={"helper":"stubborn"}`)
+		if err := cmd.Start(); err != nil {
+			return 3
+		}
+		if err := os.WriteFile(cfg.PIDFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0o600); err != nil {
+			return 3
+		}
+		return 0
+	case "sleep":
+		time.Sleep(time.Minute)
+		return 0
+	case "stubborn":
+		signal.Ignore(syscall.SIGTERM)
+		time.Sleep(time.Minute)
+		return 0
+	case "env":
+		if _, ok := os.LookupEnv("LOOKING_GLASS_TEST_HOST_VAR"); ok {
+			return 4
+		}
+		if os.Getenv("MODULE_NAME") != "test" {
+			return 4
+		}
+		return 0
+	default:
+		return 1
+	}
+}
+
+type nativeHelperClient struct {
+	r  io.Reader
+	w  io.Writer
+	id uint32
+}
+
+func (c *nativeHelperClient) call(name string, args ...[]byte) (int64, []byte) {
+	c.id++
+	body := []byte{frameCall}
+	body = binary.BigEndian.AppendUint32(body, c.id)
+	body = append(body, byte(len(name)))
+	body = append(body, name...)
+	for _, arg := range args {
+		body = binary.BigEndian.AppendUint32(body, uint32(len(arg)))
+		body = append(body, arg...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	if _, err := c.w.Write(append(frame, body...)); err != nil {
+		return -1, nil
+	}
+
+	res, err := readFrame(c.r)
+	if err != nil || len(res) < 13 || res[0] != frameResult || binary.BigEndian.Uint32(res[1:5]) != c.id {
+		return -1, nil
+	}
+	return int64(binary.BigEndian.Uint64(res[5:13])), res[13:]
+}
@@ -11,12 +11,14 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go4org/hashtriemap"
 	"github.com/hamba/logger/v2"
 	lctx "github.com/hamba/logger/v2/ctx"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 	"github.com/tetratelabs/wazero/sys"
 	"golang.org/x/sync/singleflight"
@@ -28,7 +30,9 @@ import (
 type wazeroRunner struct {
 	cache      wazero.CompilationCache
 	runtime    wazero.Runtime
+	env        *hostEnv
 	assetsPath string
+	clock      Clock
 
 	comp      hashtriemap.HashTrieMap[[32]byte, wazero.CompiledModule]
 	compGrp   singleflight.Group
@@ -37,13 +41,13 @@ type wazeroRunner struct {
 	log *logger.Logger
 }
 
-func newWazeroRunner(ctx context.Context, ui UIProvider, cachePath, assetsPath string, log *logger.Logger) (*wazeroRunner, error) {
+func newWazeroRunner(ctx context.Context, ui UIProvider, execCtx ExecContext, log *logger.Logger) (*wazeroRunner, error) {
 	cfg := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
 
 	var cache wazero.CompilationCache
-	if cachePath != "" {
+	if execCtx.CachePath != "" {
 		var err error
-		cache, err = wazero.NewCompilationCacheWithDir(cachePath)
+		cache, err = wazero.NewCompilationCacheWithDir(execCtx.CachePath)
 		if err != nil {
 			return nil, fmt.Errorf("creating compilation cache: %w", err)
 		}
@@ -52,9 +56,22 @@ func newWazeroRunner(ctx context.Context, ui UIProvider, cachePath, assetsPath s
 
 	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
 
-	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	// Calls into the host modules are tracked for the watchdog.
+	env := newHostEnv(ui, execCtx.DataPath, log)
+	env.brokers = newMQTTBrokers(execCtx.MQTT, log)
+	if execCtx.Scheduler != nil {
+		env.sched = newScheduler(*execCtx.Scheduler, log)
+	}
+	env.secrets = execCtx.Secrets
+	env.transport = execCtx.Transport
+	if execCtx.HTTPCache.Enabled {
+		env.cache = newHTTPCache(execCtx.HTTPCachePath, execCtx.HTTPCache, log)
+	}
+	hostCtx := experimental.WithFunctionListenerFactory(ctx, env)
+
+	wasi_snapshot_preview1.MustInstantiate(hostCtx, rt)
 
-	if err := buildHostModule(ctx, rt, ui, log); err != nil {
+	if err := buildHostModule(hostCtx, rt, env); err != nil {
 		_ = rt.Close(ctx)
 		return nil, fmt.Errorf("building host module: %w", err)
 	}
@@ -62,16 +79,20 @@ func newWazeroRunner(ctx context.Context, ui UIProvider, cachePath, assetsPath s
 	return &wazeroRunner{
 		cache:      cache,
 		runtime:    rt,
-		assetsPath: assetsPath,
-		compQueue:  make(chan struct{}, runtime.NumCPU()-1),
+		env:        env,
+		assetsPath: execCtx.AssetsPath,
+		clock:      execCtx.Clock,
+		compQueue:  make(chan struct{}, max(runtime.NumCPU()-1, 1)),
 		log:        log,
 	}, nil
 }
 
 // Load compiles (or retrieves from cache) a WASM module and returns a
 // PluginInstance ready to drive with Run/Close.
-func (r *wazeroRunner) Load(ctx context.Context, name string, wasmBytes []byte, cfg map[string]any) (PluginInstance, error) {
-	cfgJSON, err := json.Marshal(cfg)
+func (r *wazeroRunner) Load(ctx context.Context, desc Descriptor, wasmBytes []byte) (PluginInstance, error) {
+	name := desc.Name
+
+	cfgJSON, err := json.Marshal(desc.Config)
 	if err != nil {
 		return nil, fmt.Errorf("encoding config for %s: %w", name, err)
 	}
@@ -81,17 +102,44 @@ func (r *wazeroRunner) Load(ctx context.Context, name string, wasmBytes []byte,
 		return nil, err
 	}
 
-	modCfg := wazero.NewModuleConfig().
-		WithSysWalltime().
-		WithSysNanotime().
-		WithSysNanosleep().
+	// Incompatible modules are refused before they are instantiated.
+	manifest, ok, err := ReadManifest(wasmBytes)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("reading manifest of %s: %w", name, err))
+	}
+	if err = manifest.CheckABI(); err != nil {
+		return nil, permanent(fmt.Errorf("module %s is incompatible: %w", name, err))
+	}
+	if ok {
+		r.log.Debug("Read module manifest",
+			lctx.Str("module", name),
+			lctx.Str("name", manifest.Name),
+			lctx.Str("version", manifest.Version),
+			lctx.Str("abi", manifest.ABI),
+		)
+	}
+	warnMissingPermissions(r.log, desc, manifest)
+
+	// The module receives its config with the schema defaults applied.
+	if manifest.ConfigSchema != nil {
+		cfg, err := schemaConfig(desc, manifest.ConfigSchema)
+		if err != nil {
+			return nil, permanent(err)
+		}
+		if cfgJSON, err = json.Marshal(cfg); err != nil {
+			return nil, fmt.Errorf("encoding config for %s: %w", name, err)
+		}
+	}
+
+	modCfg := withClock(wazero.NewModuleConfig(), r.clock).
 		WithStartFunctions(). // Suppress auto-call of _start; Run() drives it.
 		WithEnv("MODULE_NAME", name).
 		WithEnv("MODULE_CONFIG", string(cfgJSON)).
-		WithStderr(newPluginLogWriter(name, r.log)).
+		WithEnv("HOST_ABI", strings.Join(supportedABIs, ",")).
+		WithStderr(newPluginLogWriter(name, r.env.secrets, r.log)).
 		WithName(name)
 
-	if r.assetsPath != "" {
+	if r.assetsPath != "" && desc.Permissions.allowsAssets() {
 		modCfg = modCfg.WithFSConfig(
 			wazero.NewFSConfig().WithReadOnlyDirMount(r.assetsPath, "/assets"),
 		)
@@ -99,14 +147,22 @@ func (r *wazeroRunner) Load(ctx context.Context, name string, wasmBytes []byte,
 
 	r.log.Debug("Instantiating module", lctx.Str("module", name))
 
-	mod, err := r.runtime.InstantiateModule(ctx, comp, modCfg)
+	// The module environment must exist before instantiation, as the
+	// plugin may call host functions from its start functions.
+	env, err := r.env.register(desc)
+	if err != nil {
+		return nil, fmt.Errorf("registering module %s: %w", name, err)
+	}
+
+	mod, err := r.runtime.InstantiateModule(experimental.WithMemoryAllocator(ctx, desc.Limits.memoryAllocator(env)), comp, modCfg)
 	if err != nil {
+		r.env.unregister(env)
 		return nil, fmt.Errorf("instantiating module %s: %w", name, err)
 	}
 
 	r.log.Info("Module instantiated", lctx.Str("module", name))
 
-	return &wazeroInstance{mod: mod, name: name}, nil
+	return &wazeroInstance{mod: mod, name: name, host: r.env, env: env}, nil
 }
 
 func (r *wazeroRunner) compileModule(ctx context.Context, name string, b []byte) (wazero.CompiledModule, error) {
@@ -152,18 +208,34 @@ func (r *wazeroRunner) Close(ctx context.Context) error {
 type wazeroInstance struct {
 	mod  api.Module
 	name string
+	host *hostEnv
+	env  *moduleEnv
 }
 
 // Run calls the WASI _start export, which invokes the plugin's main() function.
 // main() performs setup and then enters a blocking update loop. Execution
 // continues until ctx is canceled, at which point wazero interrupts the call
 // and returns a context error (treated as a clean shutdown, not an error).
+// A module stopped for exceeding a resource limit returns the violation.
 func (i *wazeroInstance) Run(ctx context.Context) error {
 	startFn := i.mod.ExportedFunction("_start")
 	if startFn == nil {
 		return nil
 	}
+
+	if i.env != nil && i.env.limits.Watchdog > 0 {
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go watch(watchCtx, i.env, i.mod, i.env.limits.Watchdog)
+	}
+
 	_, err := startFn.Call(ctx)
+	if i.env != nil {
+		if limitErr := i.env.err(); limitErr != nil && ctx.Err() == nil {
+			return fmt.Errorf("run: %w", limitErr)
+		}
+	}
 	if err != nil && ctx.Err() == nil {
 		if exitErr, ok := errors.AsType[*sys.ExitError](err); ok && exitErr.ExitCode() == 0 {
 			return nil
@@ -173,24 +245,48 @@ func (i *wazeroInstance) Run(ctx context.Context) error {
 	return nil
 }
 
-// Close releases the module instance.
+// watch stops the module when it runs longer than deadline without
+// yielding to the host.
+func watch(ctx context.Context, env *moduleEnv, mod api.Module, deadline time.Duration) {
+	ticker := time.NewTicker(max(deadline/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if idle := env.idle(now); idle > deadline {
+				env.stop(ctx, mod, fmt.Errorf("module has not yielded for %s, watchdog deadline is %s", idle.Round(time.Millisecond), deadline))
+				return
+			}
+		}
+	}
+}
+
+// Close releases the module instance and closes its open streams.
 func (i *wazeroInstance) Close(ctx context.Context) error {
+	if i.host != nil {
+		i.host.unregister(i.env)
+	}
 	return i.mod.Close(ctx)
 }
 
 // pluginLogWriter is a line-buffered io.Writer that parses logfmt lines
 // written by the plugin to stderr and routes them to the host logger.
 type pluginLogWriter struct {
-	name string
-	log  *logger.Logger
+	name    string
+	secrets *Secrets
+	log     *logger.Logger
 
 	mu  sync.Mutex
 	buf []byte
 }
 
-// newPluginLogWriter returns a pluginLogWriter for the named plugin.
-func newPluginLogWriter(name string, log *logger.Logger) *pluginLogWriter {
-	return &pluginLogWriter{name: name, log: log}
+// newPluginLogWriter returns a pluginLogWriter for the named plugin,
+// redacting the values of secrets.
+func newPluginLogWriter(name string, secrets *Secrets, log *logger.Logger) *pluginLogWriter {
+	return &pluginLogWriter{name: name, secrets: secrets, log: log}
 }
 
 func (w *pluginLogWriter) Write(p []byte) (int, error) {
@@ -213,6 +309,7 @@ func (w *pluginLogWriter) Write(p []byte) (int, error) {
 }
 
 func (w *pluginLogWriter) dispatch(line string) {
+	line = w.secrets.redact(line)
 	kvs := parseLogFmt(line)
 
 	level := kvs["level"]
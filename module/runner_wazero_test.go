@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/hamba/logger/v2"
 	"github.com/stretchr/testify/assert"
@@ -20,7 +23,7 @@ func TestNewWazeroRunner(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 
 	require.NoError(t, err)
 	require.NotNil(t, runner)
@@ -34,14 +37,14 @@ func TestWazeroRunner_Load(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
 	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
 	require.NoError(t, err)
 
-	inst, err := runner.Load(t.Context(), "test", wasmBytes, nil)
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test"}, wasmBytes)
 
 	require.NoError(t, err)
 	require.NotNil(t, inst)
@@ -55,18 +58,18 @@ func TestWazeroRunner_LoadCachesCompiledModule(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
 	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
 	require.NoError(t, err)
 
-	inst1, err := runner.Load(t.Context(), "first", wasmBytes, nil)
+	inst1, err := runner.Load(t.Context(), Descriptor{Name: "first"}, wasmBytes)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = inst1.Close(context.Background()) })
 
-	inst2, err := runner.Load(t.Context(), "second", wasmBytes, nil)
+	inst2, err := runner.Load(t.Context(), Descriptor{Name: "second"}, wasmBytes)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = inst2.Close(context.Background()) })
 
@@ -80,16 +83,129 @@ func TestWazeroRunner_LoadHandlesInvalidWasm(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
-	_, err = runner.Load(t.Context(), "bad", []byte("not-wasm"), nil)
+	_, err = runner.Load(t.Context(), Descriptor{Name: "bad"}, []byte("not-wasm"))
 
 	require.Error(t, err)
 	assert.ErrorContains(t, err, "compiling module bad")
 }
 
+func TestNewWazeroRunner_InstantiatesHostModules(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	v1 := runner.runtime.Module("looking-glass")
+	require.NotNil(t, v1)
+	v1Funcs := v1.ExportedFunctionDefinitions()
+	assert.Empty(t, v1Funcs["render"].ResultTypes())
+	assert.NotContains(t, v1Funcs, "last_error")
+
+	v2 := runner.runtime.Module("looking-glass/v2")
+	require.NotNil(t, v2)
+	v2Funcs := v2.ExportedFunctionDefinitions()
+	assert.Len(t, v2Funcs["render"].ResultTypes(), 1)
+	assert.Contains(t, v2Funcs, "last_error")
+	assert.Contains(t, v2Funcs, "secret_get")
+}
+
+func TestWazeroRunner_LoadHandlesIncompatibleABI(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
+	require.NoError(t, err)
+
+	_, err = runner.Load(t.Context(), Descriptor{Name: "old"}, withManifest(wasmBytes, `{"abi": "looking-glass/v9"}`))
+
+	assert.EqualError(t, err, `module old is incompatible: module requires host ABI "looking-glass/v9", but the host supports looking-glass/v1, looking-glass/v2`)
+	assert.True(t, isPermanent(err))
+}
+
+func TestWazeroRunner_LoadWarnsOfMissingPermissions(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
+	require.NoError(t, err)
+	wasmBytes = withManifest(wasmBytes, `{"permissions": {"http": {"hosts": ["api.example.com"]}, "storage": true}}`)
+
+	desc := Descriptor{Name: "weather", Permissions: &Permissions{Storage: true}}
+	_, err = runner.Load(t.Context(), desc, wasmBytes)
+
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `msg="Module requests permissions it is not granted" module=weather missing="http host api.example.com"`)
+}
+
+func TestWazeroRunner_LoadHandlesConfigNotMatchingSchema(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
+	require.NoError(t, err)
+	wasmBytes = withManifest(wasmBytes, `{"configSchema": {"type": "object", "properties": {"units": {"enum": ["metric", "imperial"]}}}}`)
+
+	desc := Descriptor{Name: "weather", Config: map[string]any{"units": "kelvin"}}
+	_, err = runner.Load(t.Context(), desc, wasmBytes)
+
+	assert.EqualError(t, err, `weather: config.units: value must be one of 'metric', 'imperial'`)
+	assert.True(t, isPermanent(err))
+}
+
+func TestWazeroRunner_SupervisorFailsOnConfigNotMatchingSchema(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
+	require.NoError(t, err)
+	wasmBytes = withManifest(wasmBytes, `{"configSchema": {"type": "object", "properties": {"units": {"enum": ["metric", "imperial"]}}}}`)
+
+	desc := Descriptor{Name: "weather", Config: map[string]any{"units": "kelvin"}}
+	var loads int
+	sup := newSupervisor("weather", RestartPolicy{Backoff: time.Millisecond}, func(ctx context.Context) (PluginInstance, error) {
+		loads++
+		return runner.Load(ctx, desc, wasmBytes)
+	}, log)
+
+	sup.run(t.Context())
+
+	got := sup.Status()
+	assert.Equal(t, StateFailed, got.State)
+	assert.Equal(t, 0, got.Restarts)
+	assert.Equal(t, 1, loads)
+	assert.EqualError(t, got.LastError, `loading module: weather: config.units: value must be one of 'metric', 'imperial'`)
+}
+
 func TestWazeroRunner_LoadHandlesInvalidConfig(t *testing.T) {
 	t.Parallel()
 
@@ -97,13 +213,13 @@ func TestWazeroRunner_LoadHandlesInvalidConfig(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
 	cfg := map[string]any{"key": make(chan int)}
 
-	_, err = runner.Load(t.Context(), "test", []byte("any"), cfg)
+	_, err = runner.Load(t.Context(), Descriptor{Name: "test", Config: cfg}, []byte("any"))
 
 	require.Error(t, err)
 	assert.ErrorContains(t, err, "encoding config for test")
@@ -116,7 +232,7 @@ func TestWazeroRunner_Close(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 
 	err = runner.Close(context.Background())
@@ -188,14 +304,14 @@ func TestWazeroInstance_RunIntegration(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
 	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
 	require.NoError(t, err)
 
-	inst, err := runner.Load(t.Context(), "test", wasmBytes, nil)
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test"}, wasmBytes)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = inst.Close(context.Background()) })
 
@@ -211,14 +327,14 @@ func TestWazeroInstance_RunIntegrationHandlesContextCancelled(t *testing.T) {
 	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
 	cachePath := t.TempDir()
 
-	runner, err := newWazeroRunner(t.Context(), noopUI{}, cachePath, "", log)
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: cachePath}, log)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = runner.Close(context.Background()) })
 
 	wasmBytes, err := os.ReadFile("./testdata/minimal.wasm")
 	require.NoError(t, err)
 
-	inst, err := runner.Load(t.Context(), "test", wasmBytes, nil)
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test"}, wasmBytes)
 	require.NoError(t, err)
 	t.Cleanup(func() { _ = inst.Close(context.Background()) })
 
@@ -230,6 +346,52 @@ func TestWazeroInstance_RunIntegrationHandlesContextCancelled(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestWazeroInstance_RunStopsModuleExceedingMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: t.TempDir()}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	// i32.const 10; memory.grow 0; drop
+	wasmBytes := startModule(0x41, 0x0a, 0x40, 0x00, 0x1a)
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Limits: Limits{MemoryPages: 2}}, wasmBytes)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	assert.EqualError(t, err, "run: memory of 720896 bytes exceeds limit of 2 pages")
+	assert.Contains(t, buf.String(), `msg="Module exceeded resource limit, stopping module" module=test`)
+}
+
+func TestWazeroInstance_RunStopsModuleExceedingWatchdog(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+
+	runner, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{CachePath: t.TempDir()}, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close(context.Background()) })
+
+	// loop; br 0; end
+	wasmBytes := startModule(0x03, 0x40, 0x0c, 0x00, 0x0b)
+
+	inst, err := runner.Load(t.Context(), Descriptor{Name: "test", Limits: Limits{Watchdog: 50 * time.Millisecond}}, wasmBytes)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = inst.Close(context.Background()) })
+
+	err = inst.Run(t.Context())
+
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "watchdog deadline is 50ms")
+}
+
 func TestPluginLogWriter_WriteBuffersAndFlushesLines(t *testing.T) {
 	t.Parallel()
 
@@ -276,7 +438,7 @@ func TestPluginLogWriter_WriteBuffersAndFlushesLines(t *testing.T) {
 
 			var buf bytes.Buffer
 			log := logger.New(&buf, logger.LogfmtFormat(), logger.Trace)
-			w := newPluginLogWriter("test", log)
+			w := newPluginLogWriter("test", nil, log)
 
 			for _, chunk := range test.input {
 				n, err := w.Write([]byte(chunk))
@@ -340,7 +502,7 @@ func TestPluginLogWriter_WriteDispatchesLogLevels(t *testing.T) {
 
 			var buf bytes.Buffer
 			log := logger.New(&buf, logger.LogfmtFormat(), logger.Trace)
-			w := newPluginLogWriter("test", log)
+			w := newPluginLogWriter("test", nil, log)
 
 			_, err := w.Write([]byte(test.line))
 
@@ -406,9 +568,30 @@ func TestParseLogFmt(t *testing.T) {
 	}
 }
 
+// startModule returns a WASM module with one page of memory whose
+// _start function runs the given instructions.
+func startModule(instrs ...byte) []byte {
+	body := append(append([]byte{0x00}, instrs...), 0x0b)
+	code := append([]byte{0x01, byte(len(body))}, body...)
+
+	return slices.Concat(
+		[]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, // magic and version
+		[]byte{0x01, 0x04, 0x01, 0x60, 0x00, 0x00},             // type: func() -> ()
+		[]byte{0x03, 0x02, 0x01, 0x00},                         // function: type 0
+		[]byte{0x05, 0x03, 0x01, 0x00, 0x01},                   // memory: min 1 page
+		[]byte{0x07, 0x13, 0x02, // export: _start and memory
+			0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x00,
+			0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+		},
+		[]byte{0x0a, byte(len(code))}, code, // code
+	)
+}
+
 type noopUI struct{}
 
 func (noopUI) CreateModule(_, _, _ string)     {}
+func (noopUI) RemoveModule(_ string)           {}
+func (noopUI) MoveModule(_, _, _ string)       {}
 func (noopUI) ModuleUI(_ string) WidgetUpdater { return nil }
 
 type stubModule struct {
@@ -0,0 +1,403 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+// Default scheduler settings.
+const (
+	defaultMaxConcurrent = 4
+	defaultMaxRetries    = 3
+	defaultMaxRetryDelay = time.Minute
+
+	// retryBaseDelay is the backoff before the first retry. It doubles
+	// with every retry.
+	retryBaseDelay = 500 * time.Millisecond
+)
+
+// SchedulerConfig configures the scheduler of outbound module requests.
+type SchedulerConfig struct {
+	// MaxConcurrent is the number of requests a module may have waiting
+	// for a response at a time. Defaults to 4.
+	MaxConcurrent int `yaml:"maxConcurrent"`
+	// MaxRetries is the number of times a request is retried when it is
+	// rate limited or fails with a server error. Defaults to 3.
+	MaxRetries int `yaml:"maxRetries"`
+	// MaxRetryDelay is the longest delay before a retry. A request is not
+	// retried when the server asks for a longer delay. Defaults to 1m.
+	MaxRetryDelay time.Duration `yaml:"maxRetryDelay"`
+	// Hosts are the rate limits by host.
+	Hosts map[string]RateLimit `yaml:"hosts"`
+	// Keys are the rate limits by API key.
+	Keys []KeyRateLimit `yaml:"keys"`
+}
+
+// RateLimit is a token bucket rate limit.
+type RateLimit struct {
+	// Requests is the number of requests allowed in Per.
+	Requests int `yaml:"requests"`
+	// Per is the interval Requests are allowed in.
+	Per time.Duration `yaml:"per"`
+	// Burst is the number of requests that may be made at once.
+	// Defaults to 1.
+	Burst int `yaml:"burst"`
+}
+
+// Validate validates the rate limit.
+func (l RateLimit) Validate() error {
+	if l.Requests <= 0 {
+		return errors.New("requests must be greater than zero")
+	}
+	if l.Per <= 0 {
+		return errors.New("per must be greater than zero")
+	}
+	if l.Burst < 0 {
+		return errors.New("burst must be greater than or equal to zero")
+	}
+	return nil
+}
+
+// KeyRateLimit is a rate limit shared by all requests with the same API
+// key, whichever host they are made to. The key is read from either a
+// query parameter or a header.
+type KeyRateLimit struct {
+	// Query is the name of the query parameter holding the key.
+	Query string `yaml:"query"`
+	// Header is the name of the header holding the key.
+	Header string `yaml:"header"`
+
+	RateLimit `yaml:",inline"`
+}
+
+// Validate validates the scheduler configuration.
+func (c SchedulerConfig) Validate() error {
+	if c.MaxConcurrent < 0 {
+		return errors.New("config: scheduler max concurrent must be greater than or equal to zero")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("config: scheduler max retries must be greater than or equal to zero")
+	}
+	if c.MaxRetryDelay < 0 {
+		return errors.New("config: scheduler max retry delay must be greater than or equal to zero")
+	}
+	for host, l := range c.Hosts {
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("config: scheduler rate limit of %q: %w", host, err)
+		}
+	}
+	for i, l := range c.Keys {
+		if (l.Query == "") == (l.Header == "") {
+			return fmt.Errorf("config: scheduler key rate limit %d must have either a query or a header", i)
+		}
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("config: scheduler key rate limit %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// tokenBucket is a token bucket rate limiter. Callers reserve a token and
+// wait until it is available, so requests are served in order.
+type tokenBucket struct {
+	interval time.Duration
+	burst    int
+
+	mu sync.Mutex
+	// next is the time the bucket is empty until. A full bucket has a
+	// next of burst intervals ago.
+	next time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	burst := l.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		interval: l.Per / time.Duration(l.Requests),
+		burst:    burst,
+	}
+}
+
+// reserve takes a token, returning how long to wait before using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if full := now.Add(-time.Duration(b.burst) * b.interval); b.next.Before(full) {
+		b.next = full
+	}
+	b.next = b.next.Add(b.interval)
+	return max(b.next.Sub(now), 0)
+}
+
+// pause empties the bucket, so the next token is available at t.
+func (b *tokenBucket) pause(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t = t.Add(-b.interval); b.next.Before(t) {
+		b.next = t
+	}
+}
+
+// scheduler schedules outbound module requests. Requests are rate limited
+// by host and by API key across all modules, and idempotent requests are
+// retried when they are rate limited or fail with a server error.
+type scheduler struct {
+	maxConcurrent int
+	maxRetries    int
+	maxRetryDelay time.Duration
+	hostLimits    map[string]RateLimit
+	keyLimits     []KeyRateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	// wait waits for d, or until ctx is done.
+	wait func(ctx context.Context, d time.Duration) error
+
+	log *logger.Logger
+}
+
+// newScheduler returns a request scheduler configured by cfg.
+func newScheduler(cfg SchedulerConfig, log *logger.Logger) *scheduler {
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = defaultMaxConcurrent
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	maxRetryDelay := cfg.MaxRetryDelay
+	if maxRetryDelay == 0 {
+		maxRetryDelay = defaultMaxRetryDelay
+	}
+
+	return &scheduler{
+		maxConcurrent: maxConcurrent,
+		maxRetries:    maxRetries,
+		maxRetryDelay: maxRetryDelay,
+		hostLimits:    cfg.Hosts,
+		keyLimits:     cfg.Keys,
+		buckets:       map[string]*tokenBucket{},
+		wait:          sleep,
+		log:           log,
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// bucketsFor returns the token buckets limiting req.
+func (s *scheduler) bucketsFor(req *http.Request) []*tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buckets []*tokenBucket
+	host := req.URL.Hostname()
+	if l, ok := s.hostLimits[host]; ok {
+		buckets = append(buckets, s.bucket("host:"+host, l))
+	}
+	for _, l := range s.keyLimits {
+		var key string
+		switch {
+		case l.Query != "":
+			key = req.URL.Query().Get(l.Query)
+		default:
+			key = req.Header.Get(l.Header)
+		}
+		if key == "" {
+			continue
+		}
+		buckets = append(buckets, s.bucket("key:"+l.Query+":"+l.Header+":"+key, l.RateLimit))
+	}
+	return buckets
+}
+
+func (s *scheduler) bucket(id string, l RateLimit) *tokenBucket {
+	b, ok := s.buckets[id]
+	if !ok {
+		b = newTokenBucket(l)
+		s.buckets[id] = b
+	}
+	return b
+}
+
+// transport returns a round tripper scheduling the requests of the named
+// module, making requests with next.
+func (s *scheduler) transport(name string, next http.RoundTripper) http.RoundTripper {
+	return &schedulingTransport{
+		sched: s,
+		name:  name,
+		sem:   make(chan struct{}, s.maxConcurrent),
+		next:  next,
+	}
+}
+
+// schedulingTransport schedules the requests of a module.
+type schedulingTransport struct {
+	sched *scheduler
+	name  string
+	sem   chan struct{}
+	next  http.RoundTripper
+}
+
+// RoundTrip makes a request once it is allowed by the rate limits. A slot
+// of the module concurrency cap is held until response headers are
+// received.
+func (t *schedulingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-t.sem }()
+
+	for attempt := 0; ; attempt++ {
+		if err := t.throttle(req); err != nil {
+			return nil, err
+		}
+
+		out := req
+		if attempt > 0 {
+			out = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				out.Body = body
+			}
+		}
+
+		resp, err := t.next.RoundTrip(out)
+		if err != nil || attempt >= t.sched.maxRetries || !retryable(req, resp.StatusCode) {
+			return resp, err
+		}
+
+		delay, ok := t.retryDelay(req, resp, attempt)
+		if !ok {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+
+		t.sched.log.Info("http scheduler: retrying request",
+			lctx.Str("module", t.name),
+			lctx.Str("host", req.URL.Host),
+			lctx.Int("status", resp.StatusCode),
+			lctx.Int("attempt", attempt+1),
+			lctx.Duration("delay", delay),
+		)
+		if err = t.sched.wait(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// throttle waits until req is allowed by all rate limits.
+func (t *schedulingTransport) throttle(req *http.Request) error {
+	now := time.Now()
+	var delay time.Duration
+	for _, b := range t.sched.bucketsFor(req) {
+		delay = max(delay, b.reserve(now))
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	t.sched.log.Info("http scheduler: request throttled",
+		lctx.Str("module", t.name),
+		lctx.Str("host", req.URL.Host),
+		lctx.Duration("delay", delay),
+	)
+	return t.sched.wait(req.Context(), delay)
+}
+
+// retryDelay returns the delay before retrying req, and whether it should
+// be retried. A Retry-After given by the server pauses all requests to the
+// host.
+func (t *schedulingTransport) retryDelay(req *http.Request, resp *http.Response, attempt int) (time.Duration, bool) {
+	if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		if d > t.sched.maxRetryDelay {
+			return 0, false
+		}
+		for _, b := range t.sched.bucketsFor(req) {
+			b.pause(time.Now().Add(d))
+		}
+		return d, true
+	}
+
+	// Full jitter keeps modules that failed together from retrying together.
+	backoff := min(retryBaseDelay<<attempt, t.sched.maxRetryDelay)
+	return rand.N(backoff) + 1, true //nolint:gosec // Jitter does not need a secure source.
+}
+
+// CloseIdleConnections closes the idle connections of the underlying
+// transport.
+func (t *schedulingTransport) CloseIdleConnections() {
+	if tr, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// retryable reports whether req may be retried after a response with
+// status. Only idempotent requests are retried, and requests with a body
+// only if the body can be replayed.
+func retryable(req *http.Request, status int) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given in either seconds or
+// as an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,325 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SchedulerConfig
+		wantErr string
+	}{
+		{
+			name: "valid config",
+			cfg: SchedulerConfig{
+				MaxConcurrent: 2,
+				Hosts:         map[string]RateLimit{"example.com": {Requests: 60, Per: time.Minute}},
+				Keys:          []KeyRateLimit{{Query: "appid", RateLimit: RateLimit{Requests: 1000, Per: 24 * time.Hour}}},
+			},
+		},
+		{
+			name:    "handles negative max concurrent",
+			cfg:     SchedulerConfig{MaxConcurrent: -1},
+			wantErr: "config: scheduler max concurrent must be greater than or equal to zero",
+		},
+		{
+			name:    "handles negative max retries",
+			cfg:     SchedulerConfig{MaxRetries: -1},
+			wantErr: "config: scheduler max retries must be greater than or equal to zero",
+		},
+		{
+			name:    "handles invalid host rate limit",
+			cfg:     SchedulerConfig{Hosts: map[string]RateLimit{"example.com": {Requests: 60}}},
+			wantErr: `config: scheduler rate limit of "example.com": per must be greater than zero`,
+		},
+		{
+			name:    "handles key rate limit without a key",
+			cfg:     SchedulerConfig{Keys: []KeyRateLimit{{RateLimit: RateLimit{Requests: 1, Per: time.Second}}}},
+			wantErr: "config: scheduler key rate limit 0 must have either a query or a header",
+		},
+		{
+			name:    "handles invalid key rate limit",
+			cfg:     SchedulerConfig{Keys: []KeyRateLimit{{Header: "X-Api-Key", RateLimit: RateLimit{Per: time.Second}}}},
+			wantErr: "config: scheduler key rate limit 0: requests must be greater than zero",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.cfg.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNewWazeroRunner_SchedulesOnlyWhenConfigured(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	tests := []struct {
+		name      string
+		scheduler *SchedulerConfig
+		want      bool
+	}{
+		{
+			name: "off without a scheduler",
+		},
+		{
+			name:      "on with a scheduler",
+			scheduler: &SchedulerConfig{},
+			want:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := newWazeroRunner(t.Context(), noopUI{}, ExecContext{DataPath: t.TempDir(), Scheduler: test.scheduler}, log)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = r.Close(context.Background()) })
+
+			assert.Equal(t, test.want, r.env.sched != nil)
+		})
+	}
+}
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	b := newTokenBucket(RateLimit{Requests: 1, Per: time.Second, Burst: 2})
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now.Add(time.Second)))
+	assert.Equal(t, time.Duration(0), b.reserve(now.Add(10*time.Second)))
+
+	b.pause(now.Add(15 * time.Second))
+	assert.Equal(t, 5*time.Second, b.reserve(now.Add(10*time.Second)))
+}
+
+func TestSchedulingTransport_ThrottlesByHost(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	var buf bytes.Buffer
+	client, waits := newSchedulingClient(t, &buf, SchedulerConfig{
+		Hosts: map[string]RateLimit{"127.0.0.1": {Requests: 1, Per: time.Minute}},
+	})
+
+	doRequest(t, client, http.MethodGet, srv.URL)
+	doRequest(t, client, http.MethodGet, srv.URL)
+
+	require.Len(t, waits(), 1)
+	assert.InDelta(t, time.Minute, waits()[0], float64(time.Second))
+	assert.Contains(t, buf.String(), `msg="http scheduler: request throttled" module=test host=`+strings.TrimPrefix(srv.URL, "http://"))
+}
+
+func TestSchedulingTransport_ThrottlesByKey(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	client, waits := newSchedulingClient(t, &bytes.Buffer{}, SchedulerConfig{
+		Keys: []KeyRateLimit{{Query: "appid", RateLimit: RateLimit{Requests: 1, Per: time.Minute}}},
+	})
+
+	doRequest(t, client, http.MethodGet, srv.URL+"?appid=a")
+	doRequest(t, client, http.MethodGet, srv.URL+"?appid=b")
+	doRequest(t, client, http.MethodGet, srv.URL)
+	assert.Empty(t, waits())
+
+	doRequest(t, client, http.MethodGet, srv.URL+"/other?appid=a")
+	assert.Len(t, waits(), 1)
+}
+
+func TestSchedulingTransport_RetriesAfterRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if hits.Add(1) == 1 {
+			rw.Header().Set("Retry-After", "2")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = rw.Write([]byte("sunny"))
+	}))
+	t.Cleanup(srv.Close)
+
+	var buf bytes.Buffer
+	client, waits := newSchedulingClient(t, &buf, SchedulerConfig{})
+
+	status := doRequest(t, client, http.MethodGet, srv.URL)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, []time.Duration{2 * time.Second}, waits())
+	assert.Contains(t, buf.String(), `msg="http scheduler: retrying request" module=test`)
+}
+
+func TestSchedulingTransport_DoesNotRetryRateLimitedPost(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		rw.Header().Set("Retry-After", "2")
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, waits := newSchedulingClient(t, &bytes.Buffer{}, SchedulerConfig{})
+
+	status := doRequest(t, client, http.MethodPost, srv.URL)
+
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, int32(1), hits.Load())
+	assert.Empty(t, waits())
+}
+
+func TestSchedulingTransport_RetriesServerErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+		wantHits   int32
+	}{
+		{
+			name:       "retries idempotent requests",
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+			wantHits:   3,
+		},
+		{
+			name:       "does not retry other requests",
+			method:     http.MethodPost,
+			wantStatus: http.StatusServiceUnavailable,
+			wantHits:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				hits.Add(1)
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			t.Cleanup(srv.Close)
+
+			client, waits := newSchedulingClient(t, &bytes.Buffer{}, SchedulerConfig{MaxRetries: 2})
+
+			status := doRequest(t, client, test.method, srv.URL)
+
+			assert.Equal(t, test.wantStatus, status)
+			assert.Equal(t, test.wantHits, hits.Load())
+			for i, d := range waits() {
+				assert.LessOrEqual(t, d, retryBaseDelay<<i)
+			}
+		})
+	}
+}
+
+func TestSchedulingTransport_CapsConcurrency(t *testing.T) {
+	t.Parallel()
+
+	var inflight atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		inflight.Add(1)
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _ := newSchedulingClient(t, &bytes.Buffer{}, SchedulerConfig{MaxConcurrent: 2})
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			resp, err := client.Get(srv.URL)
+			if assert.NoError(t, err) {
+				_ = resp.Body.Close()
+			}
+		})
+	}
+	for inflight.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal(t, int32(2), inflight.Load())
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(4), inflight.Load())
+}
+
+// newSchedulingClient returns a client scheduling requests for the module
+// "test", and a function returning the delays it waited for.
+func newSchedulingClient(t *testing.T, buf *bytes.Buffer, cfg SchedulerConfig) (*http.Client, func() []time.Duration) {
+	t.Helper()
+
+	var (
+		mu    sync.Mutex
+		waits []time.Duration
+	)
+	log := logger.New(buf, logger.LogfmtFormat(), logger.Info)
+	sched := newScheduler(cfg, log)
+	sched.wait = func(_ context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		waits = append(waits, d)
+		return nil
+	}
+
+	client := &http.Client{Transport: sched.transport("test", http.DefaultTransport)}
+	return client, func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return waits
+	}
+}
+
+func doRequest(t *testing.T, client *http.Client, method, uri string) int {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), method, uri, strings.NewReader("body"))
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	return resp.StatusCode
+}
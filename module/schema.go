@@ -0,0 +1,199 @@
+package module
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+)
+
+var schemaPrinter = message.NewPrinter(language.English)
+
+// configLines maps the JSON pointers of the values in a module
+// configuration to their line in the configuration file.
+type configLines map[string]int
+
+// newConfigLines returns the lines of the values in the config node n.
+func newConfigLines(n *yaml.Node) configLines {
+	lines := configLines{}
+	var walk func(ptr string, n *yaml.Node)
+	walk = func(ptr string, n *yaml.Node) {
+		lines[ptr] = n.Line
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := n.Content[i]
+				p := ptr + "/" + escapePointer(key.Value)
+				walk(p, n.Content[i+1])
+				// Values are reported on the line of their key.
+				lines[p] = key.Line
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				walk(ptr+"/"+strconv.Itoa(i), c)
+			}
+		}
+	}
+	walk("", n)
+	return lines
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// schemaConfig returns the config of the module described by desc with
+// the defaults of schema applied, validated against schema.
+func schemaConfig(desc Descriptor, schema map[string]any) (map[string]any, error) {
+	cfg := desc.Config
+	if cfg == nil {
+		cfg = map[string]any{}
+	}
+	cfg, _ = applyDefaults(schema, cfg).(map[string]any)
+	if err := validateConfig(desc.Name, schema, cfg, desc.configLines); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateConfig validates the configuration of the named module against
+// the JSON Schema schema.
+func validateConfig(name string, schema, cfg map[string]any, lines configLines) error {
+	sch, err := compileSchema(schema)
+	if err != nil {
+		return fmt.Errorf("%s: invalid config schema: %w", name, err)
+	}
+
+	inst, err := toJSONValue(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: invalid config: %w", name, err)
+	}
+	err = sch.Validate(inst)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+
+	var errs []error
+	for _, e := range leafErrors(verr) {
+		loc := e.InstanceLocation
+		// Point at the first unknown property rather than its parent.
+		if ap, ok := e.ErrorKind.(*kind.AdditionalProperties); ok && len(ap.Properties) > 0 {
+			loc = append(slices.Clone(loc), ap.Properties[0])
+		}
+
+		msg := fmt.Sprintf("%s: %s", name, configPath(loc))
+		if line, ok := lines.line(loc); ok {
+			msg += fmt.Sprintf(" (line %d)", line)
+		}
+		errs = append(errs, fmt.Errorf("%s: %s", msg, e.ErrorKind.LocalizedString(schemaPrinter)))
+	}
+	return errors.Join(errs...)
+}
+
+func compileSchema(schema map[string]any) (*jsonschema.Schema, error) {
+	doc, err := toJSONValue(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	if err = c.AddResource("config.json", doc); err != nil {
+		return nil, err
+	}
+	return c.Compile("config.json")
+}
+
+// toJSONValue converts v into the values the schema validator expects.
+func toJSONValue(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonschema.UnmarshalJSON(bytes.NewReader(b))
+}
+
+func leafErrors(e *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(e.Causes) == 0 {
+		return []*jsonschema.ValidationError{e}
+	}
+	var errs []*jsonschema.ValidationError
+	for _, c := range e.Causes {
+		errs = append(errs, leafErrors(c)...)
+	}
+	return errs
+}
+
+// line returns the line of the value at loc, or of its closest parent.
+func (l configLines) line(loc []string) (int, bool) {
+	for i := len(loc); i >= 0; i-- {
+		ptr := ""
+		for _, tok := range loc[:i] {
+			ptr += "/" + escapePointer(tok)
+		}
+		if line, ok := l[ptr]; ok && line > 0 {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+// configPath returns the YAML path of loc, e.g. "config.calendars[0].url".
+func configPath(loc []string) string {
+	var sb strings.Builder
+	sb.WriteString("config")
+	for _, tok := range loc {
+		if _, err := strconv.Atoi(tok); err == nil {
+			sb.WriteString("[" + tok + "]")
+			continue
+		}
+		sb.WriteString("." + tok)
+	}
+	return sb.String()
+}
+
+// applyDefaults returns a copy of v with the defaults of the properties
+// in schema that are not set. v is not modified.
+func applyDefaults(schema map[string]any, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		out := maps.Clone(v)
+		for k, p := range props {
+			ps, ok := p.(map[string]any)
+			if !ok {
+				continue
+			}
+			if val, ok := out[k]; ok {
+				out[k] = applyDefaults(ps, val)
+				continue
+			}
+			if def, ok := ps["default"]; ok {
+				out[k] = applyDefaults(ps, def)
+			}
+		}
+		return out
+	case []any:
+		items, ok := schema["items"].(map[string]any)
+		if !ok {
+			return v
+		}
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = applyDefaults(items, val)
+		}
+		return out
+	default:
+		return v
+	}
+}
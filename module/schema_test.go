@@ -0,0 +1,153 @@
+package module
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateConfig(t *testing.T) {
+	t.Parallel()
+
+	schema := map[string]any{
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []any{"calendars"},
+		"properties": map[string]any{
+			"maxDays": map[string]any{"type": "integer"},
+			"calendars": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type":     "object",
+					"required": []any{"url"},
+					"properties": map[string]any{
+						"url": map[string]any{"type": "string", "format": "uri"},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid config",
+			config: `
+config:
+  maxDays: 3
+  calendars:
+    - url: https://example.com/cal.ics`,
+		},
+		{
+			name: "wrong type",
+			config: `
+config:
+  maxDays: three
+  calendars: []`,
+			wantErr: "cal: config.maxDays (line 3): got string, want integer",
+		},
+		{
+			name: "wrong nested type",
+			config: `
+config:
+  calendars:
+    - url: https://example.com/cal.ics
+    - url: 12`,
+			wantErr: "cal: config.calendars[1].url (line 5): got number, want string",
+		},
+		{
+			name: "unknown property",
+			config: `
+config:
+  calendars: []
+  maxdays: 3`,
+			wantErr: "cal: config.maxdays (line 4): additional properties 'maxdays' not allowed",
+		},
+		{
+			name: "missing property",
+			config: `
+config:
+  maxDays: 3`,
+			wantErr: "cal: config (line 2): missing property 'calendars'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var desc Descriptor
+			err := yaml.Unmarshal([]byte(test.config), &desc)
+			require.NoError(t, err)
+
+			err = validateConfig("cal", schema, desc.Config, desc.configLines)
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateConfig_HandlesInvalidSchema(t *testing.T) {
+	t.Parallel()
+
+	schema := map[string]any{"type": "thing"}
+
+	err := validateConfig("cal", schema, map[string]any{}, nil)
+
+	assert.ErrorContains(t, err, "cal: invalid config schema")
+}
+
+func TestApplyDefaults(t *testing.T) {
+	t.Parallel()
+
+	schema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"units":   map[string]any{"type": "string", "default": "metric"},
+			"maxDays": map[string]any{"type": "integer", "default": 5},
+			"display": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"icons": map[string]any{"type": "boolean", "default": true},
+				},
+			},
+			"calendars": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"color": map[string]any{"type": "string", "default": "#fff"},
+					},
+				},
+			},
+		},
+	}
+	cfg := map[string]any{
+		"maxDays":   3,
+		"display":   map[string]any{},
+		"calendars": []any{map[string]any{"url": "a"}, map[string]any{"url": "b", "color": "#000"}},
+	}
+
+	got := applyDefaults(schema, cfg)
+
+	want := map[string]any{
+		"units":   "metric",
+		"maxDays": 3,
+		"display": map[string]any{"icons": true},
+		"calendars": []any{
+			map[string]any{"url": "a", "color": "#fff"},
+			map[string]any{"url": "b", "color": "#000"},
+		},
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, map[string]any{}, cfg["display"], "the config must not be modified")
+}
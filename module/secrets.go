@@ -0,0 +1,150 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	// redacted replaces secret values in logs.
+	redacted = "[REDACTED]"
+
+	// minRedactLen is the length below which secret values are not
+	// redacted, as they would match too much of the logs.
+	minRedactLen = 4
+)
+
+// Secrets holds the secrets modules may look up at runtime. Secrets are
+// named by their dotted path in the secrets file, e.g. "weather.appId".
+type Secrets struct {
+	mu       sync.RWMutex
+	values   map[string]string
+	replacer *strings.Replacer
+}
+
+// NewSecrets returns the secrets parsed from a secrets file.
+func NewSecrets(secrets map[string]any) *Secrets {
+	s := &Secrets{}
+	s.Update(secrets)
+	return s
+}
+
+// Update replaces the secrets.
+func (s *Secrets) Update(secrets map[string]any) {
+	values := map[string]string{}
+	flattenSecrets(values, "", secrets)
+
+	// Longer values are replaced first, so a value containing another is
+	// not partially redacted.
+	vals := slices.SortedFunc(maps.Values(values), func(a, b string) int { return len(b) - len(a) })
+	var oldnew []string
+	for _, v := range slices.Compact(vals) {
+		if len(v) < minRedactLen {
+			continue
+		}
+		oldnew = append(oldnew, v, redacted)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = values
+	s.replacer = strings.NewReplacer(oldnew...)
+}
+
+func flattenSecrets(values map[string]string, prefix string, secrets map[string]any) {
+	for k, v := range secrets {
+		name := prefix + k
+		switch v := v.(type) {
+		case map[string]any:
+			flattenSecrets(values, name+".", v)
+		case nil:
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// lookup returns the value of the named secret.
+func (s *Secrets) lookup(name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.values[name]
+	return v, ok
+}
+
+// redact replaces the secret values in str.
+func (s *Secrets) redact(str string) string {
+	if s == nil {
+		return str
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.replacer.Replace(str)
+}
+
+// Writer returns a writer redacting secret values from what is written
+// to w. Each write must be complete, such as a log line.
+func (s *Secrets) Writer(w io.Writer) io.Writer {
+	return redactWriter{secrets: s, w: w}
+}
+
+type redactWriter struct {
+	secrets *Secrets
+	w       io.Writer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.secrets.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// secretGetFunc reads the value of a secret granted to the module.
+func secretGetFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		namePtr := uint32(stack[0])
+		nameLen := uint32(stack[1])
+		bufPtr := uint32(stack[2])
+		bufLen := uint32(stack[3])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		name, ok := mod.Memory().Read(namePtr, nameLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		if !slices.Contains(menv.secrets, string(name)) {
+			env.log.Warn("secret_get: secret not granted", lctx.Str("module", mod.Name()), lctx.Str("secret", string(name)))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		v, ok := env.secrets.lookup(string(name))
+		if !ok {
+			stack[0] = errno(errnoNotFound)
+			return
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, []byte(v))
+	}
+}
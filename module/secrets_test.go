@@ -0,0 +1,131 @@
+package module
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecrets_Redact(t *testing.T) {
+	secrets := NewSecrets(map[string]any{
+		"weather": map[string]any{
+			"appId": "abc123",
+			"units": "si",
+		},
+		"token":  "abc123def",
+		"number": 12345,
+	})
+
+	got := secrets.redact("appid=abc123 token=abc123def units=si number=12345")
+
+	assert.Equal(t, "appid=[REDACTED] token=[REDACTED] units=si number=[REDACTED]", got)
+}
+
+func TestSecrets_Update(t *testing.T) {
+	secrets := NewSecrets(map[string]any{"token": "first-token"})
+
+	secrets.Update(map[string]any{"token": "second-token"})
+
+	v, ok := secrets.lookup("token")
+	require.True(t, ok)
+	assert.Equal(t, "second-token", v)
+	assert.Equal(t, "first-token [REDACTED]", secrets.redact("first-token second-token"))
+}
+
+func TestSecrets_Writer(t *testing.T) {
+	secrets := NewSecrets(map[string]any{"token": "s3cr3t"})
+
+	var buf bytes.Buffer
+	log := logger.New(secrets.Writer(&buf), logger.LogfmtFormat(), logger.Info)
+	log.Info("Calling api", lctx.Str("url", "https://example.com/?key=s3cr3t"))
+
+	assert.Contains(t, buf.String(), `url="https://example.com/?key=[REDACTED]"`)
+	assert.NotContains(t, buf.String(), "s3cr3t")
+}
+
+func TestPluginLogWriter_RedactsSecrets(t *testing.T) {
+	secrets := NewSecrets(map[string]any{"token": "s3cr3t"})
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	w := newPluginLogWriter("test", secrets, log)
+
+	_, err := w.Write([]byte("level=info msg=\"using s3cr3t\" token=s3cr3t\n"))
+	require.NoError(t, err)
+
+	assert.Contains(t, buf.String(), `msg="using [REDACTED]"`)
+	assert.Contains(t, buf.String(), `token=[REDACTED]`)
+	assert.NotContains(t, buf.String(), "s3cr3t")
+}
+
+func TestSecretGetFunc(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		secret  string
+		bufLen  int
+		want    string
+		wantN   int32
+		wantLog string
+	}{
+		{
+			name:   "returns a granted secret",
+			secret: "weather.appId",
+			bufLen: 16,
+			want:   "abc123",
+			wantN:  6,
+		},
+		{
+			name:   "returns the length when the buffer is too small",
+			secret: "weather.appId",
+			bufLen: 2,
+			wantN:  6,
+		},
+		{
+			name:    "handles secret not granted",
+			secret:  "token",
+			bufLen:  16,
+			wantN:   errnoPermission,
+			wantLog: `msg="secret_get: secret not granted" module=test secret=token`,
+		},
+		{
+			name:   "handles missing secret",
+			secret: "missing",
+			bufLen: 16,
+			wantN:  errnoNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+			env := newHostEnv(noopUI{}, "", log)
+			env.secrets = NewSecrets(map[string]any{
+				"weather": map[string]any{"appId": "abc123"},
+				"token":   "s3cr3t",
+			})
+			menv := mustRegister(t, env, Descriptor{Name: "test", Secrets: []string{"weather.appId", "missing"}})
+			t.Cleanup(func() { env.unregister(menv) })
+			mod := newMemModule("test")
+
+			stack := mod.call(test.secret, test.bufLen)
+			secretGetFunc(env)(t.Context(), mod, stack)
+
+			assert.Equal(t, test.wantN, int32(stack[0]))
+			if test.want != "" {
+				assert.Equal(t, test.want, mod.result(stack[0]))
+			}
+			if test.wantLog != "" {
+				assert.Contains(t, buf.String(), test.wantLog)
+			}
+		})
+	}
+}
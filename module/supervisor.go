@@ -0,0 +1,268 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	lctx "github.com/hamba/logger/v2/ctx"
+)
+
+// Restart policies.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+
+	// stablePeriod is how long a module must run for its restarts to be
+	// forgiven, so occasional crashes never reach the restart limit.
+	stablePeriod = 10 * time.Minute
+)
+
+// RestartPolicy describes when a module is restarted after its plugin stops.
+type RestartPolicy struct {
+	// Policy is one of "never", "on-failure" or "always".
+	// Defaults to "on-failure".
+	Policy string `yaml:"policy"`
+	// MaxRestarts is the maximum number of restarts. Zero means no limit.
+	MaxRestarts int `yaml:"maxRestarts"`
+	// Backoff is the delay before the first restart. It doubles with every
+	// subsequent restart. Defaults to 1s.
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff caps the restart delay. Defaults to 5m.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// Validate validates the restart policy.
+func (p RestartPolicy) Validate() error {
+	switch p.Policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("invalid restart policy %q", p.Policy)
+	}
+	if p.MaxRestarts < 0 {
+		return errors.New("max restarts must be greater than or equal to zero")
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("restart backoff must be greater than or equal to zero")
+	}
+	return nil
+}
+
+func (p RestartPolicy) shouldRestart(runErr error, restarts int) bool {
+	if isPermanent(runErr) {
+		return false
+	}
+	if p.MaxRestarts > 0 && restarts >= p.MaxRestarts {
+		return false
+	}
+
+	switch p.Policy {
+	case RestartNever:
+		return false
+	case RestartAlways:
+		return true
+	default:
+		return runErr != nil
+	}
+}
+
+func (p RestartPolicy) delay(restarts int) time.Duration {
+	backoff := p.Backoff
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	d := backoff
+	for range restarts {
+		d *= 2
+		if d >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return d
+}
+
+// permanentError is an error restarting the module cannot fix, such as
+// a module requiring a host ABI the host does not support.
+type permanentError struct {
+	err error
+}
+
+// permanent marks err as permanent, so the module is not restarted.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func isPermanent(err error) bool {
+	_, ok := errors.AsType[*permanentError](err)
+	return ok
+}
+
+// Module states.
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateBackoff  = "backoff"
+	StateStopped  = "stopped"
+	StateFailed   = "failed"
+)
+
+// Status is the runtime status of a loaded module.
+type Status struct {
+	Name      string
+	State     string
+	Restarts  int
+	LastError error
+	// LastErrorAt is the time the last error occurred.
+	LastErrorAt time.Time
+}
+
+// supervisor drives a plugin, restarting it according to its restart policy.
+type supervisor struct {
+	name   string
+	policy RestartPolicy
+	load   func(ctx context.Context) (PluginInstance, error)
+	// clock times runs and restart delays, the system clock if nil.
+	clock Clock
+
+	mu     sync.Mutex
+	status Status
+
+	log *logger.Logger
+}
+
+func newSupervisor(name string, policy RestartPolicy, load func(context.Context) (PluginInstance, error), log *logger.Logger) *supervisor {
+	return &supervisor{
+		name:   name,
+		policy: policy,
+		load:   load,
+		status: Status{Name: name, State: StateStarting},
+		log:    log,
+	}
+}
+
+// Status returns the current status of the supervised module.
+func (s *supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+func (s *supervisor) setState(state string) {
+	s.mu.Lock()
+	s.status.State = state
+	s.mu.Unlock()
+}
+
+func (s *supervisor) setError(err error) {
+	s.mu.Lock()
+	s.status.LastError = err
+	s.status.LastErrorAt = s.now()
+	s.mu.Unlock()
+}
+
+// run drives the plugin until ctx is cancelled or the restart policy
+// decides the plugin should stay stopped. The restart count and delay are
+// reset once the plugin has run for the stable period.
+func (s *supervisor) run(ctx context.Context) {
+	var restarts int
+	for {
+		s.setState(StateStarting)
+
+		started := s.now()
+		runErr := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			s.setState(StateStopped)
+			return
+		}
+		if runErr != nil {
+			s.log.Error("Plugin run error", lctx.Str("module", s.name), lctx.Err(runErr))
+
+			s.setError(runErr)
+		}
+		if s.now().Sub(started) >= stablePeriod {
+			restarts = 0
+		}
+
+		if !s.policy.shouldRestart(runErr, restarts) {
+			state := StateStopped
+			if runErr != nil {
+				state = StateFailed
+			}
+			s.setState(state)
+			return
+		}
+
+		d := s.policy.delay(restarts)
+
+		s.log.Info("Restarting module", lctx.Str("module", s.name), lctx.Duration("backoff", d), lctx.Int("restarts", restarts+1))
+
+		s.setState(StateBackoff)
+		if !s.sleep(ctx, d) {
+			s.setState(StateStopped)
+			return
+		}
+
+		restarts++
+		s.mu.Lock()
+		s.status.Restarts++
+		s.mu.Unlock()
+	}
+}
+
+func (s *supervisor) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// sleep waits for d to pass, reporting false if ctx is done first.
+func (s *supervisor) sleep(ctx context.Context, d time.Duration) bool {
+	if s.clock != nil {
+		return s.clock.Sleep(ctx, d) == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *supervisor) runOnce(ctx context.Context) error {
+	instance, err := s.load(ctx)
+	if err != nil {
+		return fmt.Errorf("loading module: %w", err)
+	}
+	defer func() {
+		_ = instance.Close(context.WithoutCancel(ctx))
+	}()
+
+	s.log.Info("Starting module", lctx.Str("module", s.name))
+
+	s.setState(StateRunning)
+
+	return instance.Run(ctx)
+}
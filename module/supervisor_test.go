@@ -0,0 +1,315 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartPolicy_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		policy  RestartPolicy
+		wantErr string
+	}{
+		{
+			name:   "valid policy",
+			policy: RestartPolicy{Policy: RestartAlways, MaxRestarts: 3, Backoff: time.Second},
+		},
+		{
+			name:   "empty policy",
+			policy: RestartPolicy{},
+		},
+		{
+			name:    "handles invalid policy",
+			policy:  RestartPolicy{Policy: "sometimes"},
+			wantErr: `invalid restart policy "sometimes"`,
+		},
+		{
+			name:    "handles negative max restarts",
+			policy:  RestartPolicy{MaxRestarts: -1},
+			wantErr: "max restarts must be greater than or equal to zero",
+		},
+		{
+			name:    "handles negative backoff",
+			policy:  RestartPolicy{Backoff: -time.Second},
+			wantErr: "restart backoff must be greater than or equal to zero",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := test.policy.Validate()
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRestartPolicy_ShouldRestart(t *testing.T) {
+	t.Parallel()
+
+	runErr := errors.New("test")
+
+	tests := []struct {
+		name     string
+		policy   RestartPolicy
+		runErr   error
+		restarts int
+		want     bool
+	}{
+		{name: "never on error", policy: RestartPolicy{Policy: RestartNever}, runErr: runErr, want: false},
+		{name: "on-failure on error", policy: RestartPolicy{Policy: RestartOnFailure}, runErr: runErr, want: true},
+		{name: "on-failure on success", policy: RestartPolicy{Policy: RestartOnFailure}, want: false},
+		{name: "default on error", policy: RestartPolicy{}, runErr: runErr, want: true},
+		{name: "always on success", policy: RestartPolicy{Policy: RestartAlways}, want: true},
+		{name: "max restarts reached", policy: RestartPolicy{Policy: RestartAlways, MaxRestarts: 2}, restarts: 2, want: false},
+		{name: "max restarts not reached", policy: RestartPolicy{Policy: RestartAlways, MaxRestarts: 2}, restarts: 1, want: true},
+		{name: "always on permanent error", policy: RestartPolicy{Policy: RestartAlways}, runErr: permanent(runErr), want: false},
+		{name: "on-failure on wrapped permanent error", policy: RestartPolicy{}, runErr: fmt.Errorf("loading module: %w", permanent(runErr)), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := test.policy.shouldRestart(test.runErr, test.restarts)
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestRestartPolicy_Delay(t *testing.T) {
+	t.Parallel()
+
+	policy := RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	assert.Equal(t, time.Second, policy.delay(0))
+	assert.Equal(t, 2*time.Second, policy.delay(1))
+	assert.Equal(t, 4*time.Second, policy.delay(2))
+	assert.Equal(t, 5*time.Second, policy.delay(3))
+	assert.Equal(t, 5*time.Second, policy.delay(100))
+	assert.Equal(t, defaultBackoff, RestartPolicy{}.delay(0))
+}
+
+func TestSupervisor_RunRestartsOnFailure(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	var loads atomic.Int32
+	load := func(context.Context) (PluginInstance, error) {
+		loads.Add(1)
+		return &funcInstance{run: func(context.Context) error { return errors.New("crashed") }}, nil
+	}
+	policy := RestartPolicy{Policy: RestartOnFailure, MaxRestarts: 2, Backoff: time.Millisecond}
+	sup := newSupervisor("test", policy, load, log)
+
+	sup.run(t.Context())
+
+	got := sup.Status()
+	assert.Equal(t, int32(3), loads.Load())
+	assert.Equal(t, "test", got.Name)
+	assert.Equal(t, StateFailed, got.State)
+	assert.Equal(t, 2, got.Restarts)
+	require.Error(t, got.LastError)
+	assert.EqualError(t, got.LastError, "crashed")
+	assert.False(t, got.LastErrorAt.IsZero())
+}
+
+func TestSupervisor_RunHandlesLoadError(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	load := func(context.Context) (PluginInstance, error) {
+		return nil, errors.New("test")
+	}
+	sup := newSupervisor("test", RestartPolicy{Policy: RestartNever}, load, log)
+
+	sup.run(t.Context())
+
+	got := sup.Status()
+	assert.Equal(t, StateFailed, got.State)
+	assert.EqualError(t, got.LastError, "loading module: test")
+}
+
+func TestSupervisor_RunResetsRestartsAfterStablePeriod(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	clock := &stepClock{now: time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)}
+	var loads int
+	load := func(context.Context) (PluginInstance, error) {
+		loads++
+		stable := loads <= 3
+		return &funcInstance{run: func(context.Context) error {
+			if stable {
+				clock.advance(stablePeriod)
+			}
+			return errors.New("crashed")
+		}}, nil
+	}
+	policy := RestartPolicy{Policy: RestartOnFailure, MaxRestarts: 2, Backoff: time.Second}
+	sup := newSupervisor("test", policy, load, log)
+	sup.clock = clock
+
+	sup.run(t.Context())
+
+	got := sup.Status()
+	assert.Equal(t, StateFailed, got.State)
+	assert.Equal(t, 5, loads)
+	assert.Equal(t, 4, got.Restarts)
+	assert.Equal(t, []time.Duration{time.Second, time.Second, time.Second, 2 * time.Second}, clock.sleeps)
+	assert.Equal(t, clock.Now(), got.LastErrorAt)
+}
+
+func TestLoader_StartShowsPermanentError(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	var loads atomic.Int32
+	runner := funcRunner(func(context.Context, Descriptor, []byte) (PluginInstance, error) {
+		loads.Add(1)
+		return nil, permanent(errors.New("module test is incompatible"))
+	})
+	updater := &recordingUpdater{}
+	l, err := NewWithRunner(recordingUI{"test": updater}, nil, runner, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close(context.Background()) })
+
+	err = l.Replace(t.Context(), Descriptor{Name: "test", Restart: RestartPolicy{Backoff: time.Millisecond}}, nil)
+	require.NoError(t, err)
+
+	var got Status
+	require.Eventually(t, func() bool {
+		got = l.Status()[0]
+		return got.State == StateFailed
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 0, got.Restarts)
+	assert.EqualError(t, got.LastError, "loading module: module test is incompatible")
+	assert.Equal(t, int32(1), loads.Load())
+	assert.True(t, updater.updated)
+}
+
+func TestSupervisor_RunStopsOnContextCancel(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	load := func(context.Context) (PluginInstance, error) {
+		return &funcInstance{run: func(ctx context.Context) error {
+			cancel()
+			<-ctx.Done()
+			return nil
+		}}, nil
+	}
+	sup := newSupervisor("test", RestartPolicy{Policy: RestartAlways}, load, log)
+
+	sup.run(ctx)
+
+	got := sup.Status()
+	assert.Equal(t, StateStopped, got.State)
+	assert.Equal(t, 0, got.Restarts)
+}
+
+func TestSupervisor_RunStopsDuringBackoff(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Info)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	load := func(context.Context) (PluginInstance, error) {
+		return nil, errors.New("crashed")
+	}
+	clock := &blockingClock{sleeping: cancel}
+	sup := newSupervisor("test", RestartPolicy{Policy: RestartAlways}, load, log)
+	sup.clock = clock
+
+	sup.run(ctx)
+
+	assert.Equal(t, StateStopped, sup.Status().State)
+	assert.True(t, clock.woken.Load(), "the sleep must end with the context")
+}
+
+type funcInstance struct {
+	run func(context.Context) error
+}
+
+func (i *funcInstance) Run(ctx context.Context) error { return i.run(ctx) }
+func (i *funcInstance) Close(context.Context) error   { return nil }
+
+type funcRunner func(context.Context, Descriptor, []byte) (PluginInstance, error)
+
+func (r funcRunner) Load(ctx context.Context, desc Descriptor, wasmBytes []byte) (PluginInstance, error) {
+	return r(ctx, desc, wasmBytes)
+}
+func (r funcRunner) Close(context.Context) error { return nil }
+
+// stepClock is a clock whose sleeps move it forward immediately,
+// recording how long they were.
+type stepClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *stepClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+	return ctx.Err()
+}
+
+func (c *stepClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// blockingClock is a clock whose sleeps only end with their context,
+// calling sleeping once they wait.
+type blockingClock struct {
+	sleeping func()
+	woken    atomic.Bool
+}
+
+func (c *blockingClock) Now() time.Time { return time.Time{} }
+
+func (c *blockingClock) Sleep(ctx context.Context, _ time.Duration) error {
+	c.sleeping()
+	<-ctx.Done()
+	c.woken.Store(true)
+	return ctx.Err()
+}
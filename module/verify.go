@@ -0,0 +1,184 @@
+package module
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Minisign signature algorithms.
+var (
+	algPure    = [2]byte{'E', 'd'}
+	algPrehash = [2]byte{'E', 'D'}
+)
+
+var (
+	errNoTrustedKey     = errors.New("no trusted key matches the signature")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// Integrity describes the expected integrity of a module binary.
+type Integrity struct {
+	// SHA256 is the hex encoded SHA-256 digest of the binary.
+	SHA256 string
+	// Signature is a minisign signature, either the contents of a
+	// .minisig file or its base64 signature line, or a base64 encoded
+	// ed25519 signature of the binary.
+	Signature string
+}
+
+// PublicKey is a trusted ed25519 public key used to verify module signatures.
+type PublicKey struct {
+	// ID is the minisign key ID. It is empty for raw ed25519 keys.
+	ID  []byte
+	Key ed25519.PublicKey
+}
+
+// ParsePublicKey parses a minisign public key or a base64 encoded
+// ed25519 public key.
+func ParsePublicKey(s string) (PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(lastLine(s))
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("decoding public key: %w", err)
+	}
+
+	switch {
+	case len(b) == ed25519.PublicKeySize:
+		return PublicKey{Key: b}, nil
+	case len(b) == 2+8+ed25519.PublicKeySize && [2]byte(b[:2]) == algPure:
+		return PublicKey{ID: b[2:10], Key: b[10:]}, nil
+	default:
+		return PublicKey{}, errors.New("invalid public key: expected a minisign or ed25519 public key")
+	}
+}
+
+// ParsePublicKeys parses all given public keys.
+func ParsePublicKeys(keys []string) ([]PublicKey, error) {
+	pubs := make([]PublicKey, 0, len(keys))
+	for i, key := range keys {
+		pub, err := ParsePublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs, nil
+}
+
+// Verify verifies b against the integrity, using keys to verify signatures.
+func (i Integrity) Verify(b []byte, keys []PublicKey) error {
+	if i.SHA256 != "" {
+		sum := sha256.Sum256(b)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, i.SHA256) {
+			return fmt.Errorf("sha256 mismatch: expected %s, got %s", strings.ToLower(i.SHA256), got)
+		}
+	}
+
+	if i.Signature != "" {
+		if len(keys) == 0 {
+			return errors.New("module is signed but no trusted keys are configured")
+		}
+		if err := verifySignature(b, i.Signature, keys); err != nil {
+			return fmt.Errorf("verifying signature: %w", err)
+		}
+	}
+	return nil
+}
+
+func verifySignature(b []byte, signature string, keys []PublicKey) error {
+	sigLine, trustedComment, globalSig, err := parseMinisig(signature)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigLine)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	// A raw ed25519 signature is checked against every trusted key.
+	if len(sig) == ed25519.SignatureSize {
+		for _, key := range keys {
+			if ed25519.Verify(key.Key, b, sig) {
+				return nil
+			}
+		}
+		return errNoTrustedKey
+	}
+
+	if len(sig) != 2+8+ed25519.SignatureSize {
+		return errInvalidSignature
+	}
+	alg, keyID, sig := [2]byte(sig[:2]), sig[2:10], sig[10:]
+
+	msg := b
+	switch alg {
+	case algPure:
+	case algPrehash:
+		sum := blake2b.Sum512(b)
+		msg = sum[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", string(alg[:]))
+	}
+
+	for _, key := range keys {
+		if key.ID != nil && !bytes.Equal(key.ID, keyID) {
+			continue
+		}
+		if !ed25519.Verify(key.Key, msg, sig) {
+			continue
+		}
+		if globalSig == nil {
+			return nil
+		}
+		// The global signature covers the signature and the trusted comment.
+		if ed25519.Verify(key.Key, slices.Concat(sig, trustedComment), globalSig) {
+			return nil
+		}
+		return errors.New("invalid trusted comment signature")
+	}
+	return errNoTrustedKey
+}
+
+// parseMinisig parses the signature and, when present, the trusted
+// comment and global signature of a minisign signature file. A single
+// line is treated as the signature.
+func parseMinisig(s string) (sig string, trustedComment []byte, globalSig []byte, err error) {
+	var lines []string
+	for line := range strings.SplitSeq(strings.TrimSpace(s), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	switch {
+	case len(lines) == 1:
+		return lines[0], nil, nil, nil
+	case len(lines) == 2 && strings.HasPrefix(lines[0], "untrusted comment:"):
+		return lines[1], nil, nil, nil
+	case len(lines) == 4 && strings.HasPrefix(lines[2], "trusted comment: "):
+		globalSig, err = base64.StdEncoding.DecodeString(lines[3])
+		if err != nil || len(globalSig) != ed25519.SignatureSize {
+			return "", nil, nil, errInvalidSignature
+		}
+		return lines[1], []byte(strings.TrimPrefix(lines[2], "trusted comment: ")), globalSig, nil
+	default:
+		return "", nil, nil, errInvalidSignature
+	}
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if idx := strings.LastIndexByte(s, '\n'); idx >= 0 {
+		s = s[idx+1:]
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,167 @@
+package module_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"testing"
+
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestParsePublicKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name    string
+		key     string
+		want    module.PublicKey
+		wantErr require.ErrorAssertionFunc
+	}{
+		{
+			name:    "parses an ed25519 key",
+			key:     base64.StdEncoding.EncodeToString(pub),
+			want:    module.PublicKey{Key: pub},
+			wantErr: require.NoError,
+		},
+		{
+			name:    "parses a minisign key",
+			key:     "untrusted comment: minisign public key\n" + minisignKey(keyID, pub),
+			want:    module.PublicKey{ID: keyID, Key: pub},
+			wantErr: require.NoError,
+		},
+		{
+			name:    "handles invalid base64",
+			key:     "not base64!",
+			wantErr: require.Error,
+		},
+		{
+			name:    "handles invalid key length",
+			key:     base64.StdEncoding.EncodeToString([]byte("short")),
+			wantErr: require.Error,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := module.ParsePublicKey(test.key)
+
+			test.wantErr(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestIntegrity_Verify(t *testing.T) {
+	data := []byte("some wasm bytes")
+	sum := sha256.Sum256(data)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key, err := module.ParsePublicKey(minisignKey(keyID, pub))
+	require.NoError(t, err)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey := module.PublicKey{Key: otherPub}
+
+	prehashed := blake2b.Sum512(data)
+	minisig := minisignSig([2]byte{'E', 'D'}, keyID, ed25519.Sign(priv, prehashed[:]))
+	trustedComment := "timestamp:1 file:test.wasm"
+	globalSig := ed25519.Sign(priv, slices.Concat(ed25519.Sign(priv, prehashed[:]), []byte(trustedComment)))
+
+	tests := []struct {
+		name      string
+		integrity module.Integrity
+		keys      []module.PublicKey
+		wantErr   string
+	}{
+		{
+			name:      "no integrity",
+			integrity: module.Integrity{},
+		},
+		{
+			name:      "valid sha256",
+			integrity: module.Integrity{SHA256: hex.EncodeToString(sum[:])},
+		},
+		{
+			name:      "handles sha256 mismatch",
+			integrity: module.Integrity{SHA256: "00"},
+			wantErr:   "sha256 mismatch: expected 00, got " + hex.EncodeToString(sum[:]),
+		},
+		{
+			name:      "valid ed25519 signature",
+			integrity: module.Integrity{Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))},
+			keys:      []module.PublicKey{otherKey, {Key: pub}},
+		},
+		{
+			name:      "valid minisign signature",
+			integrity: module.Integrity{Signature: minisignSig([2]byte{'E', 'd'}, keyID, ed25519.Sign(priv, data))},
+			keys:      []module.PublicKey{key},
+		},
+		{
+			name:      "valid prehashed minisign signature",
+			integrity: module.Integrity{Signature: minisig},
+			keys:      []module.PublicKey{key},
+		},
+		{
+			name: "valid minisign signature file",
+			integrity: module.Integrity{Signature: "untrusted comment: signature\n" + minisig + "\n" +
+				"trusted comment: " + trustedComment + "\n" + base64.StdEncoding.EncodeToString(globalSig) + "\n"},
+			keys: []module.PublicKey{key},
+		},
+		{
+			name: "handles invalid trusted comment",
+			integrity: module.Integrity{Signature: "untrusted comment: signature\n" + minisig + "\n" +
+				"trusted comment: changed\n" + base64.StdEncoding.EncodeToString(globalSig) + "\n"},
+			keys:    []module.PublicKey{key},
+			wantErr: "verifying signature: invalid trusted comment signature",
+		},
+		{
+			name:      "handles untrusted signature",
+			integrity: module.Integrity{Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))},
+			keys:      []module.PublicKey{otherKey},
+			wantErr:   "verifying signature: no trusted key matches the signature",
+		},
+		{
+			name:      "handles signature without keys",
+			integrity: module.Integrity{Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))},
+			wantErr:   "module is signed but no trusted keys are configured",
+		},
+		{
+			name:      "handles invalid signature",
+			integrity: module.Integrity{Signature: "invalid"},
+			keys:      []module.PublicKey{key},
+			wantErr:   "verifying signature: invalid signature",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.integrity.Verify(data, test.keys)
+
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func minisignKey(id []byte, pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(slices.Concat([]byte("Ed"), id, pub))
+}
+
+func minisignSig(alg [2]byte, id, sig []byte) string {
+	return base64.StdEncoding.EncodeToString(slices.Concat(alg[:], id, sig))
+}
@@ -0,0 +1,249 @@
+package module
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+	lctx "github.com/hamba/logger/v2/ctx"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// maxWSMessageSize is the maximum size of a received WebSocket message.
+const maxWSMessageSize = 1 << 20
+
+// wsConn holds an open WebSocket connection.
+type wsConn struct {
+	conn  *websocket.Conn
+	quota *streamQuota
+
+	// code is the close code of the connection, or zero while it is open.
+	code atomic.Int32
+
+	pending []byte
+}
+
+// closed records the close code of err. A connection lost without
+// a close frame is recorded as an abnormal closure.
+func (c *wsConn) closed(err error) {
+	code := int32(websocket.CloseStatus(err))
+	if code < 0 {
+		code = int32(websocket.StatusAbnormalClosure)
+	}
+	c.code.CompareAndSwap(0, code)
+}
+
+// closeWith closes the connection with the given close code, waiting
+// for the peer to acknowledge it.
+func (c *wsConn) closeWith(code websocket.StatusCode) {
+	if err := c.conn.Close(code, ""); err != nil {
+		_ = c.conn.CloseNow()
+	}
+	c.quota.release()
+}
+
+func (c *wsConn) close() {
+	_ = c.conn.CloseNow()
+	c.quota.release()
+}
+
+// wsOpenFunc opens a WebSocket connection and returns a handle for it.
+func wsOpenFunc(env *hostEnv) api.GoModuleFunc {
+	log := env.log
+
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		urlPtr := uint32(stack[0])
+		urlLen := uint32(stack[1])
+		hdrPtr := uint32(stack[2])
+		hdrLen := uint32(stack[3])
+
+		urlBytes, ok := mod.Memory().Read(urlPtr, urlLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		u, err := url.Parse(string(urlBytes))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			log.Error("ws_open: invalid url", lctx.Str("module", mod.Name()), lctx.Str("url", string(urlBytes)))
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		hdr := http.Header{}
+		if hdrLen > 0 {
+			hdrBytes, ok := mod.Memory().Read(hdrPtr, hdrLen)
+			if !ok {
+				stack[0] = errno(errnoInvalid)
+				return
+			}
+			setHeaders(hdr, hdrBytes)
+		}
+
+		menv, ok := env.module(mod)
+		if !ok || !menv.perms.allowsRequest(http.MethodGet, u) {
+			log.Warn("ws_open: connection not permitted",
+				lctx.Str("module", mod.Name()), lctx.Str("url", u.Redacted()))
+			stack[0] = errno(errnoPermission)
+			return
+		}
+		if !menv.streams.reserve() {
+			log.Warn("ws_open: too many open streams",
+				lctx.Str("module", mod.Name()), lctx.Str("url", u.Redacted()))
+			stack[0] = errno(errnoQuota)
+			return
+		}
+
+		//nolint:bodyclose // The response body is owned by the connection.
+		conn, _, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
+			HTTPClient: menv.client,
+			HTTPHeader: hdr,
+		})
+		if err != nil {
+			menv.streams.release()
+
+			log.Error("ws_open: connection failed", lctx.Str("url", u.Redacted()), lctx.Err(err))
+			stack[0] = errno(errnoIO)
+			return
+		}
+		conn.SetReadLimit(maxWSMessageSize)
+
+		handle := menv.handles.add(&wsConn{conn: conn, quota: menv.streams})
+		stack[0] = uint64(handle)
+	}
+}
+
+// wsSendFunc sends a message on a WebSocket connection.
+func wsSendFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		typ := websocket.MessageType(stack[1])
+		msgPtr := uint32(stack[2])
+		msgLen := uint32(stack[3])
+
+		if typ != websocket.MessageText && typ != websocket.MessageBinary {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		msg, ok := mod.Memory().Read(msgPtr, msgLen)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		conn, ok := getHandle[*wsConn](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		if conn.code.Load() != 0 {
+			stack[0] = errno(errnoClosed)
+			return
+		}
+
+		if err := conn.conn.Write(ctx, typ, msg); err != nil {
+			if ctx.Err() != nil {
+				stack[0] = errno(errnoIO)
+				return
+			}
+			conn.closed(err)
+			stack[0] = errno(errnoClosed)
+			return
+		}
+		stack[0] = 0
+	}
+}
+
+// wsRecvFunc reads the next message of a WebSocket connection into the
+// plugin buffer. Blocks until a message is received.
+func wsRecvFunc(env *hostEnv) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		bufPtr := uint32(stack[1])
+		bufLen := uint32(stack[2])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		conn, ok := getHandle[*wsConn](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+
+		msg := conn.pending
+		if msg == nil {
+			if conn.code.Load() != 0 {
+				stack[0] = errno(errnoClosed)
+				return
+			}
+
+			var err error
+			_, msg, err = conn.conn.Read(ctx)
+			switch {
+			case ctx.Err() != nil:
+				stack[0] = errno(errnoIO)
+				return
+			case err != nil:
+				conn.closed(err)
+				stack[0] = errno(errnoClosed)
+				return
+			}
+		}
+
+		// A message that does not fit is kept for the next call.
+		conn.pending = nil
+		if len(msg) > int(bufLen) {
+			conn.pending = msg
+		}
+		stack[0] = writeResult(mod, bufPtr, bufLen, msg)
+	}
+}
+
+// wsCloseCodeFunc returns the close code of a WebSocket connection.
+func wsCloseCodeFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		conn, ok := getHandle[*wsConn](menv.handles, handle)
+		if !ok {
+			stack[0] = errno(errnoInvalid)
+			return
+		}
+		stack[0] = uint64(conn.code.Load())
+	}
+}
+
+// wsCloseFunc closes a WebSocket connection and releases the handle.
+func wsCloseFunc(env *hostEnv) api.GoModuleFunc {
+	return func(_ context.Context, mod api.Module, stack []uint64) {
+		handle := int32(stack[0])
+		code := websocket.StatusCode(stack[1])
+
+		menv, ok := env.module(mod)
+		if !ok {
+			return
+		}
+		conn, ok := removeHandle[*wsConn](menv.handles, handle)
+		if !ok {
+			return
+		}
+		if code == 0 {
+			code = websocket.StatusNormalClosure
+		}
+		conn.closeWith(code)
+	}
+}
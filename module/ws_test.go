@@ -0,0 +1,185 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWSHostFuncs(t *testing.T) {
+	t.Parallel()
+
+	srv := newEchoServer(t)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call(srv, "X-Test: yes\n")
+	wsOpenFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = append([]uint64{handle, uint64(websocket.MessageText)}, mod.call("hello")...)
+	wsSendFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = []uint64{handle, resultOffset, 3}
+	wsRecvFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, uint64(10), stack[0], "returns the length when the buffer is too small")
+
+	stack = []uint64{handle, resultOffset, 16}
+	wsRecvFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(10), stack[0])
+	assert.Equal(t, "yes: hello", mod.result(stack[0]))
+
+	stack = []uint64{handle}
+	wsCloseCodeFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, uint64(0), stack[0])
+
+	wsCloseFunc(env)(t.Context(), mod, []uint64{handle, 0})
+
+	assert.Equal(t, int32(0), menv.streams.open.Load())
+	_, ok := getHandle[*wsConn](menv.handles, int32(handle))
+	assert.False(t, ok)
+}
+
+func TestWSRecv_ReportsCloseCode(t *testing.T) {
+	t.Parallel()
+
+	srv := newEchoServer(t)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call(srv, "")
+	wsOpenFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	stack = append([]uint64{handle, uint64(websocket.MessageText)}, mod.call("close")...)
+	wsSendFunc(env)(t.Context(), mod, stack)
+	require.Equal(t, uint64(0), stack[0])
+
+	stack = []uint64{handle, resultOffset, 16}
+	wsRecvFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoClosed, int32(stack[0]))
+
+	stack = []uint64{handle}
+	wsCloseCodeFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, uint64(4000), stack[0])
+
+	stack = append([]uint64{handle, uint64(websocket.MessageText)}, mod.call("hello")...)
+	wsSendFunc(env)(t.Context(), mod, stack)
+	assert.Equal(t, errnoClosed, int32(stack[0]))
+}
+
+func TestWSRecv_HandlesContextCancellation(t *testing.T) {
+	t.Parallel()
+
+	srv := newEchoServer(t)
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call(srv, "")
+	wsOpenFunc(env)(t.Context(), mod, stack)
+	handle := stack[0]
+	require.Positive(t, int32(handle))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	stack = []uint64{handle, resultOffset, 16}
+	wsRecvFunc(env)(ctx, mod, stack)
+
+	assert.Equal(t, errnoIO, int32(stack[0]))
+}
+
+func TestWSOpen_HandlesPermissionDenied(t *testing.T) {
+	t.Parallel()
+
+	srv := newEchoServer(t)
+
+	var buf bytes.Buffer
+	log := logger.New(&buf, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{
+		Name:        "test",
+		Permissions: &Permissions{HTTP: HTTPPermissions{Hosts: []string{"example.com"}}},
+	})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call(srv, "")
+	wsOpenFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoPermission, int32(stack[0]))
+	assert.Contains(t, buf.String(), `msg="ws_open: connection not permitted" module=test url=`+srv)
+	assert.Equal(t, int32(0), menv.streams.open.Load())
+}
+
+func TestWSOpen_HandlesInvalidURL(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(&bytes.Buffer{}, logger.LogfmtFormat(), logger.Info)
+	env := newHostEnv(noopUI{}, "", log)
+	menv := mustRegister(t, env, Descriptor{Name: "test"})
+	t.Cleanup(func() { env.unregister(menv) })
+	mod := newMemModule("test")
+
+	stack := mod.call("https://example.com", "")
+	wsOpenFunc(env)(t.Context(), mod, stack)
+
+	assert.Equal(t, errnoInvalid, int32(stack[0]))
+}
+
+// newEchoServer starts a WebSocket server echoing messages prefixed with
+// the X-Test handshake header, and returns its ws URL. The message "close"
+// closes the connection with the code 4000.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.CloseNow() }()
+
+		prefix := r.Header.Get("X-Test")
+		for {
+			typ, msg, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if string(msg) == "close" {
+				_ = conn.Close(4000, "bye")
+				return
+			}
+			if err = conn.Write(r.Context(), typ, []byte(prefix+": "+string(msg))); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
@@ -3,6 +3,8 @@ package glass
 import (
 	"context"
 	"errors"
+	"reflect"
+	"slices"
 	"sync"
 	"time"
 
@@ -20,34 +22,97 @@ type uiProviderAdapter struct {
 	u *ui.UI
 }
 
+// window is the UI the modules are rendered in.
+type window interface {
+	module.UIProvider
+
+	// Run renders the modules until the window is closed or ctx is done.
+	Run(ctx context.Context) error
+	// Close closes the window.
+	Close() error
+}
+
+// newWindow returns the window of the UI configuration.
+func newWindow(cfg ui.Config, log *logger.Logger) window {
+	log.Debug("Creating UI window")
+
+	return uiProviderAdapter{ui.New(cfg, log)}
+}
+
+func (a uiProviderAdapter) Run(ctx context.Context) error {
+	return a.u.Run(ctx)
+}
+
+func (a uiProviderAdapter) Close() error {
+	return a.u.Close()
+}
+
 func (a uiProviderAdapter) CreateModule(name, vert, horiz string) {
 	a.u.CreateModule(name, vert, horiz)
 }
 
+func (a uiProviderAdapter) RemoveModule(name string) {
+	a.u.RemoveModule(name)
+}
+
+func (a uiProviderAdapter) MoveModule(name, vert, horiz string) {
+	a.u.MoveModule(name, vert, horiz)
+}
+
 func (a uiProviderAdapter) ModuleUI(name string) module.WidgetUpdater {
 	return a.u.ModuleUI(name)
 }
 
 // Run starts the looking-glass with the given configuration, and logger.
 // cachePath is the filesystem path to the module cache directory.
-// execCtx carries the module and assets URLs used by the module runner.
-func Run(ctx context.Context, cfg Config, cachePath string, execCtx module.ExecContext, log *logger.Logger) error {
+// execCtx carries the module and assets URLs used by the module runner,
+// and is given the MQTT brokers, HTTP cache and request scheduler of the configuration.
+// Configurations received on updates are applied to the running modules,
+// stopping, starting or moving only the modules that changed. updates may be nil.
+func Run(ctx context.Context, cfg Config, updates <-chan Config, cachePath string, execCtx module.ExecContext, log *logger.Logger) error {
+	return run(ctx, newWindow(cfg.UI, log), cfg, updates, nil, cachePath, execCtx, log)
+}
+
+// Build is a module built from source.
+type Build struct {
+	// Module describes the built module.
+	Module module.Descriptor
+	// WASM is the module WASM file, when the build succeeded.
+	WASM []byte
+	// Err is the error of a failed build, including the compiler output.
+	Err error
+}
+
+// Dev starts the looking-glass as Run does, additionally swapping in the
+// modules built from source received on builds. A successful build
+// replaces the plugin of its module, while the error of a failed build is
+// shown in the module container.
+func Dev(ctx context.Context, cfg Config, builds <-chan Build, cachePath string, execCtx module.ExecContext, log *logger.Logger) error {
+	return run(ctx, newWindow(cfg.UI, log), cfg, nil, builds, cachePath, execCtx, log)
+}
+
+func run(ctx context.Context, win window, cfg Config, updates <-chan Config, builds <-chan Build, cachePath string, execCtx module.ExecContext, log *logger.Logger) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	log.Debug("Creating UI window")
-
-	gioUI := ui.New(cfg.UI, log)
-	defer func() { _ = gioUI.Close() }()
+	defer func() { _ = win.Close() }()
 
 	log.Debug("Creating module downloader", lctx.Str("cache", cachePath))
 
-	d, err := module.NewDownloader(cachePath, log)
+	keys, err := module.ParsePublicKeys(cfg.TrustedKeys)
+	if err != nil {
+		return err
+	}
+
+	d, err := module.NewDownloader(cachePath, log, module.WithIndex(cfg.Index), module.WithTrustedKeys(keys))
 	if err != nil {
 		return err
 	}
 
-	loader, err := module.New(ctx, uiProviderAdapter{gioUI}, d, execCtx, log)
+	execCtx.MQTT = cfg.MQTT
+	execCtx.HTTPCache = cfg.HTTPCache
+	execCtx.Scheduler = cfg.Scheduler
+	loader, err := module.New(ctx, win, d, execCtx, log)
 	if err != nil {
 		return err
 	}
@@ -68,16 +133,41 @@ func Run(ctx context.Context, cfg Config, cachePath string, execCtx module.ExecC
 
 			loader.Load(ctx, desc)
 		}
+
+		current := cfg
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case next, ok := <-updates:
+				if !ok {
+					updates = nil
+					continue
+				}
+
+				applyConfig(ctx, loader, current, next, log)
+				current = next
+			case b, ok := <-builds:
+				if !ok {
+					builds = nil
+					continue
+				}
+
+				applyBuild(ctx, loader, b, log)
+			}
+		}
 	})
 	defer func() {
 		log.Debug("Stopping modules")
 
+		// The window may close without ctx being done.
+		cancel()
 		wg.Wait()
 	}()
 
 	log.Debug("Starting render loop")
 
-	if err = gioUI.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+	if err = win.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		log.Debug("UI loop ended with error", lctx.Err(err))
 
 		cancel()
@@ -86,3 +176,60 @@ func Run(ctx context.Context, cfg Config, cachePath string, execCtx module.ExecC
 	}
 	return nil
 }
+
+func applyConfig(ctx context.Context, loader *module.Loader, current, next Config, log *logger.Logger) {
+	if current.UI != next.UI {
+		log.Warn("UI configuration changes require a restart")
+	}
+	if current.Index != next.Index || !slices.Equal(current.TrustedKeys, next.TrustedKeys) {
+		log.Warn("Index and trusted key changes require a restart")
+	}
+	if !slices.Equal(current.MQTT.Brokers, next.MQTT.Brokers) {
+		log.Warn("MQTT broker changes require a restart")
+	}
+	if !reflect.DeepEqual(current.HTTPCache, next.HTTPCache) {
+		log.Warn("HTTP cache changes require a restart")
+	}
+	if !reflect.DeepEqual(current.Scheduler, next.Scheduler) {
+		log.Warn("Request scheduler changes require a restart")
+	}
+
+	changes := module.Diff(current.Modules, next.Modules)
+	if changes.Empty() {
+		log.Debug("Configuration reloaded without module changes")
+		return
+	}
+
+	for _, desc := range slices.Concat(changes.Removed, changes.Changed) {
+		if err := loader.Unload(ctx, desc.Name); err != nil {
+			log.Error("Could not stop module", lctx.Str("module", desc.Name), lctx.Err(err))
+		}
+	}
+	for _, desc := range changes.Moved {
+		log.Info("Moving module", lctx.Str("module", desc.Name))
+
+		loader.Move(desc.Name, desc.Position)
+	}
+	for _, desc := range slices.Concat(changes.Changed, changes.Added) {
+		log.Info("Loading module", lctx.Str("module", desc.Name))
+
+		loader.Load(ctx, desc)
+	}
+}
+
+func applyBuild(ctx context.Context, loader *module.Loader, b Build, log *logger.Logger) {
+	if b.Err != nil {
+		log.Error("Module build failed", lctx.Str("module", b.Module.Name), lctx.Err(b.Err))
+
+		if err := loader.Fail(ctx, b.Module, b.Err); err != nil {
+			log.Error("Could not show build error", lctx.Str("module", b.Module.Name), lctx.Err(err))
+		}
+		return
+	}
+
+	log.Info("Replacing module", lctx.Str("module", b.Module.Name))
+
+	if err := loader.Replace(ctx, b.Module, b.WASM); err != nil {
+		log.Error("Could not replace module", lctx.Str("module", b.Module.Name), lctx.Err(err))
+	}
+}
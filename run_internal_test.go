@@ -0,0 +1,53 @@
+package glass
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/glasslabs/looking-glass/module"
+	"github.com/hamba/logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_ReturnsWhenWindowCloses(t *testing.T) {
+	t.Parallel()
+
+	log := logger.New(io.Discard, logger.LogfmtFormat(), logger.Error)
+	win := &closedWindow{}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(t.Context(), win, Config{}, nil, nil, t.TempDir(), module.ExecContext{}, log)
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+		assert.True(t, win.closed)
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return when the window closed")
+	}
+}
+
+// closedWindow is a window closed as soon as it runs.
+type closedWindow struct {
+	closed bool
+}
+
+func (w *closedWindow) CreateModule(string, string, string) {}
+
+func (w *closedWindow) RemoveModule(string) {}
+
+func (w *closedWindow) MoveModule(string, string, string) {}
+
+func (w *closedWindow) ModuleUI(string) module.WidgetUpdater { return nil }
+
+func (w *closedWindow) Run(context.Context) error { return nil }
+
+func (w *closedWindow) Close() error {
+	w.closed = true
+	return nil
+}
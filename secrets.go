@@ -0,0 +1,333 @@
+package glass
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// SecretsFormat is the format of a secrets file.
+type SecretsFormat int
+
+// Secrets file formats.
+const (
+	// SecretsPlain is a plain text YAML file.
+	SecretsPlain SecretsFormat = iota
+	// SecretsAge is a YAML file encrypted with age.
+	SecretsAge
+	// SecretsValues is a YAML file with its values encrypted with age,
+	// in the style of sops. Keys are left in plain text, so changes can
+	// be reviewed.
+	SecretsValues
+)
+
+// String returns the name of the format.
+func (f SecretsFormat) String() string {
+	switch f {
+	case SecretsAge:
+		return "age"
+	case SecretsValues:
+		return "values"
+	default:
+		return "plain"
+	}
+}
+
+// ParseSecretsFormat parses a secrets file format from its name.
+func ParseSecretsFormat(s string) (SecretsFormat, error) {
+	switch s {
+	case "plain":
+		return SecretsPlain, nil
+	case "age":
+		return SecretsAge, nil
+	case "values":
+		return SecretsValues, nil
+	default:
+		return 0, fmt.Errorf("secrets: unknown format %q", s)
+	}
+}
+
+const (
+	ageHeader = "age-encryption.org/"
+
+	// encPrefix and encSuffix enclose an encrypted value. The value is the
+	// base64 encoded age ciphertext of the plain text value.
+	encPrefix = "ENC[age,"
+	encSuffix = "]"
+
+	// recipientPrefix starts the comment lines at the top of an encrypted
+	// secrets file naming the recipients it is encrypted to, as they
+	// cannot be read from the ciphertext.
+	recipientPrefix = "# recipient: "
+)
+
+// DetectSecretsFormat returns the format of the secrets file in. A file
+// is in the values format when any of its values is an encrypted value.
+func DetectSecretsFormat(in []byte) SecretsFormat {
+	_, in = splitRecipients(in)
+	trimmed := bytes.TrimSpace(in)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(ageHeader)), bytes.HasPrefix(trimmed, []byte(armor.Header)):
+		return SecretsAge
+	case hasEncryptedValue(in):
+		return SecretsValues
+	default:
+		return SecretsPlain
+	}
+}
+
+// hasEncryptedValue reports whether any value of the YAML document in is
+// an encrypted value, ignoring keys and comments.
+func hasEncryptedValue(in []byte) bool {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return false
+	}
+
+	var found bool
+	_ = mapNode(&doc, func(v string) (string, error) {
+		found = found || isEncryptedValue(v)
+		return v, nil
+	})
+	return found
+}
+
+func isEncryptedValue(v string) bool {
+	enc, ok := strings.CutPrefix(v, encPrefix)
+	if !ok {
+		return false
+	}
+	enc, ok = strings.CutSuffix(enc, encSuffix)
+	if !ok {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(enc)
+	return err == nil
+}
+
+// ParseSecrets parses secrets from in, decrypting them with ids if they
+// are encrypted.
+func ParseSecrets(in []byte, ids ...age.Identity) (map[string]any, error) {
+	plain, _, err := DecryptSecrets(in, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	sec := map[string]any{}
+	err = yaml.Unmarshal(plain, &sec)
+	return sec, err
+}
+
+// SecretsRecipients returns the recipients the secrets file in is
+// encrypted to.
+func SecretsRecipients(in []byte) ([]age.Recipient, error) {
+	lines, _ := splitRecipients(in)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("secrets: invalid recipient: %w", err)
+	}
+	return recipients, nil
+}
+
+// splitRecipients splits the recipient lines from the top of the secrets
+// file in, returning the recipients and the rest of the file.
+func splitRecipients(in []byte) ([]string, []byte) {
+	var recipients []string
+	for {
+		line, rest, _ := bytes.Cut(in, []byte("\n"))
+		r, ok := strings.CutPrefix(strings.TrimRight(string(line), "\r"), recipientPrefix)
+		if !ok {
+			return recipients, in
+		}
+		recipients = append(recipients, strings.TrimSpace(r))
+		in = rest
+	}
+}
+
+// DecryptSecrets decrypts the secrets file in with ids, returning the plain
+// text YAML and the format it was in.
+func DecryptSecrets(in []byte, ids ...age.Identity) ([]byte, SecretsFormat, error) {
+	format := DetectSecretsFormat(in)
+	if format != SecretsPlain {
+		_, in = splitRecipients(in)
+	}
+	if format != SecretsPlain && len(ids) == 0 {
+		return nil, format, errors.New("secrets: the secrets file is encrypted, but no key was given")
+	}
+
+	switch format {
+	case SecretsAge:
+		plain, err := decrypt(in, ids)
+		return plain, format, err
+	case SecretsValues:
+		plain, err := mapValues(in, func(v string) (string, error) {
+			enc, ok := strings.CutPrefix(v, encPrefix)
+			if !ok {
+				return v, nil
+			}
+			enc, ok = strings.CutSuffix(enc, encSuffix)
+			if !ok {
+				return "", errors.New("secrets: invalid encrypted value")
+			}
+			b, err := base64.StdEncoding.DecodeString(enc)
+			if err != nil {
+				return "", fmt.Errorf("secrets: invalid encrypted value: %w", err)
+			}
+			plain, err := decrypt(b, ids)
+			return string(plain), err
+		})
+		return plain, format, err
+	default:
+		return in, format, nil
+	}
+}
+
+// EncryptSecrets encrypts the plain text secrets file in to recipients in
+// the given format. The recipients are named at the top of the file, so it
+// can be encrypted to them again once it is edited.
+func EncryptSecrets(in []byte, format SecretsFormat, recipients ...age.Recipient) ([]byte, error) {
+	if format != SecretsPlain && len(recipients) == 0 {
+		return nil, errors.New("secrets: at least one recipient is required")
+	}
+
+	var header bytes.Buffer
+	if format != SecretsPlain {
+		for _, r := range recipients {
+			if s, ok := r.(fmt.Stringer); ok {
+				header.WriteString(recipientPrefix + s.String() + "\n")
+			}
+		}
+	}
+
+	switch format {
+	case SecretsAge:
+		var buf bytes.Buffer
+		buf.Write(header.Bytes())
+		aw := armor.NewWriter(&buf)
+		if err := encrypt(aw, in, recipients); err != nil {
+			return nil, err
+		}
+		if err := aw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SecretsValues:
+		out, err := mapValues(in, func(v string) (string, error) {
+			if strings.HasPrefix(v, encPrefix) {
+				return v, nil
+			}
+			var buf bytes.Buffer
+			if err := encrypt(&buf, []byte(v), recipients); err != nil {
+				return "", err
+			}
+			return encPrefix + base64.StdEncoding.EncodeToString(buf.Bytes()) + encSuffix, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(header.Bytes(), out...), nil
+	default:
+		return in, nil
+	}
+}
+
+func encrypt(w io.Writer, plain []byte, recipients []age.Recipient) error {
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return fmt.Errorf("secrets: %w", err)
+	}
+	if _, err = ew.Write(plain); err != nil {
+		return fmt.Errorf("secrets: %w", err)
+	}
+	if err = ew.Close(); err != nil {
+		return fmt.Errorf("secrets: %w", err)
+	}
+	return nil
+}
+
+func decrypt(in []byte, ids []age.Identity) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(in)
+	if bytes.HasPrefix(bytes.TrimSpace(in), []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(bytes.TrimSpace(in)))
+	}
+
+	dr, err := age.Decrypt(r, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: could not decrypt: %w", err)
+	}
+	b, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: could not decrypt: %w", err)
+	}
+	return b, nil
+}
+
+// mapValues applies fn to the scalar values of the YAML document in,
+// leaving its keys and comments as they are.
+func mapValues(in []byte, fn func(string) (string, error)) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	if doc.Kind == 0 {
+		return in, nil
+	}
+	if err := mapNode(&doc, fn); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func mapNode(n *yaml.Node, fn func(string) (string, error)) error {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := mapNode(c, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		// Content alternates between keys and values.
+		for i := 1; i < len(n.Content); i += 2 {
+			if err := mapNode(n.Content[i], fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return nil
+		}
+		v, err := fn(n.Value)
+		if err != nil {
+			return err
+		}
+		if v != n.Value {
+			// The tag is kept, so values keep their type, and a string
+			// such as "0123" is not decrypted as a number. It is only
+			// written when the value does not imply it.
+			n.Value = v
+			n.Style &^= yaml.TaggedStyle
+		}
+	}
+	return nil
+}
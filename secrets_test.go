@@ -0,0 +1,215 @@
+package glass_test
+
+import (
+	"testing"
+
+	"filippo.io/age"
+	glass "github.com/glasslabs/looking-glass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecrets = `# Weather service
+weather:
+  appId: abc123
+  locationId: 996506
+calendars:
+  - https://example.com/calendar.ics
+`
+
+func TestDetectSecretsFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want glass.SecretsFormat
+	}{
+		{
+			name: "plain",
+			in:   testSecrets,
+			want: glass.SecretsPlain,
+		},
+		{
+			name: "plain with the encrypted prefix in a comment",
+			in:   "# values look like ENC[age,...]\nappId: abc123\n",
+			want: glass.SecretsPlain,
+		},
+		{
+			name: "plain with the encrypted prefix in a value",
+			in:   "note: prefix values with ENC[age,YWJj]\nENC[age,YWJj]: key\n",
+			want: glass.SecretsPlain,
+		},
+		{
+			name: "values",
+			in:   "appId: ENC[age,YWJj]\nlocationId: 996506\n",
+			want: glass.SecretsValues,
+		},
+		{
+			name: "age",
+			in:   "-----BEGIN AGE ENCRYPTED FILE-----\nYWJj\n-----END AGE ENCRYPTED FILE-----\n",
+			want: glass.SecretsAge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := glass.DetectSecretsFormat([]byte(test.in))
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		format glass.SecretsFormat
+	}{
+		{
+			name:   "age",
+			format: glass.SecretsAge,
+		},
+		{
+			name:   "values",
+			format: glass.SecretsValues,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			enc, err := glass.EncryptSecrets([]byte(testSecrets), test.format, id.Recipient())
+			require.NoError(t, err)
+
+			assert.NotContains(t, string(enc), "abc123")
+			assert.Equal(t, test.format, glass.DetectSecretsFormat(enc))
+
+			got, err := glass.ParseSecrets(enc, id)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]any{
+				"weather":   map[string]any{"appId": "abc123", "locationId": 996506},
+				"calendars": []any{"https://example.com/calendar.ics"},
+			}, got)
+		})
+	}
+}
+
+func TestEncryptSecrets_ValuesKeepKeysAndComments(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	enc, err := glass.EncryptSecrets([]byte(testSecrets), glass.SecretsValues, id.Recipient())
+	require.NoError(t, err)
+
+	assert.Contains(t, string(enc), "# Weather service\nweather:\n  appId: ENC[age,")
+
+	plain, format, err := glass.DecryptSecrets(enc, id)
+	require.NoError(t, err)
+	assert.Equal(t, glass.SecretsValues, format)
+	assert.Equal(t, testSecrets, string(plain))
+}
+
+func TestEncryptSecrets_ValuesKeepTypes(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	in := `pin: "0123"
+enabled: "true"
+empty: ""
+port: 8080
+debug: false
+`
+	enc, err := glass.EncryptSecrets([]byte(in), glass.SecretsValues, id.Recipient())
+	require.NoError(t, err)
+	assert.NotContains(t, string(enc), "0123")
+
+	got, err := glass.ParseSecrets(enc, id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"pin":     "0123",
+		"enabled": "true",
+		"empty":   "",
+		"port":    8080,
+		"debug":   false,
+	}, got)
+
+	plain, _, err := glass.DecryptSecrets(enc, id)
+	require.NoError(t, err)
+	assert.Equal(t, in, string(plain))
+}
+
+func TestSecretsRecipients(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		format glass.SecretsFormat
+	}{
+		{
+			name:   "age",
+			format: glass.SecretsAge,
+		},
+		{
+			name:   "values",
+			format: glass.SecretsValues,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			enc, err := glass.EncryptSecrets([]byte(testSecrets), test.format, id.Recipient(), other.Recipient())
+			require.NoError(t, err)
+
+			got, err := glass.SecretsRecipients(enc)
+			require.NoError(t, err)
+			assert.Equal(t, []age.Recipient{id.Recipient(), other.Recipient()}, got)
+
+			plain, format, err := glass.DecryptSecrets(enc, other)
+			require.NoError(t, err)
+			assert.Equal(t, test.format, format)
+			assert.Equal(t, testSecrets, string(plain))
+		})
+	}
+}
+
+func TestSecretsRecipients_Plain(t *testing.T) {
+	got, err := glass.SecretsRecipients([]byte(testSecrets))
+
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestParseSecrets_HandlesMissingKey(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	enc, err := glass.EncryptSecrets([]byte(testSecrets), glass.SecretsAge, id.Recipient())
+	require.NoError(t, err)
+
+	_, err = glass.ParseSecrets(enc)
+
+	assert.EqualError(t, err, "secrets: the secrets file is encrypted, but no key was given")
+}
+
+func TestParseSecrets_HandlesWrongKey(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	enc, err := glass.EncryptSecrets([]byte(testSecrets), glass.SecretsValues, id.Recipient())
+	require.NoError(t, err)
+
+	_, err = glass.ParseSecrets(enc, other)
+
+	assert.ErrorContains(t, err, "secrets: could not decrypt")
+}
+
+func TestParseSecrets_Plain(t *testing.T) {
+	got, err := glass.ParseSecrets([]byte("token: abc"))
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"token": "abc"}, got)
+}
@@ -104,6 +104,48 @@ func (u *UI) CreateModule(name, vert, horiz string) {
 	u.modules[name] = n
 }
 
+// RemoveModule removes the named module container from its region.
+func (u *UI) RemoveModule(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	n, ok := u.modules[name].(*moduleNode)
+	if !ok {
+		return
+	}
+	delete(u.modules, name)
+
+	for _, r := range u.regions {
+		r.removeModule(n)
+	}
+	u.win.Invalidate()
+}
+
+// MoveModule moves the named module container to the given region,
+// keeping its current widget tree.
+func (u *UI) MoveModule(name, vert, horiz string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	n, ok := u.modules[name].(*moduleNode)
+	if !ok {
+		return
+	}
+
+	for _, r := range u.regions {
+		r.removeModule(n)
+	}
+
+	key := vert + ":" + horiz
+	r, ok := u.regions[key]
+	if !ok {
+		r = &region{vert: vert, horiz: horiz}
+		u.regions[key] = r
+	}
+	r.addModule(n)
+	u.win.Invalidate()
+}
+
 // ModuleUI returns a ModuleUI scoped to the named module.
 func (u *UI) ModuleUI(name string) ModuleUI {
 	u.mu.RLock()
@@ -273,6 +315,13 @@ func (r *region) addModule(node *moduleNode) {
 	r.modules = append(r.modules, node)
 }
 
+func (r *region) removeModule(node *moduleNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.modules = slices.DeleteFunc(r.modules, func(m *moduleNode) bool { return m == node })
+}
+
 func (r *region) size(gtx layout.Context, shaper *text.Shaper) image.Point {
 	r.mu.RLock()
 	mods := append([]*moduleNode(nil), r.modules...)